@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,8 +11,20 @@ import (
 	"github.com/bitly/go-simplejson"
 )
 
-func Request(req *http.Request) (*simplejson.Json, error) {
-	resp, err := http.DefaultClient.Do(req)
+// StatusError is a response with a status other than 200
+type StatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got %d %s", e.StatusCode, e.Body)
+}
+
+// Request sends req with client (http.DefaultClient if nil) and parses the
+// JSON response
+func Request(client *http.Client, req *http.Request) (*simplejson.Json, error) {
+	resp, err := do(client, req)
 	if err != nil {
 		log.Printf("%s %s %s", req.Method, req.URL, err)
 		return nil, err
@@ -23,7 +36,7 @@ func Request(req *http.Request) (*simplejson.Json, error) {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("got %d %s", resp.StatusCode, body)
+		return nil, &StatusError{resp.StatusCode, body}
 	}
 	data, err := simplejson.NewJson(body)
 	if err != nil {
@@ -32,8 +45,10 @@ func Request(req *http.Request) (*simplejson.Json, error) {
 	return data, nil
 }
 
-func RequestJson(req *http.Request, v interface{}) error {
-	resp, err := http.DefaultClient.Do(req)
+// RequestJson sends req with client (http.DefaultClient if nil) and
+// unmarshals the JSON response into v
+func RequestJson(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := do(client, req)
 	if err != nil {
 		log.Printf("%s %s %s", req.Method, req.URL, err)
 		return err
@@ -45,17 +60,24 @@ func RequestJson(req *http.Request, v interface{}) error {
 		return err
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("got %d %s", resp.StatusCode, body)
+		return &StatusError{resp.StatusCode, body}
 	}
 	return json.Unmarshal(body, v)
 }
 
-func RequestUnparsedResponse(url string, header http.Header) (resp *http.Response, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+func RequestUnparsedResponse(ctx context.Context, client *http.Client, url string, header http.Header) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = header
 
-	return http.DefaultClient.Do(req)
+	return do(client, req)
+}
+
+func do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"github.com/bitly/go-simplejson"
 	"io/ioutil"
 	"net/http"
@@ -24,7 +25,7 @@ func TestRequest(t *testing.T) {
 	defer backend.Close()
 
 	req, _ := http.NewRequest("GET", backend.URL, nil)
-	response, err := Request(req)
+	response, err := Request(nil, req)
 	assert.Equal(t, nil, err)
 	result, err := response.Get("foo").String()
 	assert.Equal(t, nil, err)
@@ -39,7 +40,7 @@ func TestRequestFailure(t *testing.T) {
 
 	req, err := http.NewRequest("GET", backend.URL, nil)
 	assert.Equal(t, nil, err)
-	resp, err := Request(req)
+	resp, err := Request(nil, req)
 	assert.Equal(t, (*simplejson.Json)(nil), resp)
 	assert.NotEqual(t, nil, err)
 	if !strings.Contains(err.Error(), "refused") {
@@ -53,7 +54,7 @@ func TestHttpErrorCode(t *testing.T) {
 
 	req, err := http.NewRequest("GET", backend.URL, nil)
 	assert.Equal(t, nil, err)
-	resp, err := Request(req)
+	resp, err := Request(nil, req)
 	assert.Equal(t, (*simplejson.Json)(nil), resp)
 	assert.NotEqual(t, nil, err)
 }
@@ -64,7 +65,7 @@ func TestJsonParsingError(t *testing.T) {
 
 	req, err := http.NewRequest("GET", backend.URL, nil)
 	assert.Equal(t, nil, err)
-	resp, err := Request(req)
+	resp, err := Request(nil, req)
 	assert.Equal(t, (*simplejson.Json)(nil), resp)
 	assert.NotEqual(t, nil, err)
 }
@@ -83,7 +84,7 @@ func TestRequestUnparsedResponseUsingAccessTokenParameter(t *testing.T) {
 		}))
 	defer backend.Close()
 
-	response, err := RequestUnparsedResponse(
+	response, err := RequestUnparsedResponse(context.Background(), nil,
 		backend.URL+"?access_token=my_token", nil)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 200, response.StatusCode)
@@ -98,7 +99,7 @@ func TestRequestUnparsedResponseUsingAccessTokenParameterFailedResponse(t *testi
 	// Close the backend now to force a request failure.
 	backend.Close()
 
-	response, err := RequestUnparsedResponse(
+	response, err := RequestUnparsedResponse(context.Background(), nil,
 		backend.URL+"?access_token=my_token", nil)
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, (*http.Response)(nil), response)
@@ -118,7 +119,7 @@ func TestRequestUnparsedResponseUsingHeaders(t *testing.T) {
 
 	headers := make(http.Header)
 	headers.Set("Auth", "my_token")
-	response, err := RequestUnparsedResponse(backend.URL, headers)
+	response, err := RequestUnparsedResponse(context.Background(), nil, backend.URL, headers)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 200, response.StatusCode)
 	body, err := ioutil.ReadAll(response.Body)
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+// AuthzRule restricts the requests it matches (by path regex, method and host)
+// to the allowed emails, email domains and groups, or allows them without
+// authentication ("public"). A rule with no allowed emails, domains or groups
+// allows any authenticated user.
+//
+// The spec is space separated, e.g.
+//
+//	path=^/admin/ method=POST,DELETE host=app.example.com groups=ops,sre
+//	path=^/status$ public
+type AuthzRule struct {
+	spec    string
+	path    *regexp.Regexp
+	methods []string
+	host    string
+	public  bool
+	emails  []string
+	domains []string
+	groups  []string
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func parseAuthzRule(spec string) (*AuthzRule, error) {
+	r := &AuthzRule{spec: spec}
+	for _, field := range strings.Fields(spec) {
+		if field == "public" {
+			r.public = true
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "path":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path: %s", err)
+			}
+			r.path = re
+		case "method":
+			for _, m := range splitList(value) {
+				r.methods = append(r.methods, strings.ToUpper(m))
+			}
+		case "host":
+			r.host = strings.ToLower(value)
+		case "emails":
+			for _, e := range splitList(value) {
+				r.emails = append(r.emails, strings.ToLower(e))
+			}
+		case "domains":
+			for _, d := range splitList(value) {
+				r.domains = append(r.domains, "@"+strings.ToLower(strings.TrimPrefix(d, "@")))
+			}
+		case "groups":
+			r.groups = splitList(value)
+		default:
+			return nil, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	if r.public && (len(r.emails) > 0 || len(r.domains) > 0 || len(r.groups) > 0) {
+		return nil, fmt.Errorf("a public rule can not have emails, domains or groups")
+	}
+	return r, nil
+}
+
+func (r *AuthzRule) String() string {
+	return r.spec
+}
+
+// cleanPath is p without "//", "." or ".." elements, as the upstream would
+// resolve it, so that rules can not be bypassed with e.g. "//admin/". A
+// trailing slash is kept.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Matches returns true if the rule applies to req
+func (r *AuthzRule) Matches(req *http.Request) bool {
+	if r.path != nil && !r.path.MatchString(cleanPath(req.URL.Path)) {
+		return false
+	}
+	if len(r.methods) > 0 {
+		found := false
+		for _, m := range r.methods {
+			found = found || m == req.Method
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.host != "" {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if strings.HasPrefix(r.host, "*.") {
+			if !strings.HasSuffix(host, r.host[1:]) {
+				return false
+			}
+		} else if host != r.host {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows returns true if the session's user is allowed by the rule
+func (r *AuthzRule) Allows(s *providers.SessionState) bool {
+	if r.public {
+		return true
+	}
+	if s == nil {
+		return false
+	}
+	if len(r.emails) == 0 && len(r.domains) == 0 && len(r.groups) == 0 {
+		return true
+	}
+	email := strings.ToLower(s.Email)
+	if email != "" {
+		for _, e := range r.emails {
+			if email == e {
+				return true
+			}
+		}
+		for _, d := range r.domains {
+			if strings.HasSuffix(email, d) {
+				return true
+			}
+		}
+	}
+	for _, g := range r.groups {
+		for _, sg := range s.Groups {
+			if g == sg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchAuthzRule returns the first rule which matches req, or nil
+func matchAuthzRule(rules []*AuthzRule, req *http.Request) *AuthzRule {
+	for _, r := range rules {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// authOnlyAllows checks the allowed_groups and allowed_emails query parameters
+// of an /oauth2/auth request, so that nginx can require different users for
+// each location. Each may be given multiple times or as a comma separated list,
+// and the session must be in any of the listed groups and have any of the
+// listed emails.
+func authOnlyAllows(req *http.Request, s *providers.SessionState) bool {
+	query := req.URL.Query()
+	if values, ok := query["allowed_groups"]; ok {
+		found := false
+		for _, v := range values {
+			for _, g := range splitList(v) {
+				for _, sg := range s.Groups {
+					found = found || g == sg
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if values, ok := query["allowed_emails"]; ok {
+		found := false
+		for _, v := range values {
+			for _, e := range splitList(v) {
+				found = found || (s.Email != "" && strings.EqualFold(e, s.Email))
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
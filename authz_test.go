@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ploxiln/oauth2_proxy/policy"
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+func mustParseAuthzRules(t *testing.T, specs ...string) []*AuthzRule {
+	var rules []*AuthzRule
+	for _, spec := range specs {
+		rule, err := parseAuthzRule(spec)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", spec, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func TestParseAuthzRuleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"path=[",
+		"path",
+		"path=",
+		"users=bob",
+		"path=^/status public groups=ops",
+	} {
+		_, err := parseAuthzRule(spec)
+		assert.NotEqual(t, nil, err, spec)
+	}
+}
+
+func TestAuthzRuleMatches(t *testing.T) {
+	rules := mustParseAuthzRules(t,
+		"path=^/admin/ method=post,DELETE groups=ops",
+		"host=*.internal.example.com domains=example.com",
+		"host=app.example.com path=^/status$ public",
+		"path=^/",
+	)
+	cases := []struct {
+		method, url string
+		rule        int
+	}{
+		{"POST", "http://app.example.com/admin/users", 0},
+		{"DELETE", "http://app.example.com/admin/users", 0},
+		{"GET", "http://app.example.com/admin/users", 3},
+		{"GET", "http://wiki.internal.example.com:8080/admin/", 1},
+		{"GET", "http://internal.example.com/", 3},
+		{"GET", "http://APP.example.com:443/status", 2},
+		{"GET", "http://other.example.com/status", 3},
+		// paths are matched as the upstream would resolve them
+		{"POST", "http://app.example.com//admin/users", 0},
+		{"POST", "http://app.example.com/./admin/users", 0},
+		{"POST", "http://app.example.com/app/../admin/users", 0},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.url, nil)
+		assert.Equal(t, rules[c.rule], matchAuthzRule(rules, req), c.method+" "+c.url)
+	}
+	assert.Equal(t, (*AuthzRule)(nil), matchAuthzRule(rules[:3], httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, c := range []struct{ path, expected string }{
+		{"", "/"},
+		{"/", "/"},
+		{"//", "/"},
+		{"/admin", "/admin"},
+		{"/admin/", "/admin/"},
+		{"//admin//users/", "/admin/users/"},
+		{"/./admin/.", "/admin"},
+		{"/app/../admin/", "/admin/"},
+		{"/../../admin", "/admin"},
+	} {
+		assert.Equal(t, c.expected, cleanPath(c.path), c.path)
+	}
+}
+
+func TestAuthzRuleAllows(t *testing.T) {
+	rule := mustParseAuthzRules(t, "emails=Alice@example.com domains=@ops.example.com groups=ops,sre")[0]
+	assert.Equal(t, true, rule.Allows(&providers.SessionState{Email: "alice@EXAMPLE.com"}))
+	assert.Equal(t, true, rule.Allows(&providers.SessionState{Email: "bob@ops.example.com"}))
+	assert.Equal(t, true, rule.Allows(&providers.SessionState{Email: "carol@example.com", Groups: []string{"dev", "sre"}}))
+	assert.Equal(t, true, rule.Allows(&providers.SessionState{User: "dave", Groups: []string{"ops"}}))
+	assert.Equal(t, false, rule.Allows(&providers.SessionState{Email: "bob@example.com", Groups: []string{"dev"}}))
+	assert.Equal(t, false, rule.Allows(&providers.SessionState{Email: "bob@notops.example.com"}))
+	assert.Equal(t, false, rule.Allows(nil))
+
+	anyone := mustParseAuthzRules(t, "path=^/")[0]
+	assert.Equal(t, true, anyone.Allows(&providers.SessionState{Email: "bob@example.com"}))
+	assert.Equal(t, false, anyone.Allows(nil))
+
+	public := mustParseAuthzRules(t, "path=^/ public")[0]
+	assert.Equal(t, true, public.Allows(nil))
+}
+
+func TestProxyAuthzRules(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{ProviderName: "Test Provider"},
+		ValidToken:   true,
+	}
+	test.proxy.authzRules = mustParseAuthzRules(t,
+		"path=^/admin groups=ops",
+		"path=^/health$ method=GET public",
+	)
+	upstream := http.NewServeMux()
+	upstream.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	})
+	test.proxy.serveMux = upstream
+
+	serve := func(method, path string, session *providers.SessionState) int {
+		test.req = httptest.NewRequest(method, path, nil)
+		if session != nil {
+			test.SaveSession(session, time.Now())
+		}
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw.Code
+	}
+
+	user := &providers.SessionState{Email: "bob@example.com", User: "bob", AccessToken: "token"}
+	ops := &providers.SessionState{Email: "alice@example.com", User: "alice", AccessToken: "token", Groups: []string{"ops"}}
+	assert.Equal(t, 200, serve("GET", "/app", user))
+	assert.Equal(t, 403, serve("GET", "/admin/users", user))
+	assert.Equal(t, 200, serve("GET", "/admin/users", ops))
+	// unauthenticated is still the sign in page
+	assert.Equal(t, 403, serve("GET", "/app", nil))
+	assert.Equal(t, 200, serve("GET", "/health", nil))
+	assert.Equal(t, 403, serve("POST", "/health", nil))
+}
+
+func TestAuthOnlyEndpointAuthzRules(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{ProviderName: "Test Provider"},
+		ValidToken:   true,
+	}
+	test.proxy.authzRules = mustParseAuthzRules(t,
+		"path=^/admin/ groups=ops",
+		"path=^/api/ method=DELETE groups=ops",
+		"path=^/health$ public",
+	)
+
+	auth := func(uri, method string, session *providers.SessionState) int {
+		test.req = httptest.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+		test.req.Header.Set("X-Original-URI", uri)
+		if method != "" {
+			test.req.Header.Set("X-Original-Method", method)
+		}
+		if session != nil {
+			test.SaveSession(session, time.Now())
+		}
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw.Code
+	}
+
+	user := &providers.SessionState{Email: "bob@example.com", User: "bob", AccessToken: "token"}
+	ops := &providers.SessionState{Email: "alice@example.com", User: "alice", AccessToken: "token", Groups: []string{"ops"}}
+	assert.Equal(t, 202, auth("/app", "", user))
+	assert.Equal(t, 403, auth("/admin/users", "", user))
+	assert.Equal(t, 403, auth("//admin/users", "", user))
+	assert.Equal(t, 403, auth("/app/../admin/users", "", user))
+	assert.Equal(t, 202, auth("/admin/users", "", ops))
+	assert.Equal(t, 202, auth("/api/items", "GET", user))
+	assert.Equal(t, 403, auth("/api/items", "DELETE", user))
+	assert.Equal(t, 202, auth("/api/items", "DELETE", ops))
+	assert.Equal(t, 401, auth("/app", "", nil))
+	assert.Equal(t, 202, auth("/health", "", nil))
+}
+
+func TestProxyPolicies(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{ProviderName: "Test Provider"},
+		ValidToken:   true,
+	}
+	for _, src := range []string{
+		`admins: !startsWith(request.path, "/admin") || "ops" in groups`,
+		`provider == "Test Provider" && request.method != "DELETE"`,
+	} {
+		p, err := policy.Compile(src)
+		assert.Equal(t, nil, err)
+		test.proxy.policies = append(test.proxy.policies, p)
+	}
+	upstream := http.NewServeMux()
+	upstream.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	})
+	test.proxy.serveMux = upstream
+
+	serve := func(method, path string, session *providers.SessionState) *httptest.ResponseRecorder {
+		test.req = httptest.NewRequest(method, path, nil)
+		if session != nil {
+			test.SaveSession(session, time.Now())
+		}
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw
+	}
+
+	user := &providers.SessionState{Email: "bob@example.com", User: "bob", AccessToken: "token"}
+	ops := &providers.SessionState{Email: "alice@example.com", User: "alice", AccessToken: "token", Groups: []string{"ops"}}
+	assert.Equal(t, 200, serve("GET", "/app", user).Code)
+	rw := serve("GET", "/admin/users", user)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Permission Denied")
+	assert.Equal(t, 200, serve("GET", "/admin/users", ops).Code)
+	assert.Equal(t, 403, serve("DELETE", "/admin/users", ops).Code)
+	// the path is cleaned as for authz-rules
+	assert.Equal(t, 403, serve("GET", "//admin/users", user).Code)
+	assert.Equal(t, 403, serve("GET", "/app/../admin/users", user).Code)
+	// unauthenticated is the sign in page
+	rw = serve("GET", "/app", nil)
+	assert.Equal(t, 403, rw.Code)
+	assert.NotContains(t, rw.Body.String(), "Permission Denied")
+
+	// the auth endpoint checks the original request
+	auth := func(uri, method string, session *providers.SessionState) int {
+		test.req = httptest.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+		test.req.Header.Set("X-Original-URI", uri)
+		test.req.Header.Set("X-Original-Method", method)
+		test.SaveSession(session, time.Now())
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw.Code
+	}
+	assert.Equal(t, 202, auth("/app", "GET", user))
+	assert.Equal(t, 403, auth("/admin/users", "GET", user))
+	assert.Equal(t, 403, auth("//admin/users", "GET", user))
+	assert.Equal(t, 202, auth("/admin/users", "GET", ops))
+	assert.Equal(t, 403, auth("/admin/users", "DELETE", ops))
+}
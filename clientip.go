@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// anyNetwork trusts the real-client-ip-header from any client, which is
+// only used for logging when there are no trusted proxies
+var anyNetwork = []*net.IPNet{
+	{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+	{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+}
+
+// parseCIDR parses a network, or a single address as a network of one
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the addresses in the "for" parameters of RFC 7239
+// Forwarded headers, e.g. `for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"`.
+// Obfuscated identifiers and "unknown" are returned as is, and do not parse
+// as addresses.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = strings.Trim(kv[1], `"`)
+				}
+			}
+			if strings.HasPrefix(hop, "[") {
+				hop = strings.SplitN(hop[1:], "]", 2)[0]
+			} else if h, _, err := net.SplitHostPort(hop); err == nil {
+				hop = h
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// realClientIP returns the client's ip address. The header is only used for
+// requests from the trusted proxies. X-Forwarded-For and Forwarded, which
+// each proxy appends to, are read from the right, skipping the trusted
+// proxies, because any client can send its own; other headers (e.g.
+// X-Real-IP) have a single address set by the proxy.
+func realClientIP(req *http.Request, header string, trusted []*net.IPNet) net.IP {
+	host := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if header == "" || !containsIP(trusted, ip) {
+		return ip
+	}
+	var hops []string
+	switch header {
+	case "X-Forwarded-For":
+		for _, v := range req.Header.Values(header) {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	case "Forwarded":
+		hops = forwardedFor(req.Header.Values(header))
+	default:
+		hops = []string{req.Header.Get(header)}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hip == nil {
+			break
+		}
+		ip = hip
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// trustedClientIP returns the client's ip address from the header set by a
+// trusted proxy, or nil if req is not from a trusted proxy, or the header does
+// not have an address beyond the trusted proxies. Without a trusted proxy in
+// front, many clients may share the connection's address.
+func trustedClientIP(req *http.Request, header string, trusted []*net.IPNet) net.IP {
+	remote := realClientIP(req, "", nil)
+	if header == "" || !containsIP(trusted, remote) {
+		return nil
+	}
+	ip := realClientIP(req, header, trusted)
+	if containsIP(trusted, ip) {
+		return nil
+	}
+	return ip
+}
+
+// loggedTrustedProxies is trusted, or without any trusted proxies anyNetwork,
+// so that the real-client-ip-header is still logged for any client
+func loggedTrustedProxies(trusted []*net.IPNet) []*net.IPNet {
+	if len(trusted) == 0 {
+		return anyNetwork
+	}
+	return trusted
+}
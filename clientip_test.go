@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseCIDRs(t *testing.T, specs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		ipNet, err := parseCIDR(spec)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", spec, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func TestRealClientIP(t *testing.T) {
+	trusted := mustParseCIDRs(t, "10.0.0.0/8", "192.168.0.1")
+	cases := []struct {
+		remote, header, value, ip string
+	}{
+		{"203.0.113.7:1234", "X-Real-IP", "198.51.100.1", "203.0.113.7"},
+		{"10.0.0.1:1234", "X-Real-IP", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Real-IP", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "1.1.1.1, 198.51.100.1, 192.168.0.1, 10.2.3.4", "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "10.2.3.4", "10.2.3.4"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "garbage, 10.2.3.4", "10.2.3.4"},
+		{"192.168.0.2:1234", "X-Forwarded-For", "1.1.1.1", "192.168.0.2"},
+		{"[::1]:1234", "X-Forwarded-For", "1.1.1.1", "::1"},
+		{"10.0.0.1:1234", "X-ProxyUser-IP", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "Forwarded", `for=1.1.1.1, for=198.51.100.1;proto=https;by=10.0.0.1`, "198.51.100.1"},
+		{"10.0.0.1:1234", "Forwarded", `for="[2001:db8::17]:4711", For="10.2.3.4:80"`, "2001:db8::17"},
+		{"10.0.0.1:1234", "Forwarded", `for=198.51.100.1:4711`, "198.51.100.1"},
+		{"10.0.0.1:1234", "Forwarded", `for=1.1.1.1, for=_hidden, for=10.2.3.4`, "10.2.3.4"},
+		{"10.0.0.1:1234", "Forwarded", `for=unknown`, "10.0.0.1"},
+		{"10.0.0.1:1234", "Forwarded", `proto=https`, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		if c.header != "" && c.value != "" {
+			req.Header.Set(c.header, c.value)
+		}
+		assert.Equal(t, c.ip, realClientIP(req, c.header, trusted).String(), c.remote+" "+c.value)
+	}
+
+	// multiple X-Forwarded-For headers are one list
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Add("X-Forwarded-For", "1.1.1.1")
+	req.Header.Add("X-Forwarded-For", "198.51.100.1, 10.2.3.4")
+	assert.Equal(t, "198.51.100.1", realClientIP(req, "X-Forwarded-For", trusted).String())
+}
+
+func TestRealClientIPAnyNetwork(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 1.1.1.1")
+	assert.Equal(t, "203.0.113.7", realClientIP(req, "X-Forwarded-For", nil).String())
+	assert.Equal(t, "198.51.100.1", realClientIP(req, "X-Forwarded-For", loggedTrustedProxies(nil)).String())
+
+	req.RemoteAddr = "[2001:db8::1]:1234"
+	assert.Equal(t, "198.51.100.1", realClientIP(req, "X-Forwarded-For", loggedTrustedProxies(nil)).String())
+}
+
+func TestTrustedClientIP(t *testing.T) {
+	trusted := mustParseCIDRs(t, "10.0.0.0/8")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+	assert.Equal(t, "198.51.100.1", trustedClientIP(req, "X-Real-IP", trusted).String())
+	assert.Equal(t, net.IP(nil), trustedClientIP(req, "", trusted))
+	assert.Equal(t, net.IP(nil), trustedClientIP(req, "X-Real-IP", nil))
+
+	// not set by the proxy
+	req.Header.Del("X-Real-IP")
+	assert.Equal(t, net.IP(nil), trustedClientIP(req, "X-Real-IP", trusted))
+
+	// not from a trusted proxy
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+	assert.Equal(t, net.IP(nil), trustedClientIP(req, "X-Real-IP", trusted))
+}
+
+func TestGetRemoteAddr(t *testing.T) {
+	opts := testOptions()
+	opts.TrustedProxies = []string{"10.0.0.0/8"}
+	opts.RealClientIPHeader = "x-forwarded-for"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 198.51.100.1")
+	assert.Equal(t, `10.0.0.1:1234 ("198.51.100.1")`, proxy.getRemoteAddr(req))
+
+	req.RemoteAddr = "203.0.113.7:1234"
+	assert.Equal(t, "203.0.113.7:1234", proxy.getRemoteAddr(req))
+
+	req = req.WithContext(providers.WithRequestID(req.Context(), "abc123"))
+	assert.Equal(t, "203.0.113.7:1234 [request abc123]", proxy.getRemoteAddr(req))
+}
@@ -5,8 +5,12 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 	"time"
+
+	"github.com/ploxiln/oauth2_proxy/cookie"
+	"github.com/ploxiln/oauth2_proxy/providers"
 )
 
 type Server struct {
@@ -109,20 +113,6 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
-// extract client ip address from configured header
-func extractClientIP(req *http.Request, header string) string {
-	if header != "" {
-		val := req.Header.Get(header)
-		if val != "" {
-			if header == "X-Forwarded-For" {
-				val = strings.TrimSpace(strings.SplitN(val, ",", 2)[0])
-			}
-			return val
-		}
-	}
-	return ""
-}
-
 func redirectToHTTPS(h http.Handler, httpsAddr string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
@@ -141,3 +131,27 @@ func redirectToHTTPS(h http.Handler, httpsAddr string) http.Handler {
 		}
 	})
 }
+
+// validRequestID limits the request ids taken from clients, as they are logged
+// and sent on to the provider and upstream
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// withRequestID sets the id of each request in its context, so that it is sent
+// with the requests to the provider and logged. The id is taken from header if
+// the client sent a valid one, else a new unique id is set in header, which is
+// passed to the upstream.
+func withRequestID(h http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !validRequestID.MatchString(id) {
+			var err error
+			if id, err = cookie.Nonce(); err != nil {
+				log.Printf("error generating a request id: %s", err)
+				h.ServeHTTP(w, r)
+				return
+			}
+			r.Header.Set(header, id)
+		}
+		h.ServeHTTP(w, r.WithContext(providers.WithRequestID(r.Context(), id)))
+	})
+}
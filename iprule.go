@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type ipRuleAction int
+
+const (
+	ipSkipAuth ipRuleAction = iota + 1
+	ipAuth
+	ipDeny
+)
+
+// IPRule applies to requests from the client networks it matches (and by path
+// regex and method), and either allows them without authentication
+// ("skip-auth"), requires authentication even if they would be allowed without
+// by --skip-auth-regex or a public authz-rule ("auth"), or denies them ("deny").
+//
+// The spec is space separated, e.g.
+//
+//	cidr=10.0.0.0/8,192.168.1.0/24 skip-auth
+//	path=^/admin/ cidr=10.0.0.0/8 auth
+//	path=^/admin/ deny
+type IPRule struct {
+	spec    string
+	nets    []*net.IPNet
+	path    *regexp.Regexp
+	methods []string
+	action  ipRuleAction
+}
+
+func parseIPRule(spec string) (*IPRule, error) {
+	r := &IPRule{spec: spec}
+	for _, field := range strings.Fields(spec) {
+		var action ipRuleAction
+		switch field {
+		case "skip-auth":
+			action = ipSkipAuth
+		case "auth":
+			action = ipAuth
+		case "deny":
+			action = ipDeny
+		}
+		if action != 0 {
+			if r.action != 0 {
+				return nil, fmt.Errorf("more than one of skip-auth, auth or deny")
+			}
+			r.action = action
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "cidr":
+			for _, c := range splitList(value) {
+				ipNet, err := parseCIDR(c)
+				if err != nil {
+					return nil, err
+				}
+				r.nets = append(r.nets, ipNet)
+			}
+		case "path":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path: %s", err)
+			}
+			r.path = re
+		case "method":
+			for _, m := range splitList(value) {
+				r.methods = append(r.methods, strings.ToUpper(m))
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	if r.action == 0 {
+		return nil, fmt.Errorf("one of skip-auth, auth or deny is required")
+	}
+	return r, nil
+}
+
+func (r *IPRule) String() string {
+	return r.spec
+}
+
+// Matches returns true if the rule applies to req from the client ip
+func (r *IPRule) Matches(req *http.Request, ip net.IP) bool {
+	if len(r.nets) > 0 && !containsIP(r.nets, ip) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(cleanPath(req.URL.Path)) {
+		return false
+	}
+	if len(r.methods) > 0 {
+		found := false
+		for _, m := range r.methods {
+			found = found || m == req.Method
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// SkipsAuth, RequiresAuth and Denies are false for a nil rule
+
+func (r *IPRule) SkipsAuth() bool    { return r != nil && r.action == ipSkipAuth }
+func (r *IPRule) RequiresAuth() bool { return r != nil && r.action == ipAuth }
+func (r *IPRule) Denies() bool       { return r != nil && r.action == ipDeny }
+
+// matchIPRule returns the first rule which matches req from the client ip, or nil
+func matchIPRule(rules []*IPRule, req *http.Request, ip net.IP) *IPRule {
+	for _, r := range rules {
+		if r.Matches(req, ip) {
+			return r
+		}
+	}
+	return nil
+}
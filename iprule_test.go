@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+func mustParseIPRules(t *testing.T, specs ...string) []*IPRule {
+	var rules []*IPRule
+	for _, spec := range specs {
+		rule, err := parseIPRule(spec)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", spec, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func TestParseIPRuleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"cidr=10.0.0.0/8",
+		"cidr=10.0.0.0/33 deny",
+		"cidr=10.0.0.x deny",
+		"path=[ deny",
+		"cidr=10.0.0.0/8 skip-auth deny",
+		"cidr deny",
+		"hosts=example.com deny",
+	} {
+		_, err := parseIPRule(spec)
+		assert.NotEqual(t, nil, err, spec)
+	}
+}
+
+func TestIPRuleMatches(t *testing.T) {
+	rules := mustParseIPRules(t,
+		"path=^/admin/ cidr=10.0.0.0/8,fd00::/8 auth",
+		"path=^/admin/ deny",
+		"cidr=192.168.1.0/24,203.0.113.7 method=GET skip-auth",
+	)
+	cases := []struct {
+		method, path, ip string
+		rule             int
+	}{
+		{"GET", "/admin/users", "10.1.2.3", 0},
+		{"GET", "/admin/users", "fd00::1", 0},
+		{"GET", "/admin/users", "192.168.1.5", 1},
+		{"GET", "//admin/users", "192.168.1.5", 1},
+		{"GET", "/./admin/users", "192.168.1.5", 1},
+		{"GET", "/app/../admin/users", "192.168.1.5", 1},
+		{"GET", "/app", "192.168.1.5", 2},
+		{"GET", "/app", "203.0.113.7", 2},
+		{"POST", "/app", "192.168.1.5", -1},
+		{"GET", "/app", "203.0.113.8", -1},
+		{"GET", "/app", "", -1},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		var expected *IPRule
+		if c.rule >= 0 {
+			expected = rules[c.rule]
+		}
+		assert.Equal(t, expected, matchIPRule(rules, req, net.ParseIP(c.ip)), c.method+" "+c.path+" "+c.ip)
+	}
+}
+
+func TestProxyIPRules(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{ProviderName: "Test Provider"},
+		ValidToken:   true,
+	}
+	test.proxy.ClientIPHeader = "X-Real-IP"
+	test.proxy.trustedProxies = mustParseCIDRs(t, "127.0.0.1")
+	test.proxy.compiledRegex = []*regexp.Regexp{regexp.MustCompile("^/public/")}
+	test.proxy.ipRules = mustParseIPRules(t,
+		"path=^/admin/ cidr=10.0.0.0/8 auth",
+		"path=^/admin/ deny",
+		"path=^/public/ cidr=198.51.100.0/24 auth",
+		"cidr=10.0.0.0/8 skip-auth",
+	)
+	upstream := http.NewServeMux()
+	upstream.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	})
+	test.proxy.serveMux = upstream
+
+	serve := func(path, remote, realIP string, session *providers.SessionState) *httptest.ResponseRecorder {
+		test.req = httptest.NewRequest("GET", path, nil)
+		test.req.RemoteAddr = remote
+		if realIP != "" {
+			test.req.Header.Set("X-Real-IP", realIP)
+		}
+		if session != nil {
+			test.SaveSession(session, time.Now())
+		}
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw
+	}
+	status := func(path, remote, realIP string, session *providers.SessionState) int {
+		return serve(path, remote, realIP, session).Code
+	}
+	denied := func(path, remote, realIP string, session *providers.SessionState) bool {
+		rw := serve(path, remote, realIP, session)
+		return rw.Code == 403 && strings.Contains(rw.Body.String(), "Permission Denied")
+	}
+
+	user := &providers.SessionState{Email: "bob@example.com", User: "bob", AccessToken: "token"}
+	// the office network skips authentication, except for /admin/
+	assert.Equal(t, 200, status("/app", "127.0.0.1:1234", "10.1.2.3", nil))
+	assert.Equal(t, 202, status("/oauth2/auth", "127.0.0.1:1234", "10.1.2.3", nil))
+	assert.Equal(t, false, denied("/admin/users", "127.0.0.1:1234", "10.1.2.3", nil))
+	assert.Equal(t, 403, status("/admin/users", "127.0.0.1:1234", "10.1.2.3", nil))
+	assert.Equal(t, 200, status("/admin/users", "127.0.0.1:1234", "10.1.2.3", user))
+	// others must sign in, and can not reach /admin/
+	assert.Equal(t, 403, status("/app", "127.0.0.1:1234", "203.0.113.7", nil))
+	assert.Equal(t, 200, status("/app", "127.0.0.1:1234", "203.0.113.7", user))
+	assert.Equal(t, true, denied("/admin/users", "127.0.0.1:1234", "203.0.113.7", user))
+	assert.Equal(t, true, denied("//admin/users", "127.0.0.1:1234", "203.0.113.7", user))
+	assert.Equal(t, true, denied("/app/../admin/users", "127.0.0.1:1234", "203.0.113.7", user))
+	// the header is not trusted from others
+	assert.Equal(t, 403, status("/app", "203.0.113.7:1234", "10.1.2.3", nil))
+	// skip-auth-regex paths require authentication from some networks
+	assert.Equal(t, 200, status("/public/x", "127.0.0.1:1234", "203.0.113.7", nil))
+	assert.Equal(t, 403, status("/public/x", "127.0.0.1:1234", "198.51.100.1", nil))
+	// robots.txt and ping are not affected
+	assert.Equal(t, 200, status("/robots.txt", "127.0.0.1:1234", "192.0.2.1", nil))
+	// the proxy's own endpoints are not sent to the upstream by skip-auth
+	rw := serve("/oauth2/sign_in", "127.0.0.1:1234", "10.1.2.3", nil)
+	assert.NotContains(t, rw.Body.String(), "upstream")
+	assert.Contains(t, rw.Body.String(), "Sign in")
+
+	// the auth endpoint matches the original request
+	auth := func(uri, realIP string, session *providers.SessionState) int {
+		test.req = httptest.NewRequest("GET", "/oauth2/auth", nil)
+		test.req.RemoteAddr = "127.0.0.1:1234"
+		test.req.Header.Set("X-Real-IP", realIP)
+		test.req.Header.Set("X-Original-URI", uri)
+		if session != nil {
+			test.SaveSession(session, time.Now())
+		}
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw.Code
+	}
+	assert.Equal(t, 202, auth("/app", "10.1.2.3", nil))
+	assert.Equal(t, 401, auth("/admin/users", "10.1.2.3", nil))
+	assert.Equal(t, 202, auth("/admin/users", "10.1.2.3", user))
+	assert.Equal(t, 202, auth("/app", "203.0.113.7", user))
+	assert.Equal(t, 403, auth("/admin/users", "203.0.113.7", user))
+	assert.Equal(t, 403, auth("//admin/users", "203.0.113.7", user))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LoginLimiter counts failed password logins by key (e.g. the username or the
+// client address), and locks a key out after threshold consecutive failures,
+// for lockout, doubling with each further failure up to max. A key's failures
+// are forgotten after max without a failure. A nil LoginLimiter allows all.
+type LoginLimiter struct {
+	threshold int
+	lockout   time.Duration
+	max       time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	nextPrune time.Time
+	now       func() time.Time
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func NewLoginLimiter(threshold int, lockout, max time.Duration) *LoginLimiter {
+	if threshold <= 0 {
+		return nil
+	}
+	if max < lockout {
+		max = lockout
+	}
+	return &LoginLimiter{
+		threshold: threshold,
+		lockout:   lockout,
+		max:       max,
+		failures:  make(map[string]*loginFailures),
+		now:       time.Now,
+	}
+}
+
+// Locked returns how long until none of the keys are locked out, or 0
+func (l *LoginLimiter) Locked(keys ...string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	for _, k := range keys {
+		if f, ok := l.failures[k]; ok {
+			if d := f.lockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// Failure records a failed login for each of the keys, and returns the
+// longest lockout this started, or 0
+func (l *LoginLimiter) Failure(keys ...string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	var wait time.Duration
+	for _, k := range keys {
+		f, ok := l.failures[k]
+		if !ok || now.Sub(f.last) > l.max {
+			f = &loginFailures{}
+			l.failures[k] = f
+		}
+		f.count++
+		f.last = now
+		if f.count < l.threshold {
+			continue
+		}
+		d := l.lockout
+		for i := l.threshold; i < f.count && d < l.max; i++ {
+			d *= 2
+		}
+		if d > l.max {
+			d = l.max
+		}
+		f.lockedUntil = now.Add(d)
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// Success forgets the failures of the keys
+func (l *LoginLimiter) Success(keys ...string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		delete(l.failures, k)
+	}
+}
+
+// prune forgets expired failures, at most every max, so that failures for
+// many usernames or addresses do not accumulate
+func (l *LoginLimiter) prune(now time.Time) {
+	if now.Before(l.nextPrune) {
+		return
+	}
+	l.nextPrune = now.Add(l.max)
+	for k, f := range l.failures {
+		if now.Sub(f.last) > l.max && now.After(f.lockedUntil) {
+			delete(l.failures, k)
+		}
+	}
+}
+
+// loginLockedError is returned for a login while it is locked out
+type loginLockedError struct {
+	user       string
+	retryAfter time.Duration
+}
+
+func (e *loginLockedError) Error() string {
+	return fmt.Sprintf("login for %q locked out for %s", e.user, e.retryAfter.Round(time.Second))
+}
+
+// setRetryAfter sets the Retry-After header, in whole seconds
+func setRetryAfter(h http.Header, d time.Duration) {
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewLoginLimiter(3, 10*time.Second, time.Minute)
+	l.now = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), l.Failure("user:bob", "ip:10.0.0.1"))
+	assert.Equal(t, time.Duration(0), l.Failure("user:bob", "ip:10.0.0.1"))
+	assert.Equal(t, time.Duration(0), l.Locked("user:bob", "ip:10.0.0.1"))
+	assert.Equal(t, 10*time.Second, l.Failure("user:bob", "ip:10.0.0.2"))
+	assert.Equal(t, 10*time.Second, l.Locked("user:bob"))
+	assert.Equal(t, time.Duration(0), l.Locked("ip:10.0.0.1"))
+	assert.Equal(t, 10*time.Second, l.Locked("user:alice", "ip:10.0.0.1", "user:bob"))
+
+	// doubling, up to max
+	now = now.Add(11 * time.Second)
+	assert.Equal(t, time.Duration(0), l.Locked("user:bob"))
+	assert.Equal(t, 20*time.Second, l.Failure("user:bob"))
+	assert.Equal(t, 40*time.Second, l.Failure("user:bob"))
+	assert.Equal(t, time.Minute, l.Failure("user:bob"))
+	assert.Equal(t, time.Minute, l.Failure("user:bob"))
+
+	// a success forgets the failures
+	l.Success("user:bob")
+	assert.Equal(t, time.Duration(0), l.Locked("user:bob"))
+
+	// failures are forgotten after max
+	l.Failure("user:carol")
+	l.Failure("user:carol")
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, time.Duration(0), l.Failure("user:carol"))
+	assert.Equal(t, 1, l.failures["user:carol"].count)
+	_, ok := l.failures["ip:10.0.0.1"]
+	assert.Equal(t, false, ok)
+
+	var disabled *LoginLimiter = NewLoginLimiter(0, time.Second, time.Minute)
+	assert.Equal(t, (*LoginLimiter)(nil), disabled)
+	assert.Equal(t, time.Duration(0), disabled.Failure("user:bob"))
+	assert.Equal(t, time.Duration(0), disabled.Locked("user:bob"))
+}
+
+func newLockoutTestProxy(t *testing.T) *OAuthProxy {
+	opts := testOptions()
+	opts.HtpasswdLockoutThreshold = 2
+	opts.HtpasswdLockout = time.Minute
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.provider = &TestProvider{ProviderData: &providers.ProviderData{ProviderName: "Test Provider"}}
+	htpasswd, err := NewHtpasswd(bytes.NewBufferString("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n"))
+	assert.Equal(t, nil, err)
+	proxy.HtpasswdFile = htpasswd
+	return proxy
+}
+
+func TestSignInLockout(t *testing.T) {
+	proxy := newLockoutTestProxy(t)
+	now := time.Now()
+	proxy.userLoginLimiter.now = func() time.Time { return now }
+	signIn := func(user, password, remoteAddr, realIP string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {user}, "password": {password}}
+		req := httptest.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		if realIP != "" {
+			req.Header.Set("X-Real-IP", realIP)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 200, signIn("testuser", "wrong", "192.0.2.1:1234", "").Code)
+	assert.Equal(t, 200, signIn("testuser", "wrong", "192.0.2.2:1234", "").Code)
+	// locked out by username, even with the right password
+	rw := signIn("testuser", "asdf", "192.0.2.3:1234", "")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+	// without a trusted proxy, addresses are not counted
+	assert.Equal(t, 200, signIn("other", "wrong", "192.0.2.1:1234", "").Code)
+
+	// username lockouts do not grow
+	now = now.Add(59 * time.Second)
+	assert.Equal(t, http.StatusTooManyRequests, signIn("testuser", "asdf", "192.0.2.1:1234", "").Code)
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, 200, signIn("testuser", "wrong", "192.0.2.1:1234", "").Code)
+	assert.Equal(t, 200, signIn("testuser", "wrong", "192.0.2.1:1234", "").Code)
+	rw = signIn("testuser", "asdf", "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+	now = now.Add(61 * time.Second)
+	assert.Equal(t, 302, signIn("testuser", "asdf", "192.0.2.1:1234", "").Code)
+
+	// behind a trusted proxy, locked out by client address, for any username
+	proxy.ClientIPHeader = "X-Real-IP"
+	proxy.trustedProxies = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}}
+	assert.Equal(t, 200, signIn("other", "wrong", "127.0.0.1:1234", "192.0.2.4").Code)
+	assert.Equal(t, 200, signIn("another", "wrong", "127.0.0.1:1234", "192.0.2.4").Code)
+	assert.Equal(t, http.StatusTooManyRequests, signIn("testuser", "asdf", "127.0.0.1:1234", "192.0.2.4").Code)
+	// other clients of the proxy are not locked out
+	assert.Equal(t, 302, signIn("testuser", "asdf", "127.0.0.1:1234", "192.0.2.5").Code)
+
+	// a successful login resets the address's failures
+	assert.Equal(t, 200, signIn("other", "wrong", "127.0.0.1:1234", "192.0.2.6").Code)
+	assert.Equal(t, 302, signIn("testuser", "asdf", "127.0.0.1:1234", "192.0.2.6").Code)
+	assert.Equal(t, 200, signIn("another", "wrong", "127.0.0.1:1234", "192.0.2.6").Code)
+	assert.Equal(t, 302, signIn("testuser", "asdf", "127.0.0.1:1234", "192.0.2.6").Code)
+}
+
+func TestBasicAuthLockout(t *testing.T) {
+	proxy := newLockoutTestProxy(t)
+	basicAuth := func(password, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetBasicAuth("testuser", password)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, basicAuth("wrong", "/oauth2/auth").Code)
+	assert.Equal(t, http.StatusUnauthorized, basicAuth("wrong", "/oauth2/auth").Code)
+	rw := basicAuth("asdf", "/oauth2/auth")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+	rw = basicAuth("asdf", "/app")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Too Many Requests")
+}
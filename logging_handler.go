@@ -13,6 +13,8 @@ import (
 	"net/url"
 	"text/template"
 	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
 )
 
 const (
@@ -22,11 +24,12 @@ const (
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP status
 // code and body size
 type responseLogger struct {
-	w        http.ResponseWriter
-	status   int
-	size     int
-	upstream string
-	authInfo string
+	w         http.ResponseWriter
+	status    int
+	size      int
+	upstream  string
+	authInfo  string
+	rateLimit string
 }
 
 func (l *responseLogger) Header() http.Header {
@@ -52,6 +55,11 @@ func (l *responseLogger) ExtractGAPMetadata() {
 		l.authInfo = authInfo
 		l.w.Header().Del("GAP-Auth")
 	}
+	rateLimit := l.w.Header().Get("GAP-Rate-Limit")
+	if rateLimit != "" {
+		l.rateLimit = rateLimit
+		l.w.Header().Del("GAP-Rate-Limit")
+	}
 }
 
 func (l *responseLogger) Write(b []byte) (int, error) {
@@ -91,7 +99,9 @@ type logMessageData struct {
 	Client,
 	Host,
 	Protocol,
+	RateLimit,
 	RequestDuration,
+	RequestID,
 	RequestMethod,
 	RequestURI,
 	ResponseSize,
@@ -107,14 +117,16 @@ type loggingHandler struct {
 	writer      io.Writer
 	handler     http.Handler
 	ipHeader    string
+	trusted     []*net.IPNet
 	logTemplate *template.Template
 }
 
-func LoggingHandler(out io.Writer, h http.Handler, ipHeader, requestLoggingTpl string) http.Handler {
+func LoggingHandler(out io.Writer, h http.Handler, ipHeader string, trusted []*net.IPNet, requestLoggingTpl string) http.Handler {
 	return loggingHandler{
 		writer:      out,
 		handler:     h,
 		ipHeader:    ipHeader,
+		trusted:     loggedTrustedProxies(trusted),
 		logTemplate: template.Must(template.New("request-log").Parse(requestLoggingTpl + "\n")),
 	}
 }
@@ -124,19 +136,24 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	url := *req.URL
 	logger := &responseLogger{w: w}
 	h.handler.ServeHTTP(logger, req)
-	h.writeLogLine(logger.authInfo, logger.upstream, req, url, t, logger.Status(), logger.Size())
+	h.writeLogLine(logger.authInfo, logger.upstream, logger.rateLimit, req, url, t, logger.Status(), logger.Size())
 }
 
 // Log entry for req similar to Apache Common Log Format.
 // ts is the timestamp with which the entry should be logged.
 // status, size are used to provide the response HTTP status and size.
-func (h loggingHandler) writeLogLine(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) {
+func (h loggingHandler) writeLogLine(username, upstream, rateLimit string, req *http.Request, url url.URL, ts time.Time, status int, size int) {
 	if username == "" {
 		username = "-"
 	}
 	if upstream == "" {
 		upstream = "-"
 	}
+	if rateLimit == "" {
+		rateLimit = "-"
+	} else {
+		rateLimit = fmt.Sprintf("%q", rateLimit)
+	}
 	if url.User != nil && username == "-" {
 		if name := url.User.Username(); name != "" {
 			username = name
@@ -144,14 +161,17 @@ func (h loggingHandler) writeLogLine(username, upstream string, req *http.Reques
 	}
 
 	client := req.RemoteAddr
-	hval := extractClientIP(req, h.ipHeader)
-	if hval != "" {
-		client = hval
-	}
-
 	if c, _, err := net.SplitHostPort(client); err == nil {
 		client = c
 	}
+	if ip := realClientIP(req, h.ipHeader, h.trusted); ip != nil {
+		client = ip.String()
+	}
+
+	requestID := providers.RequestIDFromContext(req.Context())
+	if requestID == "" {
+		requestID = "-"
+	}
 
 	duration := float64(time.Now().Sub(ts)) / float64(time.Second)
 
@@ -159,7 +179,9 @@ func (h loggingHandler) writeLogLine(username, upstream string, req *http.Reques
 		Client:          client,
 		Host:            req.Host,
 		Protocol:        req.Proto,
+		RateLimit:       rateLimit,
 		RequestDuration: fmt.Sprintf("%0.3f", duration),
+		RequestID:       requestID,
 		RequestMethod:   req.Method,
 		RequestURI:      fmt.Sprintf("%q", url.RequestURI()),
 		ResponseSize:    fmt.Sprintf("%d", size),
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,7 +36,7 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 			w.Write([]byte("test"))
 		}
 
-		h := LoggingHandler(buf, http.HandlerFunc(handler), "", test.Format)
+		h := LoggingHandler(buf, http.HandlerFunc(handler), "", nil, test.Format)
 		r, _ := http.NewRequest("GET", "/foo/bar", nil)
 		r.RemoteAddr = "127.0.0.1"
 		r.Host = "test-server"
@@ -45,3 +47,53 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		assert.Regexp(t, re, buf.String())
 	}
 }
+
+func TestLoggingHandlerClientIP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	cases := []struct {
+		trusted  []*net.IPNet
+		expected string
+	}{
+		{nil, "198.51.100.1\n"},
+		{mustParseCIDRs(t, "10.0.0.0/8"), "198.51.100.1\n"},
+		{mustParseCIDRs(t, "192.168.0.0/16"), "10.0.0.1\n"},
+	}
+	for _, c := range cases {
+		buf := bytes.NewBuffer(nil)
+		h := LoggingHandler(buf, handler, "X-Forwarded-For", c.trusted, "{{.Client}}")
+		r, _ := http.NewRequest("GET", "/foo/bar", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		assert.Equal(t, c.expected, buf.String())
+	}
+}
+
+func TestLoggingHandlerRequestID(t *testing.T) {
+	var upstreamIDs []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamIDs = append(upstreamIDs, req.Header.Get("X-Request-Id"))
+	})
+	buf := bytes.NewBuffer(nil)
+	h := withRequestID(LoggingHandler(buf, handler, "", nil, "{{.RequestID}}"), "X-Request-Id")
+
+	for _, id := range []string{"abc-123", "not a valid id", ""} {
+		r, _ := http.NewRequest("GET", "/foo/bar", nil)
+		if id != "" {
+			r.Header.Set("X-Request-Id", id)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	logged := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, upstreamIDs, logged)
+	assert.Equal(t, "abc-123", logged[0])
+	assert.Regexp(t, "^[0-9a-f]{32}$", logged[1])
+	assert.Regexp(t, "^[0-9a-f]{32}$", logged[2])
+	assert.NotEqual(t, logged[1], logged[2])
+
+	// without withRequestID there is no request id
+	buf.Reset()
+	r, _ := http.NewRequest("GET", "/foo/bar", nil)
+	LoggingHandler(buf, handler, "", nil, "{{.RequestID}}").ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "-\n", buf.String())
+}
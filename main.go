@@ -21,9 +21,22 @@ func mainFlagSet() *flag.FlagSet {
 	whitelistDomains := StringArray{}
 	upstreams := StringArray{}
 	skipAuthRegex := StringArray{}
+	authzRules := StringArray{}
+	policies := StringArray{}
+	ipRules := StringArray{}
+	trustedProxies := StringArray{}
+	rateLimits := StringArray{}
 	googleGroups := StringArray{}
 	gitlabGroups := StringArray{}
+	azureGroups := StringArray{}
+	discordGuilds := StringArray{}
+	discordRoles := StringArray{}
+	gitlabProjects := StringArray{}
+	githubOrgs := StringArray{}
 	githubTeams := StringArray{}
+	giteaOrgs := StringArray{}
+	giteaTeams := StringArray{}
+	providerCAFiles := StringArray{}
 
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
@@ -32,12 +45,16 @@ func mainFlagSet() *flag.FlagSet {
 	flagSet.String("tls-key-file", "", "path to private key file")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. e.g.: \"https://internalapp.yourcompany.com/oauth2/callback\"")
 	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
-	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
-	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User, X-Auth-Request-Email and X-Auth-Request-Groups response headers (useful in Nginx auth_request mode)")
+	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User, X-Forwarded-Email and X-Forwarded-Groups information to upstream")
 	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth header to upstream")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
 	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
+	flagSet.Var(&authzRules, "authz-rule", "restrict requests matching path=<regex> method=<list> host=<host> to emails=, domains= or groups= (comma separated lists), or allow them without authentication with \"public\"; the first matching rule applies (may be given multiple times)")
+	flagSet.Var(&policies, "policy", "deny authenticated requests unless this expression over the session and request is true, e.g. '\"ops\" in groups && request.method != \"DELETE\"', optionally prefixed with \"<name>: \" for logs (may be given multiple times)")
+	flagSet.Var(&ipRules, "ip-rule", "for requests from cidr=<list of networks> (and matching path=<regex> method=<list>), skip-auth, require auth even for skipped paths, or deny; the first matching rule applies (may be given multiple times)")
+	flagSet.Var(&rateLimits, "rate-limit", "limit requests matching path=<regex> to rate=<n>/<s|m|h> (and burst=<n>) for each user, or client address for requests without authentication; the first matching limit applies (may be given multiple times)")
 	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests with paths that match (may be given multiple times)")
 	flagSet.Bool("skip-auth-strip-headers", true, "strip upstream request http headers that are normally set by this proxy, also for requests allowed by --skip-auth-regex")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
@@ -48,18 +65,47 @@ func mainFlagSet() *flag.FlagSet {
 	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
 	flagSet.Var(&whitelistDomains, "whitelist-domain", "allowed domain for redirection after authentication, leading '.' allows subdomains (may be given multiple times)")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
-	flagSet.String("bitbucket-team", "", "restrict logins to members of this team")
-	flagSet.String("github-org", "", "restrict logins to members of this organisation")
+	flagSet.Var(&azureGroups, "azure-group", "restrict logins to members of this Azure AD group (object id) (may be given multiple times)")
+	flagSet.String("bitbucket-team", "", "deprecated alias of bitbucket-workspace")
+	flagSet.String("bitbucket-workspace", "", "restrict logins to members of this workspace")
+	flagSet.String("bitbucket-repository", "", "restrict logins to users with bitbucket-repository-permission on this repository (workspace/repo_slug)")
+	flagSet.String("bitbucket-repository-permission", "read", "minimum permission required on bitbucket-repository: read, write or admin")
+	flagSet.Var(&discordGuilds, "discord-guild", "restrict logins to members of this Discord guild (id) (may be given multiple times)")
+	flagSet.Var(&discordRoles, "discord-role", "restrict logins to holders of this role (id) in a discord-guild (may be given multiple times)")
+	flagSet.String("facebook-graph-version", "v19.0", "the Facebook Graph API version to use")
+	flagSet.String("github-base-url", "", "the base url of a GitHub Enterprise Server instance (e.g. https://github.example.com)")
+	flagSet.Var(&githubOrgs, "github-org", "restrict logins to members of this organisation (may be given multiple times)")
 	flagSet.Var(&githubTeams, "github-team", "restrict logins to members of this team (slug) (may be given multiple times)")
+	flagSet.Duration("github-membership-cache-ttl", time.Duration(5)*time.Minute, "cache GitHub org and team membership lookups for this duration; 0 to disable")
+	flagSet.String("github-repo", "", "restrict logins to collaborators with push access to this repository (owner/repo); requests the full \"repo\" scope")
+	flagSet.String("gitea-base-url", "", "the base url of a Gitea or Forgejo instance (e.g. https://gitea.example.com)")
+	flagSet.Var(&giteaOrgs, "gitea-org", "restrict logins to members of this Gitea organisation (may be given multiple times)")
+	flagSet.Var(&giteaTeams, "gitea-team", "restrict logins to members of this team (name) in a gitea-org (may be given multiple times)")
 	flagSet.Var(&gitlabGroups, "gitlab-group", "restrict logins to members of this group (full path) (may be given multiple times)")
+	flagSet.Var(&gitlabProjects, "gitlab-project", "restrict logins to members of this project (full path) (may be given multiple times)")
+	flagSet.String("gitlab-project-access-level", "guest", "minimum access level required in gitlab-project: guest, reporter, developer, maintainer, owner, or a number")
 	flagSet.Var(&googleGroups, "google-group", "restrict logins to members of this google group (may be given multiple times)")
 	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
 	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
+	flagSet.Bool("google-use-application-default-credentials", false, "use the Application Default Credentials (e.g. GKE workload identity) for Google group lookups, instead of google-service-account-json")
+	flagSet.String("google-access-token-file", "", "the path to a file containing an access token for Google group lookups, which is re-read every minute")
+	flagSet.Duration("google-group-cache-ttl", time.Duration(5)*time.Minute, "cache positive Google group membership lookups for this duration; 0 to disable")
+	flagSet.Duration("google-group-cache-negative-ttl", time.Duration(1)*time.Minute, "cache negative Google group membership lookups for this duration; 0 to disable")
+	flagSet.Duration("google-group-cache-stale-ttl", 0, "when the Directory API fails, use expired Google group cache entries up to this much older than their ttl (disabled by default)")
 	flagSet.String("client-id", "", "the OAuth Client ID: e.g.: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
-	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
+	flagSet.String("client-auth-method", "client_secret_post", "how to authenticate to the token endpoint: client_secret_post, client_secret_basic, private_key_jwt or tls_client_auth")
+	flagSet.String("client-private-key-file", "", "the path to the PEM encoded private key for client-auth-method=private_key_jwt")
+	flagSet.String("client-private-key-id", "", "the key id (\"kid\") of client-private-key-file, if the provider requires it")
+	flagSet.String("client-tls-cert-file", "", "the path to the client certificate for client-auth-method=tls_client_auth")
+	flagSet.String("client-tls-key-file", "", "the path to the client certificate's private key for client-auth-method=tls_client_auth")
+	flagSet.String("authenticated-emails-file", "", "authenticate against emails, globs or /regexes/ (matching the whole email) via file (one per line, optionally with restrictions, or ! to deny)")
+	flagSet.Bool("authenticated-emails-normalize-plus", false, "match user+tag@domain emails against user@domain entries in the authenticated-emails-file")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
 	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
+	flagSet.Int("htpasswd-lockout-threshold", 5, "lock out htpasswd logins for a username, or from a client address behind a trusted proxy, after this many consecutive failures; 0 to disable")
+	flagSet.Duration("htpasswd-lockout", time.Duration(30)*time.Second, "how long the first htpasswd lockout is, doubling with each further failure")
+	flagSet.Duration("htpasswd-lockout-max", time.Duration(1)*time.Hour, "the longest htpasswd lockout of a client address, and how long until its failures are forgotten")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("banner", "", "custom sign-in banner text/html. Use \"-\" to disable default banner.")
 	flagSet.String("footer", "", "custom footer text/html. Use \"-\" to disable default footer.")
@@ -78,7 +124,8 @@ func mainFlagSet() *flag.FlagSet {
 
 	flagSet.Bool("request-logging", true, "Log requests to stdout")
 	flagSet.String("request-logging-format", defaultRequestLoggingFormat, "Template for request log lines")
-	flagSet.String("real-client-ip-header", "X-Real-IP", "HTTP header indicating the actual ip address of the client (blank to disable)")
+	flagSet.String("real-client-ip-header", "X-Real-IP", "HTTP header indicating the actual ip address of the client, e.g. X-Real-IP, X-Forwarded-For or Forwarded (blank to disable)")
+	flagSet.Var(&trustedProxies, "trusted-proxy", "a proxy (ip address or cidr) whose real-client-ip-header is trusted; without any, the header is only used for logging (may be given multiple times)")
 
 	flagSet.String("provider", "google", "OAuth provider")
 	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (e.g. https://accounts.google.com)")
@@ -89,6 +136,17 @@ func mainFlagSet() *flag.FlagSet {
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
+	flagSet.Duration("provider-connect-timeout", time.Duration(10)*time.Second, "timeout for connecting to the provider (including the TLS handshake)")
+	flagSet.Duration("provider-response-timeout", time.Duration(30)*time.Second, "timeout for each request to the provider, including reading the response")
+	flagSet.Var(&providerCAFiles, "provider-ca-file", "a PEM bundle of CA certificates to trust for requests to the provider, instead of the system roots (may be given multiple times)")
+	flagSet.String("provider-http-proxy", "", "an http(s) proxy for requests to the provider (default from the HTTPS_PROXY / HTTP_PROXY environment variables)")
+	flagSet.String("provider-request-id-header", "", "send the request id in this header (e.g. X-Request-Id) with each request to the provider: the id from this header of the request being handled, or a new unique id")
+	flagSet.Int("provider-retries", 2, "how many times to retry idempotent requests to the provider after a connection error, timeout or 5xx response")
+	flagSet.Duration("provider-retry-backoff", time.Duration(100)*time.Millisecond, "the maximum random delay before the first retry, doubled for each further retry")
+	flagSet.Int("provider-circuit-breaker-threshold", 5, "fail requests to a provider endpoint immediately after this many consecutive failures; 0 to disable")
+	flagSet.Duration("provider-circuit-breaker-cooldown", time.Duration(30)*time.Second, "how long requests to a failing provider endpoint fail immediately")
+	flagSet.Duration("provider-outage-grace", time.Duration(1)*time.Hour, "how long to keep sessions which can not be refreshed or re-validated because the provider is failing; 0 to disable")
+	flagSet.String("device-auth-url", "", "Device Authorization endpoint; enables the device flow endpoints")
 	flagSet.String("scope", "", "OAuth scope specification")
 	flagSet.String("prompt", "", "OIDC prompt (overrides approval-prompt)")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt (see also: prompt)")
@@ -129,8 +187,11 @@ func main() {
 		log.Printf("%s", err)
 		os.Exit(1)
 	}
-	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	authenticatedEmails := NewUserMap(opts.AuthenticatedEmailsFile, nil, func() {})
+	authenticatedEmails.NormalizePlus = opts.AuthenticatedEmailsPlus
+	validator := newValidatorWithUsers(opts.EmailDomains, authenticatedEmails)
 	oauthproxy := NewOAuthProxy(opts, validator)
+	oauthproxy.AuthenticatedEmails = authenticatedEmails
 
 	if opts.Banner != "" {
 		if opts.Banner == "-" {
@@ -161,11 +222,14 @@ func main() {
 	}
 	if opts.RequestLogging {
 		handler = LoggingHandler(
-			os.Stdout, handler, opts.RealClientIPHeader, opts.RequestLoggingFormat,
+			os.Stdout, handler, opts.RealClientIPHeader, opts.trustedProxies, opts.RequestLoggingFormat,
 		)
 	} else {
 		handler = NoLoggingHandler(handler)
 	}
+	if opts.ProviderRequestIDHeader != "" {
+		handler = withRequestID(handler, opts.ProviderRequestIDHeader)
+	}
 	s := &Server{
 		Handler: handler,
 		Opts:    opts,
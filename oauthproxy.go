@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -12,11 +14,13 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/mbland/hmacauth"
 	"github.com/ploxiln/oauth2_proxy/cookie"
+	"github.com/ploxiln/oauth2_proxy/policy"
 	"github.com/ploxiln/oauth2_proxy/providers"
 	"github.com/yhat/wsutil"
 )
@@ -56,6 +60,8 @@ type OAuthProxy struct {
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	DeviceStartPath   string
+	DevicePollPath    string
 
 	redirectURL         *url.URL // the url to receive requests at
 	whitelistDomains    []string
@@ -64,10 +70,16 @@ type OAuthProxy struct {
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
 	DisplayHtpasswdForm bool
+	AuthenticatedEmails *UserMap
+	loginLimiter        *LoginLimiter
+	userLoginLimiter    *LoginLimiter
+	rateLimits          []*RateLimit
+	providerOutageGrace time.Duration
 	serveMux            http.Handler
 	SetXAuthRequest     bool
 	PassBasicAuth       bool
 	SkipProviderButton  bool
+	DeviceAuth          bool
 	PassUserHeaders     bool
 	BasicAuthPassword   string
 	PassAccessToken     bool
@@ -77,6 +89,10 @@ type OAuthProxy struct {
 	skipAuthStripHdrs   bool
 	skipAuthPreflight   bool
 	compiledRegex       []*regexp.Regexp
+	authzRules          []*AuthzRule
+	policies            []*policy.Policy
+	ipRules             []*IPRule
+	trustedProxies      []*net.IPNet
 	templates           *template.Template
 	Footer              string
 }
@@ -128,6 +144,13 @@ func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.HmacAuth) (restProxy http.Handler) {
 	proxy := httputil.NewSingleHostReverseProxy(u)
 	proxy.FlushInterval = opts.FlushInterval
+	if opts.SSLInsecureSkipVerify {
+		if defaultTransport, ok := http.DefaultTransport.(*http.Transport); ok {
+			transport := defaultTransport.Clone()
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			proxy.Transport = transport
+		}
+	}
 
 	u.Path = ""
 	if !opts.PassHostHeader {
@@ -181,6 +204,18 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 	for _, u := range opts.CompiledRegex {
 		log.Printf("compiled skip-auth-regex => %q", u)
 	}
+	for _, r := range opts.authzRules {
+		log.Printf("authz-rule => %q", r)
+	}
+	for _, pol := range opts.policies {
+		log.Printf("policy => %q", pol)
+	}
+	for _, r := range opts.ipRules {
+		log.Printf("ip-rule => %q", r)
+	}
+	for _, r := range opts.rateLimits {
+		log.Printf("rate-limit => %q", r)
+	}
 
 	redirectURL := opts.redirectURL
 	if redirectURL.Path == "" {
@@ -227,26 +262,37 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
-
-		ProxyPrefix:        opts.ProxyPrefix,
-		provider:           opts.provider,
-		serveMux:           serveMux,
-		redirectURL:        redirectURL,
-		whitelistDomains:   opts.WhitelistDomains,
-		skipAuthRegex:      opts.SkipAuthRegex,
-		skipAuthStripHdrs:  opts.SkipAuthStripHeaders,
-		skipAuthPreflight:  opts.SkipAuthPreflight,
-		compiledRegex:      opts.CompiledRegex,
-		SetXAuthRequest:    opts.SetXAuthRequest,
-		PassBasicAuth:      opts.PassBasicAuth,
-		PassUserHeaders:    opts.PassUserHeaders,
-		BasicAuthPassword:  opts.BasicAuthPassword,
-		PassAccessToken:    opts.PassAccessToken,
-		SkipProviderButton: opts.SkipProviderButton,
-		ClientIPHeader:     opts.RealClientIPHeader,
-		CookieCipher:       cipher,
-		templates:          loadTemplates(opts.CustomTemplatesDir),
-		Footer:             opts.Footer,
+		DeviceStartPath:   fmt.Sprintf("%s/device/start", opts.ProxyPrefix),
+		DevicePollPath:    fmt.Sprintf("%s/device/poll", opts.ProxyPrefix),
+
+		ProxyPrefix:         opts.ProxyPrefix,
+		provider:            opts.provider,
+		serveMux:            serveMux,
+		redirectURL:         redirectURL,
+		whitelistDomains:    opts.WhitelistDomains,
+		skipAuthRegex:       opts.SkipAuthRegex,
+		skipAuthStripHdrs:   opts.SkipAuthStripHeaders,
+		skipAuthPreflight:   opts.SkipAuthPreflight,
+		compiledRegex:       opts.CompiledRegex,
+		authzRules:          opts.authzRules,
+		policies:            opts.policies,
+		ipRules:             opts.ipRules,
+		rateLimits:          opts.rateLimits,
+		providerOutageGrace: opts.ProviderOutageGrace,
+		loginLimiter:        NewLoginLimiter(opts.HtpasswdLockoutThreshold, opts.HtpasswdLockout, opts.HtpasswdLockoutMax),
+		userLoginLimiter:    NewLoginLimiter(opts.HtpasswdLockoutThreshold, opts.HtpasswdLockout, opts.HtpasswdLockout),
+		trustedProxies:      opts.trustedProxies,
+		SetXAuthRequest:     opts.SetXAuthRequest,
+		PassBasicAuth:       opts.PassBasicAuth,
+		PassUserHeaders:     opts.PassUserHeaders,
+		BasicAuthPassword:   opts.BasicAuthPassword,
+		PassAccessToken:     opts.PassAccessToken,
+		SkipProviderButton:  opts.SkipProviderButton,
+		DeviceAuth:          opts.DeviceAuthURL != "",
+		ClientIPHeader:      opts.RealClientIPHeader,
+		CookieCipher:        cipher,
+		templates:           loadTemplates(opts.CustomTemplatesDir),
+		Footer:              opts.Footer,
 	}
 }
 
@@ -272,22 +318,28 @@ func (p *OAuthProxy) displayCustomLoginForm() bool {
 	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(ctx context.Context, host, code string) (s *providers.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
 	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	s, err = p.provider.Redeem(ctx, redirectURI, code)
 	if err != nil {
 		return
 	}
+	err = p.completeSession(ctx, s)
+	return
+}
 
+// completeSession looks up the email and user name of a newly redeemed
+// session, if the provider did not already set them
+func (p *OAuthProxy) completeSession(ctx context.Context, s *providers.SessionState) (err error) {
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(s)
+		s.Email, err = p.provider.GetEmailAddress(ctx, s)
 	}
 
 	if s.User == "" {
-		s.User, err = p.provider.GetUserName(s)
+		s.User, err = p.provider.GetUserName(ctx, s)
 		if err != nil && err.Error() == "not implemented" {
 			err = nil
 		}
@@ -377,7 +429,11 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionSt
 	c, err := req.Cookie(p.CookieName)
 	if err != nil {
 		// always http.ErrNoCookie
-		return nil, age, fmt.Errorf("Cookie %q not present", p.CookieName)
+		token, ok := p.bearerToken(req)
+		if !ok {
+			return nil, age, fmt.Errorf("Cookie %q not present", p.CookieName)
+		}
+		c = &http.Cookie{Name: p.CookieName, Value: token}
 	}
 	val, timestamp, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
 	if !ok {
@@ -393,6 +449,20 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionSt
 	return session, age, nil
 }
 
+// bearerToken returns a session cookie value issued by the device flow and
+// sent as "Authorization: Bearer <value>". Other bearer tokens, which may be
+// meant for the upstream, are not signed cookie values and are ignored.
+func (p *OAuthProxy) bearerToken(req *http.Request) (string, bool) {
+	if !p.DeviceAuth {
+		return "", false
+	}
+	s := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Bearer") || strings.Count(s[1], "|") != 2 {
+		return "", false
+	}
+	return s[1], true
+}
+
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
 	value, err := p.provider.CookieForSession(s, p.CookieCipher)
 	if err != nil {
@@ -412,6 +482,7 @@ func (p *OAuthProxy) stripAuthHeaders(req *http.Request) {
 	if p.PassUserHeaders {
 		req.Header.Del("X-Forwarded-User")
 		req.Header.Del("X-Forwarded-Email")
+		req.Header.Del("X-Forwarded-Groups")
 	}
 	if p.PassAccessToken {
 		req.Header.Del("X-Forwarded-Access-Token")
@@ -475,21 +546,60 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
 }
 
-func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (string, bool) {
+func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (string, bool, error) {
 	if req.Method != "POST" || p.HtpasswdFile == nil {
-		return "", false
+		return "", false, nil
 	}
 	user := req.FormValue("username")
 	passwd := req.FormValue("password")
 	if user == "" {
-		return "", false
+		return "", false, nil
 	}
 	// check auth
-	if p.HtpasswdFile.Validate(user, passwd) {
+	ok, err := p.validateLogin(req, user, passwd)
+	if ok {
 		log.Printf("authenticated %q via HtpasswdFile", user)
-		return user, true
+		return user, true, nil
+	}
+	return "", false, err
+}
+
+// validateLogin checks a password against the htpasswd file, counting
+// failures by username, and by client address when it is from a trusted
+// proxy's header. Username lockouts do not grow past the first lockout, so
+// that others can only briefly lock a user out. While either is locked out,
+// the password is not checked and a *loginLockedError is returned.
+func (p *OAuthProxy) validateLogin(req *http.Request, user, password string) (bool, error) {
+	userKey := "user:" + user
+	var ipKey string
+	if ip := trustedClientIP(req, p.ClientIPHeader, p.trustedProxies); ip != nil {
+		ipKey = "ip:" + ip.String()
+	}
+	wait := p.userLoginLimiter.Locked(userKey)
+	if ipKey != "" {
+		if d := p.loginLimiter.Locked(ipKey); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return false, &loginLockedError{user: user, retryAfter: wait}
 	}
-	return "", false
+	if p.HtpasswdFile.Validate(user, password) {
+		p.userLoginLimiter.Success(userKey)
+		if ipKey != "" {
+			p.loginLimiter.Success(ipKey)
+		}
+		return true, nil
+	}
+	if wait := p.userLoginLimiter.Failure(userKey); wait > 0 {
+		log.Printf("%s locking out logins for %q for %s after failed logins", p.getRemoteAddr(req), user, wait)
+	}
+	if ipKey != "" {
+		if wait := p.loginLimiter.Failure(ipKey); wait > 0 {
+			log.Printf("%s locking out logins from %s for %s after failed logins", p.getRemoteAddr(req), ipKey, wait)
+		}
+	}
+	return false, nil
 }
 
 func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error) {
@@ -546,7 +656,13 @@ func (p *OAuthProxy) IsValidRedirect(redirect string) bool {
 
 func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
 	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
-	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
+	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path) || p.isPublicRequest(req)
+}
+
+// isPublicRequest returns true if the first authz-rule matching req is public
+func (p *OAuthProxy) isPublicRequest(req *http.Request) bool {
+	rule := matchAuthzRule(p.authzRules, req)
+	return rule != nil && rule.public
 }
 
 func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
@@ -562,22 +678,51 @@ func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
 func (p *OAuthProxy) getRemoteAddr(req *http.Request) (s string) {
 	s = req.RemoteAddr
 
-	hval := extractClientIP(req, p.ClientIPHeader)
-	if hval != "" {
-		s += fmt.Sprintf(" (%q)", hval)
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+	}
+	ip := realClientIP(req, p.ClientIPHeader, loggedTrustedProxies(p.trustedProxies))
+	if ip != nil && !ip.Equal(net.ParseIP(host)) {
+		s += fmt.Sprintf(" (%q)", ip.String())
+	}
+	if id := providers.RequestIDFromContext(req.Context()); id != "" {
+		s += fmt.Sprintf(" [request %s]", id)
 	}
 	return
 }
 
+// clientIP is the client's address for ip-rules and policies, which only use
+// the real-client-ip-header from trusted proxies
+func (p *OAuthProxy) clientIP(req *http.Request) net.IP {
+	return realClientIP(req, p.ClientIPHeader, p.trustedProxies)
+}
+
+// isProxyPath returns true for the proxy's own endpoints, under ProxyPrefix,
+// which skip-auth ip-rules do not send to the upstream
+func (p *OAuthProxy) isProxyPath(path string) bool {
+	return path == p.ProxyPrefix || strings.HasPrefix(path, p.ProxyPrefix+"/")
+}
+
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var ipRule *IPRule
+	if len(p.ipRules) > 0 {
+		ipRule = matchIPRule(p.ipRules, p.originalRequest(req), p.clientIP(req))
+	}
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
 	case path == p.PingPath:
 		p.PingPage(rw)
-	case p.IsWhitelistedRequest(req):
+	case ipRule.Denies():
+		orig := p.originalRequest(req)
+		log.Printf("%s Permission Denied: %s %s by ip-rule %q", p.getRemoteAddr(req), orig.Method, orig.URL.Path, ipRule)
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "You are not allowed to access this page")
+	case path == p.AuthOnlyPath && ipRule.SkipsAuth():
+		rw.WriteHeader(http.StatusAccepted)
+	case (ipRule.SkipsAuth() && !p.isProxyPath(path)) || (!ipRule.RequiresAuth() && p.IsWhitelistedRequest(req)):
 		p.stripAuthHeaders(req)
-		p.serveMux.ServeHTTP(rw, req)
+		p.serveUpstream(rw, req, nil)
 	case path == p.SignInPath:
 		p.SignIn(rw, req)
 	case path == p.SignOutPath:
@@ -588,14 +733,22 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		p.OAuthCallback(rw, req)
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case p.DeviceAuth && path == p.DeviceStartPath:
+		p.DeviceStart(rw, req)
+	case p.DeviceAuth && path == p.DevicePollPath:
+		p.DevicePoll(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
 }
 
 func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
-	user, ok := p.ManualSignIn(rw, req)
-	if ok {
+	user, ok, err := p.ManualSignIn(rw, req)
+	if locked, isLocked := err.(*loginLockedError); isLocked {
+		log.Printf("%s %s", p.getRemoteAddr(req), err)
+		setRetryAfter(rw.Header(), locked.retryAfter)
+		p.ErrorPage(rw, http.StatusTooManyRequests, "Too Many Requests", "Too many failed logins, try again later")
+	} else if ok {
 		redirect, err := p.GetRedirect(req)
 		if err != nil {
 			p.ErrorPage(rw, 400, "Bad Request", err.Error())
@@ -654,7 +807,7 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
+	session, err := p.redeemCode(req.Context(), req.Host, req.Form.Get("code"))
 	if err != nil {
 		log.Printf("%s error redeeming code %s", remoteAddr, err)
 		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
@@ -685,7 +838,7 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
+	if p.Validator(session.Email) && p.provider.ValidateGroup(req.Context(), session) {
 		log.Printf("%s authentication complete %s", remoteAddr, session)
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
@@ -700,57 +853,246 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// deviceJSON writes a device flow response, or error response (RFC 8628)
+func deviceJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func deviceError(rw http.ResponseWriter, code int, errorCode string) {
+	deviceJSON(rw, code, map[string]string{"error": errorCode})
+}
+
+// DeviceStart begins a device authorization, returning the user_code and
+// verification_uri for the user to visit, and the device_code to poll with
+func (p *OAuthProxy) DeviceStart(rw http.ResponseWriter, req *http.Request) {
+	preventCaching(rw)
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		deviceError(rw, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+	d, err := p.provider.StartDeviceAuth(req.Context())
+	if err != nil {
+		log.Printf("%s error starting device authorization %s", p.getRemoteAddr(req), err)
+		deviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	deviceJSON(rw, http.StatusOK, d)
+}
+
+// DevicePoll redeems a device_code once the user has authorized it, and
+// returns the session cookie value, which can also be used as a bearer token
+func (p *OAuthProxy) DevicePoll(rw http.ResponseWriter, req *http.Request) {
+	preventCaching(rw)
+	remoteAddr := p.getRemoteAddr(req)
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		deviceError(rw, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		deviceError(rw, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	session, err := p.provider.RedeemDeviceCode(req.Context(), req.Form.Get("device_code"))
+	if err != nil {
+		if e, ok := err.(*providers.DeviceAuthError); ok {
+			code := http.StatusBadRequest
+			if e.Code == "access_denied" {
+				code = http.StatusForbidden
+			}
+			if !e.Pending() {
+				log.Printf("%s device authorization failed %s", remoteAddr, e)
+			}
+			deviceError(rw, code, e.Code)
+			return
+		}
+		log.Printf("%s error redeeming device code %s", remoteAddr, err)
+		deviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	if err := p.completeSession(req.Context(), session); err != nil {
+		log.Printf("%s error redeeming device code %s", remoteAddr, err)
+		deviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	if !p.Validator(session.Email) || !p.provider.ValidateGroup(req.Context(), session) {
+		log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
+		deviceError(rw, http.StatusForbidden, "access_denied")
+		return
+	}
+
+	value, err := p.provider.CookieForSession(session, p.CookieCipher)
+	if err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+		deviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	log.Printf("%s device authentication complete %s", remoteAddr, session)
+	signed := cookie.SignedValue(p.CookieSeed, p.CookieName, value, time.Now())
+	p.SetSessionCookie(rw, req, value)
+	deviceJSON(rw, http.StatusOK, map[string]interface{}{
+		"access_token": signed,
+		"token_type":   "Bearer",
+		"expires_in":   int64(p.CookieExpire / time.Second),
+		"cookie_name":  p.CookieName,
+	})
+}
+
+// originalRequest returns the request being authorized. For AuthOnlyPath it
+// is a copy of req with the original request's path, from the X-Original-URI
+// (nginx auth_request) or X-Forwarded-Uri header, and method, from the
+// X-Original-Method or X-Forwarded-Method header.
+func (p *OAuthProxy) originalRequest(req *http.Request) *http.Request {
+	if req.URL.Path != p.AuthOnlyPath {
+		return req
+	}
+	orig := new(http.Request)
+	*orig = *req
+	u := *req.URL
+	orig.URL = &u
+	for _, header := range []string{"X-Original-URI", "X-Forwarded-Uri"} {
+		if uri := req.Header.Get(header); uri != "" {
+			if parsed, err := url.ParseRequestURI(uri); err == nil {
+				orig.URL.Path, orig.URL.RawPath, orig.URL.RawQuery = parsed.Path, parsed.RawPath, parsed.RawQuery
+				break
+			}
+		}
+	}
+	for _, header := range []string{"X-Original-Method", "X-Forwarded-Method"} {
+		if method := req.Header.Get(header); method != "" {
+			orig.Method = strings.ToUpper(method)
+			break
+		}
+	}
+	return orig
+}
+
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
 	// allow caching, do not send no-cache header
 	// typically not accessed directly by browsers
 	// short caching sometimes useful to prevent multiple simultaneous refreshes
-	status := p.Authenticate(rw, req)
-	if status == http.StatusAccepted {
+	orig := p.originalRequest(req)
+	rule := matchAuthzRule(p.authzRules, orig)
+	if rule != nil && rule.public {
 		rw.WriteHeader(http.StatusAccepted)
-	} else {
+		return
+	}
+	session, status := p.authenticate(rw, req)
+	if status == http.StatusAccepted && !authOnlyAllows(req, session) {
+		log.Printf("%s Permission Denied: %s for %s by %q", p.getRemoteAddr(req), req.URL.Path, session, req.URL.RawQuery)
+		status = http.StatusForbidden
+	} else if status == http.StatusAccepted && rule != nil && !rule.Allows(session) {
+		log.Printf("%s Permission Denied: %s %s for %s by authz-rule %q", p.getRemoteAddr(req), orig.Method, orig.URL.Path, session, rule)
+		status = http.StatusForbidden
+	}
+	switch status {
+	case http.StatusAccepted:
+		rw.WriteHeader(http.StatusAccepted)
+	case http.StatusForbidden:
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+	case http.StatusTooManyRequests:
+		http.Error(rw, "too many requests", http.StatusTooManyRequests)
+	default:
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
 	}
 }
 
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
+	session, status := p.authenticate(rw, req)
 	if status == http.StatusInternalServerError {
 		p.ErrorPage(rw, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
 	} else if status == http.StatusForbidden {
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "You are not allowed to access this page")
+	} else if status == http.StatusTooManyRequests {
+		p.ErrorPage(rw, http.StatusTooManyRequests, "Too Many Requests", "Too many failed logins, try again later")
+	} else if status == http.StatusUnauthorized {
 		if p.SkipProviderButton {
 			p.OAuthStart(rw, req)
 		} else {
 			p.SignInPage(rw, req, http.StatusForbidden)
 		}
+	} else if rule := matchAuthzRule(p.authzRules, req); rule != nil && !rule.Allows(session) {
+		log.Printf("%s Permission Denied: %s %s for %s by authz-rule %q", p.getRemoteAddr(req), req.Method, req.URL.Path, session, rule)
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "You are not allowed to access this page")
 	} else {
-		p.serveMux.ServeHTTP(rw, req)
+		p.serveUpstream(rw, req, session)
+	}
+}
+
+// serveUpstream proxies req, unless the user (or without a session, the
+// client address) is over the first matching rate-limit
+func (p *OAuthProxy) serveUpstream(rw http.ResponseWriter, req *http.Request, session *providers.SessionState) {
+	if limit := matchRateLimit(p.rateLimits, req); limit != nil {
+		var key string
+		if session != nil && session.Email != "" {
+			key = "user:" + session.Email
+		} else if session != nil {
+			key = "user:" + session.User
+		} else if ip := p.clientIP(req); ip != nil {
+			key = "ip:" + ip.String()
+		} else {
+			key = "ip:" + req.RemoteAddr
+		}
+		if ok, wait := limit.Allow(key); !ok {
+			log.Printf("%s rate limited: %s %s for %s by rate-limit %q", p.getRemoteAddr(req), req.Method, req.URL.Path, key, limit)
+			rw.Header().Set("GAP-Rate-Limit", limit.String())
+			setRetryAfter(rw.Header(), wait)
+			p.ErrorPage(rw, http.StatusTooManyRequests, "Too Many Requests", "Too many requests, try again later")
+			return
+		}
 	}
+	p.serveMux.ServeHTTP(rw, req)
 }
 
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	_, status := p.authenticate(rw, req)
+	return status
+}
+
+// authenticate is Authenticate, also returning the session if authenticated
+func (p *OAuthProxy) authenticate(rw http.ResponseWriter, req *http.Request) (*providers.SessionState, int) {
 	var saveSession, clearSession, revalidated bool
 	remoteAddr := p.getRemoteAddr(req)
 
 	session, sessionAge, err := p.LoadCookiedSession(req)
 	if err != nil {
 		log.Printf("%s %s", remoteAddr, err)
+	} else if _, ok := p.bearerToken(req); ok {
+		// the proxy's own bearer token is not for the upstream
+		if _, err := req.Cookie(p.CookieName); err != nil {
+			req.Header.Del("Authorization")
+		}
 	}
 	if session != nil && p.CookieRefresh != time.Duration(0) && sessionAge > p.CookieRefresh && session.AccessToken != "" {
 		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
 		saveSession = true
 	}
 
-	if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
-		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
-		clearSession = true
-		session = nil
+	var keptExpired bool
+	if ok, err := p.provider.RefreshSessionIfNeeded(req.Context(), session); err != nil {
+		if providers.IsUnavailable(err) && time.Since(session.ExpiresOn) < p.providerOutageGrace {
+			// keep the expired session until the provider is back, for up to
+			// providerOutageGrace
+			log.Printf("%s provider unavailable, keeping session. error refreshing access token %s %s", remoteAddr, err, session)
+			saveSession = false
+			keptExpired = true
+		} else {
+			log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+			clearSession = true
+			session = nil
+		}
 	} else if ok {
 		saveSession = true
 		revalidated = true
 	}
 
-	if session != nil && session.IsExpired() {
+	if session != nil && session.IsExpired() && !keptExpired {
 		log.Printf("%s removing session. token expired %s", remoteAddr, session)
 		session = nil
 		saveSession = false
@@ -759,11 +1101,18 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 
 	if saveSession && !revalidated && session != nil {
 		if session.AccessToken != "" {
-			if !p.provider.ValidateSessionState(session) {
-				log.Printf("%s removing session. error validating %s", remoteAddr, session)
-				saveSession = false
-				session = nil
-				clearSession = true
+			if err := p.provider.ValidateSessionState(req.Context(), session); err != nil {
+				if providers.IsUnavailable(err) && sessionAge-p.CookieRefresh < p.providerOutageGrace {
+					// not saved, so that it is validated again on the next
+					// request, for up to providerOutageGrace
+					log.Printf("%s provider unavailable, keeping session. error validating %s %s", remoteAddr, err, session)
+					saveSession = false
+				} else {
+					log.Printf("%s removing session. error validating %s %s", remoteAddr, err, session)
+					saveSession = false
+					session = nil
+					clearSession = true
+				}
 			}
 		} else {
 			saveSession = false
@@ -781,7 +1130,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			return http.StatusInternalServerError
+			return nil, http.StatusInternalServerError
 		}
 	}
 
@@ -794,10 +1143,32 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
 		}
+		if locked, ok := err.(*loginLockedError); ok {
+			setRetryAfter(rw.Header(), locked.retryAfter)
+			return nil, http.StatusTooManyRequests
+		}
 	}
 
 	if session == nil {
-		return http.StatusForbidden
+		return nil, http.StatusUnauthorized
+	}
+
+	orig := p.originalRequest(req)
+	path := cleanPath(orig.URL.Path)
+	if session.Email != "" && !p.AuthenticatedEmails.Allows(session.Email, session.Groups, path) {
+		log.Printf("%s Permission Denied: %s %s for %s by authenticated-emails-file", remoteAddr, orig.Method, path, session)
+		return session, http.StatusForbidden
+	}
+
+	if len(p.policies) > 0 {
+		denied, err := policy.Check(p.policies, p.policyInput(orig, session))
+		if err != nil {
+			log.Printf("%s Permission Denied: %s %s for %s by policy %q: %s", remoteAddr, orig.Method, path, session, denied, err)
+			return session, http.StatusForbidden
+		} else if denied != nil {
+			log.Printf("%s Permission Denied: %s %s for %s by policy %q", remoteAddr, orig.Method, path, session, denied)
+			return session, http.StatusForbidden
+		}
 	}
 
 	// At this point, the user is authenticated. proxy normally
@@ -811,12 +1182,20 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		} else {
 			req.Header.Del("X-Forwarded-Email")
 		}
+		if len(session.Groups) > 0 {
+			req.Header.Set("X-Forwarded-Groups", strings.Join(session.Groups, ","))
+		} else {
+			req.Header.Del("X-Forwarded-Groups")
+		}
 	}
 	if p.SetXAuthRequest {
 		rw.Header().Set("X-Auth-Request-User", session.User)
 		if session.Email != "" {
 			rw.Header().Set("X-Auth-Request-Email", session.Email)
 		}
+		if len(session.Groups) > 0 {
+			rw.Header().Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+		}
 		if p.PassAccessToken && session.AccessToken != "" {
 			rw.Header().Set("X-Auth-Request-Access-Token", session.AccessToken)
 		}
@@ -833,7 +1212,42 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
 	}
-	return http.StatusAccepted
+	return session, http.StatusAccepted
+}
+
+// policyInput is what the policies are evaluated against, for req (for
+// AuthOnlyPath, the original request) with its path cleaned as for authz-rules.
+// The session does not keep the provider's claims, so claims has the
+// session's own attributes.
+func (p *OAuthProxy) policyInput(req *http.Request, s *providers.SessionState) *policy.Input {
+	var ip string
+	if clientIP := p.clientIP(req); clientIP != nil {
+		ip = clientIP.String()
+	}
+	in := &policy.Input{
+		Email:  s.Email,
+		User:   s.User,
+		Groups: s.Groups,
+		Claims: map[string]interface{}{
+			"email":  s.Email,
+			"user":   s.User,
+			"groups": s.Groups,
+		},
+		Request: policy.Request{
+			Method: req.Method,
+			Host:   req.Host,
+			Path:   cleanPath(req.URL.Path),
+			Header: req.Header,
+			IP:     ip,
+		},
+	}
+	if !s.ExpiresOn.IsZero() {
+		in.Claims["exp"] = strconv.FormatInt(s.ExpiresOn.Unix(), 10)
+	}
+	if d := p.provider.Data(); d != nil {
+		in.Provider = d.ProviderName
+	}
+	return in
 }
 
 func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState, error) {
@@ -856,7 +1270,10 @@ func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState,
 	if len(pair) != 2 {
 		return nil, fmt.Errorf("invalid format %s", b)
 	}
-	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
+	ok, err := p.validateLogin(req, pair[0], pair[1])
+	if err != nil {
+		return nil, err
+	} else if ok {
 		log.Printf("authenticated %q via basic auth", pair[0])
 		return &providers.SessionState{User: pair[0]}, nil
 	}
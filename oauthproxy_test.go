@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -17,6 +20,7 @@ import (
 	"time"
 
 	"github.com/mbland/hmacauth"
+	"github.com/ploxiln/oauth2_proxy/policy"
 	"github.com/ploxiln/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/websocket"
@@ -280,6 +284,9 @@ type TestProvider struct {
 	*providers.ProviderData
 	EmailAddress string
 	ValidToken   bool
+	// ValidateErr is returned by ValidateSessionState if ValidToken is false
+	ValidateErr error
+	RefreshErr  error
 }
 
 func NewTestProvider(provider_url *url.URL, email_address string) *TestProvider {
@@ -307,12 +314,25 @@ func NewTestProvider(provider_url *url.URL, email_address string) *TestProvider
 	}
 }
 
-func (tp *TestProvider) GetEmailAddress(session *providers.SessionState) (string, error) {
+func (tp *TestProvider) GetEmailAddress(ctx context.Context, session *providers.SessionState) (string, error) {
 	return tp.EmailAddress, nil
 }
 
-func (tp *TestProvider) ValidateSessionState(session *providers.SessionState) bool {
-	return tp.ValidToken
+func (tp *TestProvider) ValidateSessionState(ctx context.Context, session *providers.SessionState) error {
+	if tp.ValidToken {
+		return nil
+	}
+	if tp.ValidateErr != nil {
+		return tp.ValidateErr
+	}
+	return fmt.Errorf("invalid token")
+}
+
+func (tp *TestProvider) RefreshSessionIfNeeded(ctx context.Context, session *providers.SessionState) (bool, error) {
+	if session == nil || tp.RefreshErr == nil || !session.IsExpired() {
+		return false, nil
+	}
+	return false, tp.RefreshErr
 }
 
 func TestBasicAuthPassword(t *testing.T) {
@@ -826,6 +846,67 @@ func TestAuthOnlyEndpointUnauthorizedOnEmailValidationFailure(t *testing.T) {
 	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
 }
 
+func TestAuthOnlyEndpointKeepsSessionWhenProviderUnavailable(t *testing.T) {
+	test := NewProcessCookieTest(ProcessCookieTestOpts{
+		provider_validate_cookie_response: false,
+	})
+	provider := &TestProvider{
+		ProviderData: &providers.ProviderData{},
+		ValidToken:   false,
+	}
+	test.proxy.provider = provider
+	test.proxy.CookieRefresh = time.Hour
+	test.proxy.providerOutageGrace = time.Hour
+	serve := func(age time.Duration) *httptest.ResponseRecorder {
+		test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+		test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}, time.Now().Add(-age))
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw
+	}
+
+	// the provider rejects the token, so the session is invalid
+	provider.ValidateErr = &providers.StatusError{StatusCode: 401}
+	assert.Equal(t, http.StatusUnauthorized, serve(2*time.Hour).Code)
+
+	// the provider fails to respond, so the session is kept, but not saved
+	provider.ValidateErr = &providers.StatusError{StatusCode: 503}
+	rw := serve(90 * time.Minute)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Set-Cookie"))
+
+	// but not for longer than the grace period
+	assert.Equal(t, http.StatusUnauthorized, serve(150*time.Minute).Code)
+}
+
+func TestKeepsExpiredSessionWhenProviderUnavailable(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	provider := &TestProvider{
+		ProviderData: &providers.ProviderData{},
+		ValidToken:   true,
+	}
+	test.proxy.provider = provider
+	test.proxy.providerOutageGrace = time.Hour
+	serve := func(expired time.Duration) int {
+		test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+		test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			ExpiresOn: time.Now().Add(-expired)}, time.Now())
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw.Code
+	}
+
+	provider.RefreshErr = fmt.Errorf("refreshing: %w", &providers.StatusError{StatusCode: 502})
+	assert.Equal(t, http.StatusAccepted, serve(time.Minute))
+	assert.Equal(t, http.StatusUnauthorized, serve(2*time.Hour))
+
+	// a revoked refresh token is not kept
+	provider.RefreshErr = fmt.Errorf("refreshing: %w", &providers.StatusError{StatusCode: 400})
+	assert.Equal(t, http.StatusUnauthorized, serve(time.Minute))
+}
+
 func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	var pc_test ProcessCookieTest
 
@@ -847,13 +928,65 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 		pc_test.opts.ProxyPrefix+"/auth", nil)
 
 	startSession := &providers.SessionState{
-		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token"}
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token",
+		Groups: []string{"group1", "group/two"}}
 	pc_test.SaveSession(startSession, time.Now())
 
 	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
 	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
 	assert.Equal(t, "oauth_user", pc_test.rw.HeaderMap["X-Auth-Request-User"][0])
 	assert.Equal(t, "oauth_user@example.com", pc_test.rw.HeaderMap["X-Auth-Request-Email"][0])
+	assert.Equal(t, "group1,group/two", pc_test.rw.HeaderMap["X-Auth-Request-Groups"][0])
+}
+
+func TestAuthOnlyEndpointAllowedGroupsAndEmails(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		Groups: []string{"dev", "ops"}}
+
+	cases := []struct {
+		query  string
+		status int
+	}{
+		{"allowed_groups=ops", http.StatusAccepted},
+		{"allowed_groups=admin,ops", http.StatusAccepted},
+		{"allowed_groups=admin&allowed_groups=dev", http.StatusAccepted},
+		{"allowed_groups=admin", http.StatusForbidden},
+		{"allowed_emails=Michael.Bland@gsa.gov", http.StatusAccepted},
+		{"allowed_emails=other@gsa.gov", http.StatusForbidden},
+		{"allowed_groups=ops&allowed_emails=other@gsa.gov", http.StatusForbidden},
+		{"allowed_groups=ops&allowed_emails=other@gsa.gov,michael.bland@gsa.gov", http.StatusAccepted},
+		{"allowed_groups=", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/auth?"+c.query, nil)
+		test.SaveSession(startSession, time.Now())
+		test.rw = httptest.NewRecorder()
+		test.proxy.ServeHTTP(test.rw, test.req)
+		assert.Equal(t, c.status, test.rw.Code, c.query)
+	}
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "forbidden request\n", string(bodyBytes))
+
+	// unauthenticated is still 401
+	test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/auth?allowed_groups=ops", nil)
+	test.rw = httptest.NewRecorder()
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+}
+
+func TestAuthOnlyEndpointForbiddenByPolicy(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	p, err := policy.Compile(`"ops" in groups`)
+	assert.Equal(t, nil, err)
+	test.proxy.policies = []*policy.Policy{p}
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now())
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusForbidden, test.rw.Code)
 }
 
 func TestAuthSkippedForPreflightRequests(t *testing.T) {
@@ -1018,3 +1151,138 @@ func TestRequestSignaturePostRequest(t *testing.T) {
 	assert.Equal(t, 200, st.rw.Code)
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
+
+func NewDeviceAuthTest(t *testing.T) (*OAuthProxy, *httptest.Server) {
+	provider_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/oauth/device":
+			w.Write([]byte(`{"device_code": "imaginary_device_code", "user_code": "WDJB-MJHT",
+				"verification_uri": "https://example.com/device", "expires_in": 900, "interval": 5}`))
+		case "/oauth/token":
+			switch r.Form.Get("device_code") {
+			case "imaginary_device_code":
+				w.Write([]byte(`{"access_token": "my_auth_token"}`))
+			case "pending_device_code":
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error": "authorization_pending"}`))
+			default:
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error": "access_denied"}`))
+			}
+		default:
+			w.Write([]byte(r.Header.Get("X-Forwarded-Email") + " " + r.Header.Get("Authorization")))
+		}
+	}))
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, provider_server.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.DeviceAuthURL = provider_server.URL + "/oauth/device"
+	opts.PassBasicAuth = false
+	opts.PassUserHeaders = true
+	assert.Equal(t, nil, opts.Validate())
+
+	provider_url, _ := url.Parse(provider_server.URL)
+	provider := NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	provider.DeviceAuthURL = opts.provider.Data().DeviceAuthURL
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return email == "michael.bland@gsa.gov"
+	})
+	return proxy, provider_server
+}
+
+func TestDeviceAuth(t *testing.T) {
+	proxy, provider_server := NewDeviceAuthTest(t)
+	defer provider_server.Close()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/device/start", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	var start providers.DeviceAuth
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &start))
+	assert.Equal(t, "WDJB-MJHT", start.UserCode)
+	assert.Equal(t, "https://example.com/device", start.VerificationURI)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth2/device/poll",
+		strings.NewReader("device_code=pending_device_code"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+	assert.Equal(t, "{\"error\":\"authorization_pending\"}\n", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth2/device/poll",
+		strings.NewReader("device_code="+start.DeviceCode))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	var poll struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		CookieName  string `json:"cookie_name"`
+	}
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &poll))
+	assert.Equal(t, "Bearer", poll.TokenType)
+	assert.Equal(t, "_oauth2_proxy", poll.CookieName)
+
+	// the token is accepted as a bearer token, and not passed upstream
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+poll.AccessToken)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "michael.bland@gsa.gov ", rw.Body.String())
+
+	// or as the cookie
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: poll.CookieName, Value: poll.AccessToken})
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "michael.bland@gsa.gov ", rw.Body.String())
+
+	// other bearer tokens are left for the upstream
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: poll.CookieName, Value: poll.AccessToken})
+	req.Header.Set("Authorization", "Bearer upstream_token")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, "michael.bland@gsa.gov Bearer upstream_token", rw.Body.String())
+}
+
+func TestDeviceAuthDenied(t *testing.T) {
+	proxy, provider_server := NewDeviceAuthTest(t)
+	defer provider_server.Close()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/device/poll",
+		strings.NewReader("device_code=denied_device_code"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "{\"error\":\"access_denied\"}\n", rw.Body.String())
+
+	// the Validator applies as in OAuthCallback
+	proxy.Validator = func(email string) bool { return false }
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth2/device/poll",
+		strings.NewReader("device_code=imaginary_device_code"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "{\"error\":\"access_denied\"}\n", rw.Body.String())
+
+	// a forged bearer token is not accepted
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer Zm9v|1600000000|forged")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
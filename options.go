@@ -2,9 +2,10 @@ package main
 
 import (
 	"crypto"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -13,33 +14,56 @@ import (
 	"time"
 
 	"github.com/mbland/hmacauth"
+	"github.com/ploxiln/oauth2_proxy/policy"
 	"github.com/ploxiln/oauth2_proxy/providers"
 )
 
 // Configuration Options that can be set by Command Line Flag, or Config File
 type Options struct {
-	ProxyPrefix     string `flag:"proxy-prefix" cfg:"proxy_prefix"`
-	ProxyWebSockets bool   `flag:"proxy-websockets" cfg:"proxy_websockets"`
-	HttpAddress     string `flag:"http-address" cfg:"http_address"`
-	HttpsAddress    string `flag:"https-address" cfg:"https_address"`
-	ForceHTTPS      bool   `flag:"force-https" cfg:"force_https"`
-	RedirectURL     string `flag:"redirect-url" cfg:"redirect_url"`
-	ClientID        string `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
-	ClientSecret    string `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
-	TLSCertFile     string `flag:"tls-cert-file" cfg:"tls_cert_file"`
-	TLSKeyFile      string `flag:"tls-key-file" cfg:"tls_key_file"`
+	ProxyPrefix          string `flag:"proxy-prefix" cfg:"proxy_prefix"`
+	ProxyWebSockets      bool   `flag:"proxy-websockets" cfg:"proxy_websockets"`
+	HttpAddress          string `flag:"http-address" cfg:"http_address"`
+	HttpsAddress         string `flag:"https-address" cfg:"https_address"`
+	ForceHTTPS           bool   `flag:"force-https" cfg:"force_https"`
+	RedirectURL          string `flag:"redirect-url" cfg:"redirect_url"`
+	ClientID             string `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
+	ClientSecret         string `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
+	ClientAuthMethod     string `flag:"client-auth-method" cfg:"client_auth_method"`
+	ClientPrivateKeyFile string `flag:"client-private-key-file" cfg:"client_private_key_file"`
+	ClientPrivateKeyID   string `flag:"client-private-key-id" cfg:"client_private_key_id"`
+	ClientTLSCertFile    string `flag:"client-tls-cert-file" cfg:"client_tls_cert_file"`
+	ClientTLSKeyFile     string `flag:"client-tls-key-file" cfg:"client_tls_key_file"`
+	TLSCertFile          string `flag:"tls-cert-file" cfg:"tls_cert_file"`
+	TLSKeyFile           string `flag:"tls-key-file" cfg:"tls_key_file"`
 
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
+	AuthenticatedEmailsPlus  bool     `flag:"authenticated-emails-normalize-plus" cfg:"authenticated_emails_normalize_plus"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
+	AzureGroups              []string `flag:"azure-group" cfg:"azure_groups"`
 	BitbucketTeam            string   `flag:"bitbucket-team" cfg:"bitbucket_team"`
+	BitbucketWorkspace       string   `flag:"bitbucket-workspace" cfg:"bitbucket_workspace"`
+	BitbucketRepository      string   `flag:"bitbucket-repository" cfg:"bitbucket_repository"`
+	BitbucketRepoPermission  string   `flag:"bitbucket-repository-permission" cfg:"bitbucket_repository_permission"`
+	DiscordGuilds            []string `flag:"discord-guild" cfg:"discord_guilds"`
+	DiscordRoles             []string `flag:"discord-role" cfg:"discord_roles"`
+	FacebookGraphVersion     string   `flag:"facebook-graph-version" cfg:"facebook_graph_version"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains"`
 	WhitelistDomains         []string `flag:"whitelist-domain" cfg:"whitelist_domains" env:"OAUTH2_PROXY_WHITELIST_DOMAINS"`
-	GitHubOrg                string   `flag:"github-org" cfg:"github_org"`
+	GitHubBaseURL            string   `flag:"github-base-url" cfg:"github_base_url"`
+	GitHubOrgs               []string `flag:"github-org" cfg:"github_org"`
+	GitHubRepo               string   `flag:"github-repo" cfg:"github_repo"`
 	GitHubTeams              []string `flag:"github-team" cfg:"github_teams"`
+	GiteaBaseURL             string   `flag:"gitea-base-url" cfg:"gitea_base_url"`
+	GiteaOrgs                []string `flag:"gitea-org" cfg:"gitea_orgs"`
+	GiteaTeams               []string `flag:"gitea-team" cfg:"gitea_teams"`
 	GitLabGroups             []string `flag:"gitlab-group" cfg:"gitlab_groups"`
+	GitLabProjects           []string `flag:"gitlab-project" cfg:"gitlab_projects"`
+	GitLabProjectAccessLevel string   `flag:"gitlab-project-access-level" cfg:"gitlab_project_access_level"`
 	GoogleGroups             []string `flag:"google-group" cfg:"google_groups"`
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
+	GoogleUseADC             bool     `flag:"google-use-application-default-credentials" cfg:"google_use_application_default_credentials"`
+	GoogleAccessTokenFile    string   `flag:"google-access-token-file" cfg:"google_access_token_file"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file"`
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
@@ -58,6 +82,11 @@ type Options struct {
 
 	Upstreams             []string `flag:"upstream" cfg:"upstreams"`
 	SkipAuthRegex         []string `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
+	AuthzRules            []string `flag:"authz-rule" cfg:"authz_rules"`
+	Policies              []string `flag:"policy" cfg:"policies"`
+	IPRules               []string `flag:"ip-rule" cfg:"ip_rules"`
+	TrustedProxies        []string `flag:"trusted-proxy" cfg:"trusted_proxies"`
+	RateLimits            []string `flag:"rate-limit" cfg:"rate_limits"`
 	SkipAuthStripHeaders  bool     `flag:"skip-auth-strip-headers" cfg:"skip_auth_strip_headers"`
 	PassBasicAuth         bool     `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
 	BasicAuthPassword     string   `flag:"basic-auth-password" cfg:"basic_auth_password"`
@@ -71,6 +100,22 @@ type Options struct {
 
 	FlushInterval time.Duration `flag:"flush-interval" cfg:"flush_interval"`
 
+	HtpasswdLockoutThreshold int           `flag:"htpasswd-lockout-threshold" cfg:"htpasswd_lockout_threshold"`
+	HtpasswdLockout          time.Duration `flag:"htpasswd-lockout" cfg:"htpasswd_lockout"`
+	HtpasswdLockoutMax       time.Duration `flag:"htpasswd-lockout-max" cfg:"htpasswd_lockout_max"`
+
+	GitHubMembershipCacheTTL time.Duration `flag:"github-membership-cache-ttl" cfg:"github_membership_cache_ttl"`
+
+	ProviderConnectTimeout  time.Duration `flag:"provider-connect-timeout" cfg:"provider_connect_timeout"`
+	ProviderResponseTimeout time.Duration `flag:"provider-response-timeout" cfg:"provider_response_timeout"`
+	ProviderRetryBackoff    time.Duration `flag:"provider-retry-backoff" cfg:"provider_retry_backoff"`
+	ProviderBreakerCooldown time.Duration `flag:"provider-circuit-breaker-cooldown" cfg:"provider_circuit_breaker_cooldown"`
+	ProviderOutageGrace     time.Duration `flag:"provider-outage-grace" cfg:"provider_outage_grace"`
+
+	GoogleGroupCacheTTL         time.Duration `flag:"google-group-cache-ttl" cfg:"google_group_cache_ttl"`
+	GoogleGroupCacheNegativeTTL time.Duration `flag:"google-group-cache-negative-ttl" cfg:"google_group_cache_negative_ttl"`
+	GoogleGroupCacheStaleTTL    time.Duration `flag:"google-group-cache-stale-ttl" cfg:"google_group_cache_stale_ttl"`
+
 	// These options allow for other providers besides Google, with
 	// potential overrides.
 	Provider          string `flag:"provider" cfg:"provider"`
@@ -82,10 +127,18 @@ type Options struct {
 	ProfileURL        string `flag:"profile-url" cfg:"profile_url"`
 	ProtectedResource string `flag:"resource" cfg:"resource"`
 	ValidateURL       string `flag:"validate-url" cfg:"validate_url"`
+	DeviceAuthURL     string `flag:"device-auth-url" cfg:"device_auth_url"`
 	Scope             string `flag:"scope" cfg:"scope"`
 	Prompt            string `flag:"prompt" cfg:"prompt"`
 	ApprovalPrompt    string `flag:"approval-prompt" cfg:"approval_prompt"` // Deprecated by OIDC 1.0
 
+	// Outbound requests to the provider
+	ProviderCAFiles          []string `flag:"provider-ca-file" cfg:"provider_ca_files"`
+	ProviderHTTPProxy        string   `flag:"provider-http-proxy" cfg:"provider_http_proxy"`
+	ProviderRequestIDHeader  string   `flag:"provider-request-id-header" cfg:"provider_request_id_header"`
+	ProviderRetries          int      `flag:"provider-retries" cfg:"provider_retries"`
+	ProviderBreakerThreshold int      `flag:"provider-circuit-breaker-threshold" cfg:"provider_circuit_breaker_threshold"`
+
 	RequestLogging       bool   `flag:"request-logging" cfg:"request_logging"`
 	RequestLoggingFormat string `flag:"request-logging-format" cfg:"request_logging_format"`
 	RealClientIPHeader   string `flag:"real-client-ip-header" cfg:"real_client_ip_header"`
@@ -93,13 +146,21 @@ type Options struct {
 	SignatureKey string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
 
 	// internal values that are set after config validation
-	redirectURL   *url.URL
-	proxyURLs     []*url.URL
-	CompiledRegex []*regexp.Regexp
-	provider      providers.Provider
-	signatureData *SignatureData
+	redirectURL    *url.URL
+	proxyURLs      []*url.URL
+	CompiledRegex  []*regexp.Regexp
+	authzRules     []*AuthzRule
+	policies       []*policy.Policy
+	ipRules        []*IPRule
+	trustedProxies []*net.IPNet
+	rateLimits     []*RateLimit
+	provider       providers.Provider
+	signatureData  *SignatureData
 }
 
+var facebookGraphVersion = regexp.MustCompile(`^v[0-9]+\.[0-9]+$`)
+var headerName = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
 type SignatureData struct {
 	hash crypto.Hash
 	key  string
@@ -112,6 +173,7 @@ func NewOptions() *Options {
 		HttpAddress:          "127.0.0.1:4180",
 		HttpsAddress:         ":443",
 		ForceHTTPS:           false,
+		ClientAuthMethod:     "client_secret_post",
 		DisplayHtpasswdForm:  true,
 		CookieName:           "_oauth2_proxy",
 		CookieSecure:         true,
@@ -130,6 +192,23 @@ func NewOptions() *Options {
 		RequestLogging:       true,
 		RequestLoggingFormat: defaultRequestLoggingFormat,
 		RealClientIPHeader:   "X-Real-IP",
+
+		GitHubMembershipCacheTTL: time.Duration(5) * time.Minute,
+
+		HtpasswdLockoutThreshold: 5,
+		HtpasswdLockout:          time.Duration(30) * time.Second,
+		HtpasswdLockoutMax:       time.Duration(1) * time.Hour,
+
+		ProviderConnectTimeout:   time.Duration(10) * time.Second,
+		ProviderResponseTimeout:  time.Duration(30) * time.Second,
+		ProviderRetries:          2,
+		ProviderRetryBackoff:     time.Duration(100) * time.Millisecond,
+		ProviderBreakerThreshold: 5,
+		ProviderBreakerCooldown:  time.Duration(30) * time.Second,
+		ProviderOutageGrace:      time.Duration(1) * time.Hour,
+
+		GoogleGroupCacheTTL:         time.Duration(5) * time.Minute,
+		GoogleGroupCacheNegativeTTL: time.Duration(1) * time.Minute,
 	}
 }
 
@@ -145,23 +224,13 @@ func parseURL(to_parse string, urltype string, msgs []string) (*url.URL, []strin
 func (o *Options) Validate() error {
 	msgs := make([]string, 0)
 
-	if o.SSLInsecureSkipVerify {
-		// TODO: Accept a certificate bundle.
-		default_transport, ok := http.DefaultTransport.(*http.Transport)
-		if ok {
-			default_transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		} else {
-			msgs = append(msgs, "error setting insecure tls config: DefaultTransport is unexpected type")
-		}
-	}
-
 	if o.CookieSecret == "" {
 		msgs = append(msgs, "missing setting: cookie-secret")
 	}
 	if o.ClientID == "" {
 		msgs = append(msgs, "missing setting: client-id")
 	}
-	if o.ClientSecret == "" {
+	if o.ClientSecret == "" && (o.ClientAuthMethod == "" || strings.HasPrefix(o.ClientAuthMethod, "client_secret_")) {
 		msgs = append(msgs, "missing setting: client-secret")
 	}
 	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
@@ -192,6 +261,51 @@ func (o *Options) Validate() error {
 		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
 	}
 
+	for _, spec := range o.AuthzRules {
+		rule, err := parseAuthzRule(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing authz-rule=%q %s", spec, err))
+			continue
+		}
+		o.authzRules = append(o.authzRules, rule)
+	}
+
+	for _, src := range o.Policies {
+		p, err := policy.Compile(src)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling policy=%q %s", src, err))
+			continue
+		}
+		o.policies = append(o.policies, p)
+	}
+
+	for _, spec := range o.IPRules {
+		rule, err := parseIPRule(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing ip-rule=%q %s", spec, err))
+			continue
+		}
+		o.ipRules = append(o.ipRules, rule)
+	}
+
+	for _, s := range o.TrustedProxies {
+		ipNet, err := parseCIDR(s)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing trusted-proxy=%q %s", s, err))
+			continue
+		}
+		o.trustedProxies = append(o.trustedProxies, ipNet)
+	}
+
+	for _, spec := range o.RateLimits {
+		limit, err := parseRateLimit(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing rate-limit=%q %s", spec, err))
+			continue
+		}
+		o.rateLimits = append(o.rateLimits, limit)
+	}
+
 	msgs = parseProviderInfo(o, msgs)
 
 	if o.PassAccessToken || (o.CookieRefresh != time.Duration(0)) {
@@ -237,18 +351,9 @@ func (o *Options) Validate() error {
 	msgs = validateCookieName(o, msgs)
 
 	if o.RealClientIPHeader != "" {
-		valid := false
-		realClientIPHeaders := []string{
-			"X-Real-IP",
-			"X-Forwarded-For",
-			"X-ProxyUser-IP",
-		}
-		for _, s := range realClientIPHeaders {
-			if o.RealClientIPHeader == s {
-				valid = true
-			}
-		}
-		if !valid {
+		if headerName.MatchString(o.RealClientIPHeader) {
+			o.RealClientIPHeader = http.CanonicalHeaderKey(o.RealClientIPHeader)
+		} else {
 			msgs = append(msgs, fmt.Sprintf("unsupported real-client-ip-header %q", o.RealClientIPHeader))
 		}
 	}
@@ -273,35 +378,130 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 	p.ProfileURL, msgs = parseURL(o.ProfileURL, "profile", msgs)
 	p.ValidateURL, msgs = parseURL(o.ValidateURL, "validate", msgs)
 	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
+	p.DeviceAuthURL, msgs = parseURL(o.DeviceAuthURL, "device-auth", msgs)
+
+	clientConfig := providers.HTTPClientConfig{
+		ConnectTimeout:     o.ProviderConnectTimeout,
+		ResponseTimeout:    o.ProviderResponseTimeout,
+		CAFiles:            o.ProviderCAFiles,
+		InsecureSkipVerify: o.SSLInsecureSkipVerify,
+		RequestIDHeader:    o.ProviderRequestIDHeader,
+		Retries:            o.ProviderRetries,
+		RetryBackoff:       o.ProviderRetryBackoff,
+		Breaker:            providers.NewCircuitBreaker(o.ProviderBreakerThreshold, o.ProviderBreakerCooldown),
+	}
+	if o.ProviderHTTPProxy != "" {
+		clientConfig.ProxyURL, msgs = parseURL(o.ProviderHTTPProxy, "provider-http-proxy", msgs)
+	}
+	var err error
+	p.HTTPClient, err = providers.NewHTTPClient(clientConfig)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("error configuring provider http client: %s", err))
+	}
+	msgs = parseClientAuth(o, p, clientConfig, msgs)
 
 	o.provider = providers.New(o.Provider, p)
 	switch p := o.provider.(type) {
 	case *providers.AzureProvider:
 		p.Configure(o.AzureTenant)
+		p.SetGroups(o.AzureGroups)
 	case *providers.BitbucketProvider:
-		p.SetTeam(o.BitbucketTeam)
+		if o.BitbucketTeam != "" && o.BitbucketWorkspace != "" && o.BitbucketTeam != o.BitbucketWorkspace {
+			msgs = append(msgs, "bitbucket-team is a deprecated alias of bitbucket-workspace, set only one")
+		}
+		if o.BitbucketWorkspace != "" {
+			p.SetWorkspace(o.BitbucketWorkspace)
+		} else {
+			p.SetTeam(o.BitbucketTeam)
+		}
+		if err := p.SetRepository(o.BitbucketRepository, o.BitbucketRepoPermission); err != nil {
+			msgs = append(msgs, fmt.Sprintf("bitbucket-repository-permission: %s", err))
+		}
+	case *providers.DiscordProvider:
+		if len(o.DiscordRoles) > 0 && len(o.DiscordGuilds) == 0 {
+			msgs = append(msgs, "missing setting: discord-guild (required with discord-role)")
+		}
+		p.SetGuildsRoles(o.DiscordGuilds, o.DiscordRoles)
+	case *providers.FacebookProvider:
+		if o.FacebookGraphVersion != "" && !facebookGraphVersion.MatchString(o.FacebookGraphVersion) {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: facebook-graph-version=%q (expected a version like v19.0)", o.FacebookGraphVersion))
+		} else {
+			p.SetGraphVersion(o.FacebookGraphVersion)
+		}
 	case *providers.GitHubProvider:
-		p.SetOrgTeam(o.GitHubOrg, o.GitHubTeams)
+		if o.GitHubBaseURL != "" {
+			var baseURL *url.URL
+			baseURL, msgs = parseURL(o.GitHubBaseURL, "github-base", msgs)
+			if baseURL != nil && (baseURL.Scheme == "" || baseURL.Host == "") {
+				msgs = append(msgs, fmt.Sprintf("github-base-url=%q must be an absolute url", o.GitHubBaseURL))
+			} else {
+				p.SetBaseURL(baseURL)
+			}
+		}
+		p.SetOrgTeam(o.GitHubOrgs, o.GitHubTeams)
+		p.SetRepo(o.GitHubRepo)
+		p.SetMembershipCacheTTL(o.GitHubMembershipCacheTTL)
+	case *providers.GiteaProvider:
+		if o.GiteaBaseURL != "" {
+			var baseURL *url.URL
+			baseURL, msgs = parseURL(o.GiteaBaseURL, "gitea-base", msgs)
+			if baseURL != nil && (baseURL.Scheme == "" || baseURL.Host == "") {
+				msgs = append(msgs, fmt.Sprintf("gitea-base-url=%q must be an absolute url", o.GiteaBaseURL))
+			} else {
+				p.SetBaseURL(baseURL)
+			}
+		}
+		if len(o.GiteaTeams) > 0 && len(o.GiteaOrgs) == 0 {
+			msgs = append(msgs, "missing setting: gitea-org (required with gitea-team)")
+		}
+		p.SetOrgTeam(o.GiteaOrgs, o.GiteaTeams)
 	case *providers.GitLabProvider:
 		p.SetGroups(o.GitLabGroups)
+		if err := p.SetProjects(o.GitLabProjects, o.GitLabProjectAccessLevel); err != nil {
+			msgs = append(msgs, fmt.Sprintf("gitlab-project-access-level: %s", err))
+		}
 	case *providers.GoogleProvider:
-		if len(o.GoogleGroups) > 0 || o.GoogleAdminEmail != "" || o.GoogleServiceAccountJSON != "" {
+		credentialSources := 0
+		for _, set := range []bool{o.GoogleServiceAccountJSON != "", o.GoogleUseADC, o.GoogleAccessTokenFile != ""} {
+			if set {
+				credentialSources++
+			}
+		}
+		if len(o.GoogleGroups) > 0 || o.GoogleAdminEmail != "" || credentialSources > 0 {
 			if len(o.GoogleGroups) < 1 {
 				msgs = append(msgs, "missing setting: google-group")
 			}
-			if o.GoogleAdminEmail == "" {
-				msgs = append(msgs, "missing setting: google-admin-email")
+			if credentialSources == 0 {
+				msgs = append(msgs, "missing setting: google-service-account-json, google-use-application-default-credentials or google-access-token-file")
+			} else if credentialSources > 1 {
+				msgs = append(msgs, "only one of google-service-account-json, google-use-application-default-credentials or google-access-token-file may be set")
 			}
-			if o.GoogleServiceAccountJSON == "" {
-				msgs = append(msgs, "missing setting: google-service-account-json")
+			if o.GoogleServiceAccountJSON != "" && o.GoogleAdminEmail == "" {
+				msgs = append(msgs, "missing setting: google-admin-email")
 			}
 		}
-		if o.GoogleServiceAccountJSON != "" {
-			file, err := os.Open(o.GoogleServiceAccountJSON)
-			if err != nil {
-				msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
-			} else {
-				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
+		if credentialSources == 1 {
+			p.SetGroupCache(o.GoogleGroupCacheTTL, o.GoogleGroupCacheNegativeTTL, o.GoogleGroupCacheStaleTTL)
+			switch {
+			case o.GoogleServiceAccountJSON != "":
+				file, err := os.Open(o.GoogleServiceAccountJSON)
+				if err != nil {
+					msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
+				} else {
+					err = p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
+					file.Close()
+					if err != nil {
+						msgs = append(msgs, fmt.Sprintf("invalid Google credentials file: %s: %s", o.GoogleServiceAccountJSON, err))
+					}
+				}
+			case o.GoogleUseADC:
+				if err := p.SetGroupRestrictionADC(o.GoogleGroups, o.GoogleAdminEmail); err != nil {
+					msgs = append(msgs, fmt.Sprintf("invalid Google application default credentials: %s", err))
+				}
+			case o.GoogleAccessTokenFile != "":
+				if err := p.SetGroupRestrictionTokenFile(o.GoogleGroups, o.GoogleAccessTokenFile); err != nil {
+					msgs = append(msgs, fmt.Sprintf("invalid Google access token file: %s", err))
+				}
 			}
 		}
 	case *providers.OIDCProvider:
@@ -333,6 +533,39 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 	return msgs
 }
 
+func parseClientAuth(o *Options, p *providers.ProviderData, clientConfig providers.HTTPClientConfig, msgs []string) []string {
+	switch o.ClientAuthMethod {
+	case "", "client_secret_post":
+		p.ClientAuth = providers.NewClientSecretPost(o.ClientID, o.ClientSecret)
+	case "client_secret_basic":
+		p.ClientAuth = providers.NewClientSecretBasic(o.ClientID, o.ClientSecret)
+	case "private_key_jwt":
+		if o.ClientPrivateKeyFile == "" {
+			return append(msgs, "missing setting: client-private-key-file (required with client-auth-method=private_key_jwt)")
+		}
+		keyPEM, err := ioutil.ReadFile(o.ClientPrivateKeyFile)
+		if err != nil {
+			return append(msgs, fmt.Sprintf("error reading client-private-key-file: %s", err))
+		}
+		p.ClientAuth, err = providers.NewPrivateKeyJWT(o.ClientID, keyPEM, o.ClientPrivateKeyID)
+		if err != nil {
+			return append(msgs, fmt.Sprintf("invalid client-private-key-file=%q %s", o.ClientPrivateKeyFile, err))
+		}
+	case "tls_client_auth":
+		if o.ClientTLSCertFile == "" || o.ClientTLSKeyFile == "" {
+			return append(msgs, "missing setting: client-tls-cert-file and client-tls-key-file (required with client-auth-method=tls_client_auth)")
+		}
+		var err error
+		p.ClientAuth, err = providers.NewTLSClientAuth(o.ClientID, o.ClientTLSCertFile, o.ClientTLSKeyFile, clientConfig)
+		if err != nil {
+			return append(msgs, fmt.Sprintf("error loading client-tls-cert-file: %s", err))
+		}
+	default:
+		return append(msgs, fmt.Sprintf("unsupported client-auth-method %q", o.ClientAuthMethod))
+	}
+	return msgs
+}
+
 func parseSignatureKey(o *Options, msgs []string) []string {
 	if o.SignatureKey == "" {
 		return msgs
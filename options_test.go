@@ -6,7 +6,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -52,9 +54,39 @@ func TestGoogleGroupOptions(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 
 	expected := errorMsg([]string{
-		"missing setting: google-admin-email",
-		"missing setting: google-service-account-json"})
+		"missing setting: google-service-account-json, google-use-application-default-credentials or google-access-token-file"})
 	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.GoogleGroups = []string{"googlegroup"}
+	o.GoogleServiceAccountJSON = "file_doesnt_exist.json"
+	o.GoogleUseADC = true
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"only one of google-service-account-json, google-use-application-default-credentials or google-access-token-file may be set",
+		"missing setting: google-admin-email"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestGoogleGroupAccessTokenFile(t *testing.T) {
+	o := testOptions()
+	o.GoogleGroups = []string{"test_group"}
+	o.GoogleAccessTokenFile = "file_doesnt_exist"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid Google access token file: open file_doesnt_exist")
+
+	f, _ := ioutil.TempFile("", "google_access_token")
+	defer os.Remove(f.Name())
+	f.WriteString("ya29.token\n")
+	f.Close()
+
+	o = testOptions()
+	o.GoogleGroups = []string{"test_group"}
+	o.GoogleAccessTokenFile = f.Name()
+	assert.Equal(t, nil, o.Validate())
 }
 
 func TestGoogleGroupInvalidFile(t *testing.T) {
@@ -93,6 +125,100 @@ func TestMultiGitLabGroupOptions(t *testing.T) {
 	assert.Equal(t, 0, len(opts.GitLabGroups))
 }
 
+func TestMultiGitHubOrgOptions(t *testing.T) {
+	flagSet := mainFlagSet()
+	flagSet.Parse([]string{"--github-org=one", "-github-org=two"})
+	opts := NewOptions()
+	cfg := make(EnvOptions)
+	options.Resolve(opts, flagSet, cfg)
+
+	assert.Equal(t, []string{"one", "two"}, opts.GitHubOrgs)
+
+	// a single org in the config file is still accepted
+	flagSet = mainFlagSet()
+	flagSet.Parse([]string{})
+	opts = NewOptions()
+	cfg["github_org"] = "three"
+	options.Resolve(opts, flagSet, cfg)
+
+	assert.Equal(t, []string{"three"}, opts.GitHubOrgs)
+}
+
+func TestGiteaOptions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "gitea"
+	o.GiteaBaseURL = "https://gitea.example.com"
+	o.GiteaOrgs = []string{"org1"}
+	o.GiteaTeams = []string{"devs"}
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.Data()
+	assert.Equal(t, "https://gitea.example.com/login/oauth/authorize", p.LoginURL.String())
+	assert.Equal(t, "https://gitea.example.com/api/v1/user", p.ValidateURL.String())
+
+	o = testOptions()
+	o.Provider = "forgejo"
+	o.GiteaBaseURL = "codeberg.org"
+	o.GiteaTeams = []string{"devs"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`gitea-base-url="codeberg.org" must be an absolute url`,
+		"missing setting: gitea-org (required with gitea-team)"}), err.Error())
+}
+
+func TestDiscordRoleOptions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "discord"
+	o.DiscordRoles = []string{"2001"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"missing setting: discord-guild (required with discord-role)"}), err.Error())
+
+	o = testOptions()
+	o.Provider = "discord"
+	o.DiscordGuilds = []string{"1001"}
+	o.DiscordRoles = []string{"2001"}
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestFacebookGraphVersionOption(t *testing.T) {
+	o := testOptions()
+	o.Provider = "facebook"
+	o.FacebookGraphVersion = "v21.0"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.Data()
+	assert.Equal(t, "https://www.facebook.com/v21.0/dialog/oauth", p.LoginURL.String())
+	assert.Equal(t, "https://graph.facebook.com/v21.0/oauth/access_token", p.RedeemURL.String())
+	assert.Equal(t, "https://graph.facebook.com/v21.0/me", p.ProfileURL.String())
+
+	o = testOptions()
+	o.Provider = "facebook"
+	o.FacebookGraphVersion = "21"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`invalid setting: facebook-graph-version="21" (expected a version like v19.0)`}), err.Error())
+}
+
+func TestGitHubBaseURLOption(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubBaseURL = "https://github.example.com"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.Data()
+	assert.Equal(t, "https://github.example.com/login/oauth/authorize", p.LoginURL.String())
+	assert.Equal(t, "https://github.example.com/login/oauth/access_token", p.RedeemURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3/", p.ValidateURL.String())
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubBaseURL = "github.example.com"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "must be an absolute url")
+}
+
 // Note that it's not worth testing nonparseable URLs, since url.Parse()
 // seems to parse damn near anything.
 func TestRedirectURL(t *testing.T) {
@@ -356,3 +482,107 @@ func TestSecretBytesNonBase64(t *testing.T) {
 	assert.Equal(t, raw32, string(sb32))
 	assert.Equal(t, 32, len(sb32))
 }
+
+func TestClientAuthMethod(t *testing.T) {
+	o := testOptions()
+	o.ClientAuthMethod = "client_secret_jwt"
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  unsupported client-auth-method \"client_secret_jwt\"", err.Error())
+
+	o = testOptions()
+	o.ClientSecret = ""
+	o.ClientAuthMethod = "private_key_jwt"
+	err = o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  missing setting: client-private-key-file (required with client-auth-method=private_key_jwt)", err.Error())
+
+	o = testOptions()
+	o.ClientSecret = ""
+	o.ClientAuthMethod = "tls_client_auth"
+	o.ClientTLSCertFile = "client.crt"
+	err = o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  missing setting: client-tls-cert-file and client-tls-key-file (required with client-auth-method=tls_client_auth)", err.Error())
+
+	o = testOptions()
+	o.ClientAuthMethod = "client_secret_basic"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestProviderHTTPClient(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, nil, o.Validate())
+	client := o.provider.Data().HTTPClient
+	assert.NotEqual(t, nil, client)
+	assert.Equal(t, 30*time.Second, client.Timeout)
+
+	o = testOptions()
+	o.ProviderCAFiles = []string{"/nonexistent/ca.crt"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "error configuring provider http client")
+}
+
+func TestAuthzRuleOption(t *testing.T) {
+	o := testOptions()
+	o.AuthzRules = []string{"path=^/admin groups=ops", "path=^/status$ public"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.authzRules))
+
+	o = testOptions()
+	o.AuthzRules = []string{"path=^/admin users=bob"}
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  error parsing authz-rule=\"path=^/admin users=bob\" unknown field \"users\"", err.Error())
+}
+
+func TestPolicyOption(t *testing.T) {
+	o := testOptions()
+	o.Policies = []string{`ops: "ops" in groups`, `request.method != "DELETE"`}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.policies))
+	assert.Equal(t, "ops", o.policies[0].String())
+
+	o = testOptions()
+	o.Policies = []string{`"ops" in group`}
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  error compiling policy=\"\\\"ops\\\" in group\" unknown variable \"group\" at 9", err.Error())
+}
+
+func TestIPRuleOption(t *testing.T) {
+	o := testOptions()
+	o.IPRules = []string{"cidr=10.0.0.0/8 skip-auth", "path=^/admin/ deny"}
+	o.TrustedProxies = []string{"127.0.0.1", "172.16.0.0/12"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.ipRules))
+	assert.Equal(t, "127.0.0.1/32", o.trustedProxies[0].String())
+	assert.Equal(t, "172.16.0.0/12", o.trustedProxies[1].String())
+
+	o = testOptions()
+	o.IPRules = []string{"cidr=10.0.0.0/8"}
+	o.TrustedProxies = []string{"localhost"}
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  error parsing ip-rule=\"cidr=10.0.0.0/8\" one of skip-auth, auth or deny is required\n"+
+		"  error parsing trusted-proxy=\"localhost\" invalid ip address \"localhost\"", err.Error())
+}
+
+func TestRealClientIPHeader(t *testing.T) {
+	o := testOptions()
+	o.RealClientIPHeader = "forwarded"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "Forwarded", o.RealClientIPHeader)
+
+	o = testOptions()
+	o.RealClientIPHeader = "CF-Connecting-IP"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "Cf-Connecting-Ip", o.RealClientIPHeader)
+
+	o = testOptions()
+	o.RealClientIPHeader = "X-Real-IP:"
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  unsupported real-client-ip-header \"X-Real-IP:\"", err.Error())
+}
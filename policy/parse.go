@@ -0,0 +1,317 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// operators, longest first
+var operators = []string{"&&", "||", "==", "!=", "!", "(", ")", "[", "]", ",", "."}
+
+func tokenize(src string) ([]token, error) {
+	if !utf8.ValidString(src) {
+		return nil, fmt.Errorf("invalid UTF-8")
+	}
+	var tokens []token
+	for i := 0; i < len(src); {
+		c, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += size
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + size
+			for j < len(src) {
+				r, n := utf8.DecodeRuneInString(src[j:])
+				if r == c {
+					break
+				}
+				if r == '\\' && j+n < len(src) {
+					j += n
+					r, n = utf8.DecodeRuneInString(src[j:])
+				}
+				b.WriteRune(r)
+				j += n
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{tokString, b.String(), i})
+			i = j + 1
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(src) {
+				r, n := utf8.DecodeRuneInString(src[j:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += n
+			}
+			tokens = append(tokens, token{tokIdent, src[i:j], i})
+			i = j
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{tokOp, op, i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(src)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(kind tokenKind, value string) bool {
+	if t := p.peek(); t.kind == kind && t.value == value {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(value string) error {
+	if !p.accept(tokOp, value) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.value, t.pos)
+}
+
+func parse(src string) (node, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	return n, nil
+}
+
+// or := and ("||" and)*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+// and := unary ("&&" unary)*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+// unary := "!" unary | comparison
+func (p *parser) parseUnary() (node, error) {
+	if p.accept(tokOp, "!") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+	return p.parseComparison()
+}
+
+// comparison := operand (("==" | "!=" | "in" | "matches") operand)?
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.value == "==" || t.value == "!="):
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &equalNode{left, right, t.value == "!="}, nil
+	case t.kind == tokIdent && t.value == "in":
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &inNode{left, right}, nil
+	case t.kind == tokIdent && t.value == "matches":
+		p.next()
+		r := p.next()
+		if r.kind != tokString {
+			return nil, fmt.Errorf("matches requires a string literal regex at %d", r.pos)
+		}
+		re, err := regexp.Compile(r.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex at %d: %s", r.pos, err)
+		}
+		return &matchesNode{left, re}, nil
+	}
+	return left, nil
+}
+
+// operand := string | "true" | "false" | list | "(" or ")" | call | path
+func (p *parser) parseOperand() (node, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokString:
+		return &literalNode{t.value}, nil
+	case t.kind == tokIdent && (t.value == "true" || t.value == "false"):
+		b, _ := strconv.ParseBool(t.value)
+		return &literalNode{b}, nil
+	case t.kind == tokOp && t.value == "[":
+		var items []node
+		for !p.accept(tokOp, "]") {
+			if len(items) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			item, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return &listNode{items}, nil
+	case t.kind == tokOp && t.value == "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case t.kind == tokIdent && p.peek().kind == tokOp && p.peek().value == "(":
+		return p.parseCall(t)
+	case t.kind == tokIdent:
+		if _, ok := variables[t.value]; !ok {
+			return nil, fmt.Errorf("unknown variable %q at %d", t.value, t.pos)
+		}
+		var n node = &variableNode{t.value}
+		for {
+			if p.accept(tokOp, ".") {
+				f := p.next()
+				if f.kind != tokIdent {
+					return nil, fmt.Errorf("expected a field name at %d", f.pos)
+				}
+				n = &fieldNode{n, &literalNode{f.value}}
+			} else if p.accept(tokOp, "[") {
+				key, err := p.parseOperand()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect("]"); err != nil {
+					return nil, err
+				}
+				n = &fieldNode{n, key}
+			} else {
+				return n, nil
+			}
+		}
+	}
+	if t.kind != tokEOF {
+		p.pos--
+	}
+	return nil, p.unexpected()
+}
+
+// call := ident "(" (operand ("," operand)*)? ")"
+func (p *parser) parseCall(name token) (node, error) {
+	f, ok := functions[name.value]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name.value, name.pos)
+	}
+	p.next() // "("
+	var args []node
+	for !p.accept(tokOp, ")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) != f.args {
+		return nil, fmt.Errorf("%s() takes %d arguments, got %d", name.value, f.args, len(args))
+	}
+	return &callNode{name.value, f, args}, nil
+}
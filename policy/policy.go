@@ -0,0 +1,390 @@
+// Package policy implements a small boolean expression language, evaluated
+// against an authenticated session and the request, for authorization
+// decisions. For example:
+//
+//	"ops" in groups && request.method != "DELETE"
+//	endsWith(email, "@example.com") || user in ["alice", "bob"]
+//	request.path matches "^/api/" && request.header["X-Api-Version"] == "2"
+//
+// Variables are email, domain (of the email), user, groups, provider, claims
+// and request (with method, host, path, header and ip). Operators are ==, !=,
+// in (list membership), matches (regex), &&, || and !, and the functions are
+// startsWith, endsWith, contains, lower and inCIDR. Comparisons are of strings, and
+// a missing field is "".
+package policy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Request holds the attributes of the request which policies can use
+type Request struct {
+	Method string
+	Host   string
+	Path   string
+	Header http.Header
+	// IP is the client's address
+	IP string
+}
+
+// Input is what a policy is evaluated against
+type Input struct {
+	Email    string
+	User     string
+	Groups   []string
+	Provider string
+	// Claims are other attributes of the session
+	Claims  map[string]interface{}
+	Request Request
+}
+
+// Policy is a compiled expression
+type Policy struct {
+	Name string
+	src  string
+	expr node
+}
+
+var namePrefix = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+):\s`)
+
+// Compile parses an expression, optionally prefixed with a name followed by a
+// colon (e.g. "no-deletes: request.method != \"DELETE\""). Without a name, the
+// expression itself is used as the name.
+func Compile(src string) (*Policy, error) {
+	p := &Policy{src: strings.TrimSpace(src)}
+	if m := namePrefix.FindStringSubmatchIndex(src); m != nil {
+		p.Name = src[m[2]:m[3]]
+		p.src = strings.TrimSpace(src[m[1]:])
+	}
+	if p.Name == "" {
+		p.Name = p.src
+	}
+	expr, err := parse(p.src)
+	if err != nil {
+		return nil, err
+	}
+	p.expr = expr
+	return p, nil
+}
+
+func (p *Policy) String() string {
+	return p.Name
+}
+
+// Eval returns whether the policy allows the input. Errors (e.g. comparing a
+// list with a string) are returned with false.
+func (p *Policy) Eval(in *Input) (bool, error) {
+	v, err := p.expr.eval(in)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression is not a boolean: %s", describe(v))
+	}
+	return b, nil
+}
+
+// Check evaluates the policies in order, returning the first which denies the
+// input (or failed to evaluate, with the error), or nil if all allow it
+func Check(policies []*Policy, in *Input) (*Policy, error) {
+	for _, p := range policies {
+		ok, err := p.Eval(in)
+		if err != nil || !ok {
+			return p, err
+		}
+	}
+	return nil, nil
+}
+
+// values are string, bool, []string or map[string]interface{}
+
+var variables = map[string]func(in *Input) interface{}{
+	"email": func(in *Input) interface{} { return in.Email },
+	"domain": func(in *Input) interface{} {
+		if i := strings.LastIndex(in.Email, "@"); i >= 0 {
+			return strings.ToLower(in.Email[i+1:])
+		}
+		return ""
+	},
+	"user":     func(in *Input) interface{} { return in.User },
+	"groups":   func(in *Input) interface{} { return in.Groups },
+	"provider": func(in *Input) interface{} { return in.Provider },
+	"claims": func(in *Input) interface{} {
+		if in.Claims == nil {
+			return map[string]interface{}{}
+		}
+		return in.Claims
+	},
+	"request": func(in *Input) interface{} {
+		header := make(map[string]interface{}, len(in.Request.Header))
+		for k, v := range in.Request.Header {
+			header[k] = strings.Join(v, ",")
+		}
+		return map[string]interface{}{
+			"method": in.Request.Method,
+			"host":   in.Request.Host,
+			"path":   in.Request.Path,
+			"header": header,
+			"ip":     in.Request.IP,
+		}
+	},
+}
+
+type function struct {
+	args int
+	call func(args []string) (interface{}, error)
+}
+
+var functions = map[string]function{
+	"startsWith": {2, func(a []string) (interface{}, error) { return strings.HasPrefix(a[0], a[1]), nil }},
+	"endsWith":   {2, func(a []string) (interface{}, error) { return strings.HasSuffix(a[0], a[1]), nil }},
+	"contains":   {2, func(a []string) (interface{}, error) { return strings.Contains(a[0], a[1]), nil }},
+	"lower":      {1, func(a []string) (interface{}, error) { return strings.ToLower(a[0]), nil }},
+	"inCIDR":     {2, inCIDR},
+}
+
+// inCIDR returns whether the address is in the network, e.g.
+// inCIDR(request.ip, "10.0.0.0/8")
+func inCIDR(a []string) (interface{}, error) {
+	_, ipNet, err := net.ParseCIDR(a[1])
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(a[0])
+	return ip != nil && ipNet.Contains(ip), nil
+}
+
+func describe(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case []string:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// normalize converts claim values to the expression types
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			list = append(list, fmt.Sprint(item))
+		}
+		return list
+	case string, bool, []string, map[string]interface{}:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+type node interface {
+	eval(in *Input) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+func (n *literalNode) eval(in *Input) (interface{}, error) { return n.value, nil }
+
+type listNode struct{ items []node }
+
+func (n *listNode) eval(in *Input) (interface{}, error) {
+	list := make([]string, 0, len(n.items))
+	for _, item := range n.items {
+		s, err := evalString(item, in)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+type variableNode struct{ name string }
+
+func (n *variableNode) eval(in *Input) (interface{}, error) {
+	return variables[n.name](in), nil
+}
+
+type fieldNode struct {
+	object node
+	key    node
+}
+
+func (n *fieldNode) eval(in *Input) (interface{}, error) {
+	obj, err := n.object.eval(in)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("can not get a field of a %s", describe(obj))
+	}
+	key, err := evalString(n.key, in)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := m[key]; ok {
+		return normalize(v), nil
+	}
+	// request headers are canonicalized
+	if v, ok := m[http.CanonicalHeaderKey(key)]; ok {
+		return normalize(v), nil
+	}
+	return "", nil
+}
+
+type callNode struct {
+	name string
+	f    function
+	args []node
+}
+
+func (n *callNode) eval(in *Input) (interface{}, error) {
+	args := make([]string, len(n.args))
+	for i, arg := range n.args {
+		s, err := evalString(arg, in)
+		if err != nil {
+			return nil, fmt.Errorf("%s(): %s", n.name, err)
+		}
+		args[i] = s
+	}
+	v, err := n.f.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %s", n.name, err)
+	}
+	return v, nil
+}
+
+func evalString(n node, in *Input) (string, error) {
+	v, err := n.eval(in)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got a %s", describe(v))
+	}
+	return s, nil
+}
+
+func evalBool(n node, in *Input) (bool, error) {
+	v, err := n.eval(in)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool, got a %s", describe(v))
+	}
+	return b, nil
+}
+
+type notNode struct{ operand node }
+
+func (n *notNode) eval(in *Input) (interface{}, error) {
+	b, err := evalBool(n.operand, in)
+	return !b, err
+}
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(in *Input) (interface{}, error) {
+	b, err := evalBool(n.left, in)
+	if err != nil || !b {
+		return false, err
+	}
+	return evalBool(n.right, in)
+}
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(in *Input) (interface{}, error) {
+	b, err := evalBool(n.left, in)
+	if err != nil || b {
+		return b, err
+	}
+	return evalBool(n.right, in)
+}
+
+type equalNode struct {
+	left, right node
+	negate      bool
+}
+
+func (n *equalNode) eval(in *Input) (interface{}, error) {
+	l, err := n.left.eval(in)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(in)
+	if err != nil {
+		return nil, err
+	}
+	var equal bool
+	switch l := l.(type) {
+	case string:
+		s, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("can not compare a string with a %s", describe(r))
+		}
+		equal = l == s
+	case bool:
+		b, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("can not compare a bool with a %s", describe(r))
+		}
+		equal = l == b
+	default:
+		return nil, fmt.Errorf("can not compare a %s", describe(l))
+	}
+	return equal != n.negate, nil
+}
+
+type inNode struct{ item, list node }
+
+func (n *inNode) eval(in *Input) (interface{}, error) {
+	item, err := evalString(n.item, in)
+	if err != nil {
+		return nil, err
+	}
+	v, err := n.list.eval(in)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := v.([]string)
+	if !ok {
+		return nil, fmt.Errorf("in requires a list, got a %s", describe(v))
+	}
+	for _, s := range list {
+		if s == item {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type matchesNode struct {
+	operand node
+	re      *regexp.Regexp
+}
+
+func (n *matchesNode) eval(in *Input) (interface{}, error) {
+	s, err := evalString(n.operand, in)
+	if err != nil {
+		return nil, err
+	}
+	return n.re.MatchString(s), nil
+}
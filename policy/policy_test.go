@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testdata/policies.json has policies with inputs and the expected decision,
+// and new cases can be added there to check a policy before deploying it
+func TestPolicies(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/policies.json")
+	assert.Equal(t, nil, err)
+	var tests []struct {
+		Policy string
+		Cases  []struct {
+			Input Input
+			Allow bool
+			Error bool
+		}
+	}
+	assert.Equal(t, nil, json.Unmarshal(data, &tests))
+
+	for _, test := range tests {
+		p, err := Compile(test.Policy)
+		if err != nil {
+			t.Errorf("compiling %q: %s", test.Policy, err)
+			continue
+		}
+		for i, c := range test.Cases {
+			allow, err := p.Eval(&c.Input)
+			assert.Equal(t, c.Error, err != nil, "%s case %d: %v", p, i, err)
+			assert.Equal(t, c.Allow, allow, "%s case %d", p, i)
+		}
+	}
+}
+
+func TestCompileName(t *testing.T) {
+	p, err := Compile(` no-deletes: request.method != "DELETE"`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "no-deletes", p.String())
+
+	p, err = Compile(`request.method != "DELETE" `)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `request.method != "DELETE"`, p.String())
+
+	// not a name
+	p, err = Compile(`"a:b" == user`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `"a:b" == user`, p.String())
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		`email ==`,
+		`email == "x`,
+		`unknown == "x"`,
+		`nosuch(email)`,
+		`lower(email, "x") == "x"`,
+		`email matches "["`,
+		`email matches user`,
+		`(email == "x"`,
+		`email == "x" "y"`,
+		`email = "x"`,
+		`user in ["a" "b"]`,
+		`user == "jörg" ∧ email != ""`,
+		`café == "x"`,
+		"user == \"\xff\"",
+	} {
+		_, err := Compile(src)
+		assert.NotEqual(t, nil, err, src)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var policies []*Policy
+	for _, src := range []string{`signed-in: email != ""`, `no-deletes: request.method != "DELETE"`} {
+		p, err := Compile(src)
+		assert.Equal(t, nil, err)
+		policies = append(policies, p)
+	}
+	in := &Input{Email: "alice@example.com", Request: Request{Method: "GET"}}
+	denied, err := Check(policies, in)
+	assert.Equal(t, (*Policy)(nil), denied)
+	assert.Equal(t, nil, err)
+
+	in.Request.Method = "DELETE"
+	denied, err = Check(policies, in)
+	assert.Equal(t, "no-deletes", denied.String())
+	assert.Equal(t, nil, err)
+}
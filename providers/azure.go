@@ -1,11 +1,17 @@
 package providers
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/bitly/go-simplejson"
 	"github.com/ploxiln/oauth2_proxy/api"
@@ -14,6 +20,9 @@ import (
 type AzureProvider struct {
 	*ProviderData
 	Tenant string
+	// Groups are object ids of Azure AD groups, any of which the user must be
+	// a member of
+	Groups []string
 }
 
 func NewAzureProvider(p *ProviderData) *AzureProvider {
@@ -21,20 +30,20 @@ func NewAzureProvider(p *ProviderData) *AzureProvider {
 
 	if p.ProfileURL == nil || p.ProfileURL.String() == "" {
 		p.ProfileURL = &url.URL{
-			Scheme:   "https",
-			Host:     "graph.windows.net",
-			Path:     "/me",
-			RawQuery: "api-version=1.6",
+			Scheme: "https",
+			Host:   "graph.microsoft.com",
+			Path:   "/v1.0/me",
 		}
 	}
-	if p.ProtectedResource == nil || p.ProtectedResource.String() == "" {
-		p.ProtectedResource = &url.URL{
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = &url.URL{
 			Scheme: "https",
-			Host:   "graph.windows.net",
+			Host:   "graph.microsoft.com",
+			Path:   "/v1.0/me",
 		}
 	}
 	if p.Scope == "" {
-		p.Scope = "openid"
+		p.Scope = "openid email profile offline_access User.Read"
 	}
 
 	return &AzureProvider{ProviderData: p}
@@ -46,27 +55,273 @@ func (p *AzureProvider) Configure(tenant string) {
 		p.Tenant = "common"
 	}
 
+	// https://docs.microsoft.com/en-us/azure/active-directory/develop/v2-oauth2-auth-code-flow
 	if p.LoginURL == nil || p.LoginURL.String() == "" {
 		p.LoginURL = &url.URL{
 			Scheme: "https",
 			Host:   "login.microsoftonline.com",
-			Path:   "/" + p.Tenant + "/oauth2/authorize"}
+			Path:   "/" + p.Tenant + "/oauth2/v2.0/authorize"}
 	}
 	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
 		p.RedeemURL = &url.URL{
 			Scheme: "https",
 			Host:   "login.microsoftonline.com",
-			Path:   "/" + p.Tenant + "/oauth2/token",
+			Path:   "/" + p.Tenant + "/oauth2/v2.0/token",
 		}
 	}
 }
 
+// SetGroups restricts logins to members of any of the groups (object ids).
+// Group memberships are taken from the "groups" claim of the id_token, or
+// looked up in Microsoft Graph if the user is in too many groups for the claim.
+func (p *AzureProvider) SetGroups(groups []string) {
+	p.Groups = groups
+	if len(groups) > 0 {
+		p.Scope += " GroupMember.Read.All"
+	}
+}
+
 func getAzureHeader(access_token string) http.Header {
 	header := make(http.Header)
 	header.Set("Authorization", fmt.Sprintf("Bearer %s", access_token))
 	return header
 }
 
+// azureClaims are the id_token claims used from the Microsoft identity platform
+// https://docs.microsoft.com/en-us/azure/active-directory/develop/id-tokens
+type azureClaims struct {
+	Email             string   `json:"email"`
+	PreferredUsername string   `json:"preferred_username"`
+	Groups            []string `json:"groups"`
+	// "hasgroups" or a "groups" entry in "_claim_names" signal group overage:
+	// the user is in too many groups to list in the token
+	HasGroups  bool              `json:"hasgroups"`
+	ClaimNames map[string]string `json:"_claim_names"`
+}
+
+func (c *azureClaims) groupsOverage() bool {
+	_, ok := c.ClaimNames["groups"]
+	return ok || c.HasGroups
+}
+
+func azureClaimsFromIdToken(idToken string) (*azureClaims, error) {
+	// the id_token comes directly from the token endpoint over https,
+	// so the signature does not need to be verified
+	jwt := strings.Split(idToken, ".")
+	if len(jwt) < 2 {
+		return nil, errors.New("malformed id_token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwt[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var claims azureClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (p *AzureProvider) Redeem(ctx context.Context, redirectURL, code string) (*SessionState, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	return p.redeemTokens(ctx, params)
+}
+
+// redeemTokens requests tokens from the token endpoint with the given grant,
+// and builds a session from the response and the id_token claims
+func (p *AzureProvider) redeemTokens(ctx context.Context, params url.Values) (*SessionState, error) {
+	status, body, err := p.postToken(ctx, p.RedeemURL, params)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, newStatusError(status, p.RedeemURL, body)
+	}
+
+	var jsonResponse tokenResponse
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+	if jsonResponse.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+	return p.sessionFromTokens(ctx, &jsonResponse)
+}
+
+// RedeemDeviceCode polls the token endpoint with the device code, and builds
+// a session like Redeem once the user has authorized the device
+func (p *AzureProvider) RedeemDeviceCode(ctx context.Context, deviceCode string) (*SessionState, error) {
+	r, err := p.redeemDeviceCodeResponse(ctx, deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	return p.sessionFromTokens(ctx, r)
+}
+
+// sessionFromTokens builds a session from a token endpoint response and its
+// id_token claims
+func (p *AzureProvider) sessionFromTokens(ctx context.Context, r *tokenResponse) (*SessionState, error) {
+	s := &SessionState{
+		AccessToken:  r.AccessToken,
+		RefreshToken: r.RefreshToken,
+	}
+	if r.ExpiresIn > 0 {
+		s.ExpiresOn = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second).Truncate(time.Second)
+	}
+
+	var claims *azureClaims
+	var err error
+	if r.IdToken != "" {
+		claims, err = azureClaimsFromIdToken(r.IdToken)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id_token: %s", err)
+		}
+		s.Email = claims.Email
+		if s.Email == "" {
+			s.Email = claims.PreferredUsername
+		}
+		s.User = claims.PreferredUsername
+	}
+
+	s.Groups, err = p.sessionGroups(ctx, s.AccessToken, claims)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sessionGroups returns the configured groups the user is a member of, from
+// the id_token claims, or from Microsoft Graph if there are no claims or they
+// are not complete
+func (p *AzureProvider) sessionGroups(ctx context.Context, accessToken string, claims *azureClaims) ([]string, error) {
+	if len(p.Groups) == 0 {
+		return nil, nil
+	}
+
+	var memberOf []string
+	if claims == nil || claims.groupsOverage() {
+		var err error
+		memberOf, err = p.memberOf(ctx, accessToken)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		memberOf = claims.Groups
+	}
+
+	var found []string
+	for _, g := range p.Groups {
+		for _, m := range memberOf {
+			if g == m {
+				found = append(found, g)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// memberOf lists the ids of the groups and directory roles the user is a
+// member of, directly or through nested groups (as in the id_token groups
+// claim), following @odata.nextLink paging
+func (p *AzureProvider) memberOf(ctx context.Context, accessToken string) ([]string, error) {
+	// https://docs.microsoft.com/en-us/graph/api/user-list-transitivememberof
+	endpoint := &url.URL{
+		Scheme:   p.ProfileURL.Scheme,
+		Host:     p.ProfileURL.Host,
+		Path:     path.Join(p.ProfileURL.Path, "transitiveMemberOf"),
+		RawQuery: url.Values{"$select": {"id"}}.Encode(),
+	}
+
+	var ids []string
+	next := endpoint.String()
+	for pn := 1; next != "" && pn <= 50; pn++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = getAzureHeader(accessToken)
+
+		var page struct {
+			Value []struct {
+				ID string `json:"id"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := api.RequestJson(p.httpClient(), req, &page); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Value {
+			ids = append(ids, v.ID)
+		}
+		next = page.NextLink
+	}
+	return ids, nil
+}
+
+// ValidateGroup checks that the session has any of the configured groups
+func (p *AzureProvider) ValidateGroup(ctx context.Context, s *SessionState) bool {
+	if len(p.Groups) == 0 {
+		return true
+	}
+	for _, g := range p.Groups {
+		for _, sg := range s.Groups {
+			if g == sg {
+				return true
+			}
+		}
+	}
+	log.Printf("%s not found in any allowed groups", s.Email)
+	return false
+}
+
+func (p *AzureProvider) ValidateSessionState(ctx context.Context, s *SessionState) error {
+	if err := validateToken(ctx, p, s.AccessToken, getAzureHeader(s.AccessToken)); err != nil {
+		return err
+	}
+	if !p.ValidateGroup(ctx, s) {
+		return fmt.Errorf("%s is no longer in the group(s)", s.Email)
+	}
+	return nil
+}
+
+func (p *AzureProvider) RefreshSessionIfNeeded(ctx context.Context, s *SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+
+	params := url.Values{}
+	params.Add("refresh_token", s.RefreshToken)
+	params.Add("grant_type", "refresh_token")
+	params.Add("scope", p.Scope)
+	newSession, err := p.redeemTokens(ctx, params)
+	if err != nil {
+		return false, err
+	}
+
+	// re-check that the user is in the proper group(s)
+	if !p.ValidateGroup(ctx, newSession) {
+		return false, fmt.Errorf("%s is no longer in the group(s)", s.Email)
+	}
+
+	origExpiration := s.ExpiresOn
+	s.AccessToken = newSession.AccessToken
+	s.ExpiresOn = newSession.ExpiresOn
+	if newSession.RefreshToken != "" {
+		s.RefreshToken = newSession.RefreshToken
+	}
+	s.Groups = newSession.Groups
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
 func getEmailFromJSON(json *simplejson.Json) (string, error) {
 	var email string
 	var err error
@@ -84,20 +339,20 @@ func getEmailFromJSON(json *simplejson.Json) (string, error) {
 	return email, err
 }
 
-func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (p *AzureProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	var email string
 	var err error
 
 	if s.AccessToken == "" {
 		return "", errors.New("missing access token")
 	}
-	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", p.ProfileURL.String(), nil)
 	if err != nil {
 		return "", err
 	}
 	req.Header = getAzureHeader(s.AccessToken)
 
-	json, err := api.Request(req)
+	json, err := api.Request(p.httpClient(), req)
 
 	if err != nil {
 		return "", err
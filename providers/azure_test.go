@@ -1,10 +1,15 @@
 package providers
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,17 +40,17 @@ func TestAzureProviderDefaults(t *testing.T) {
 	p.Configure("")
 	assert.Equal(t, "Azure", p.Data().ProviderName)
 	assert.Equal(t, "common", p.Tenant)
-	assert.Equal(t, "https://login.microsoftonline.com/common/oauth2/authorize",
+	assert.Equal(t, "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
 		p.Data().LoginURL.String())
-	assert.Equal(t, "https://login.microsoftonline.com/common/oauth2/token",
+	assert.Equal(t, "https://login.microsoftonline.com/common/oauth2/v2.0/token",
 		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://graph.windows.net/me?api-version=1.6",
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me",
 		p.Data().ProfileURL.String())
-	assert.Equal(t, "https://graph.windows.net",
-		p.Data().ProtectedResource.String())
 	assert.Equal(t, "",
+		p.Data().ProtectedResource.String())
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me",
 		p.Data().ValidateURL.String())
-	assert.Equal(t, "openid", p.Data().Scope)
+	assert.Equal(t, "openid email profile offline_access User.Read", p.Data().Scope)
 }
 
 func TestAzureProviderOverrides(t *testing.T) {
@@ -91,27 +96,22 @@ func TestAzureSetTenant(t *testing.T) {
 	p.Configure("example")
 	assert.Equal(t, "Azure", p.Data().ProviderName)
 	assert.Equal(t, "example", p.Tenant)
-	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/authorize",
+	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/v2.0/authorize",
 		p.Data().LoginURL.String())
-	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/token",
+	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/v2.0/token",
 		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://graph.windows.net/me?api-version=1.6",
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me",
 		p.Data().ProfileURL.String())
-	assert.Equal(t, "https://graph.windows.net",
-		p.Data().ProtectedResource.String())
-	assert.Equal(t, "",
-		p.Data().ValidateURL.String())
-	assert.Equal(t, "openid", p.Data().Scope)
+	assert.Equal(t, "openid email profile offline_access User.Read", p.Data().Scope)
 }
 
 func testAzureBackend(payload string) *httptest.Server {
-	path := "/me"
-	query := "api-version=1.6"
+	path := "/v1.0/me"
 
 	return httptest.NewServer(http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			url := r.URL
-			if url.Path != path || url.RawQuery != query {
+			if url.Path != path {
 				w.WriteHeader(404)
 			} else if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
 				w.WriteHeader(403)
@@ -130,7 +130,7 @@ func TestAzureProviderGetEmailAddress(t *testing.T) {
 	p := testAzureProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "user@windows.net", email)
 }
@@ -143,7 +143,7 @@ func TestAzureProviderGetEmailAddressMailNull(t *testing.T) {
 	p := testAzureProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "user@windows.net", email)
 }
@@ -156,7 +156,7 @@ func TestAzureProviderGetEmailAddressGetUserPrincipalName(t *testing.T) {
 	p := testAzureProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "user@windows.net", email)
 }
@@ -169,7 +169,7 @@ func TestAzureProviderGetEmailAddressFailToGetEmailAddress(t *testing.T) {
 	p := testAzureProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, "type assertion to string failed", err.Error())
 	assert.Equal(t, "", email)
 }
@@ -182,7 +182,7 @@ func TestAzureProviderGetEmailAddressEmptyUserPrincipalName(t *testing.T) {
 	p := testAzureProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "", email)
 }
@@ -195,7 +195,161 @@ func TestAzureProviderGetEmailAddressIncorrectOtherMails(t *testing.T) {
 	p := testAzureProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, "type assertion to string failed", err.Error())
 	assert.Equal(t, "", email)
 }
+
+func testAzureIdToken(claims map[string]interface{}) string {
+	b, _ := json.Marshal(claims)
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(b) + ".sig"
+}
+
+// testAzureTokenBackend serves the token endpoint at /token, returning the
+// id_token, and Graph /v1.0/me/transitiveMemberOf in two pages. The user is a
+// direct member of group-1 and group-2, and of group-3 through group-2.
+func testAzureTokenBackend(t *testing.T, idToken string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/token":
+				r.ParseForm()
+				if r.Form.Get("grant_type") == "refresh_token" {
+					assert.Equal(t, "imaginary_refresh_token", r.Form.Get("refresh_token"))
+				} else {
+					assert.Equal(t, "imaginary_code", r.Form.Get("code"))
+				}
+				fmt.Fprintf(w, `{"access_token": "imaginary_access_token",
+					"refresh_token": "new_refresh_token", "expires_in": 3600, "id_token": %q}`, idToken)
+			case "/v1.0/me/transitiveMemberOf":
+				if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+					w.WriteHeader(403)
+				} else if r.URL.Query().Get("page") == "" {
+					fmt.Fprintf(w, `{"value": [{"id": "group-1"}],
+						"@odata.nextLink": "%s/v1.0/me/transitiveMemberOf?page=2"}`, server.URL)
+				} else {
+					w.Write([]byte(`{"value": [{"id": "group-2"}, {"id": "group-3"}]}`))
+				}
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	return server
+}
+
+func testAzureRedeemProvider(server *httptest.Server) *AzureProvider {
+	bURL, _ := url.Parse(server.URL)
+	p := testAzureProvider(bURL.Host)
+	p.RedeemURL = &url.URL{Scheme: "http", Host: bURL.Host, Path: "/token"}
+	p.Configure("")
+	return p
+}
+
+func TestAzureProviderRedeemClaims(t *testing.T) {
+	b := testAzureTokenBackend(t, testAzureIdToken(map[string]interface{}{
+		"preferred_username": "user@example.onmicrosoft.com",
+		"email":              "user@example.com",
+		"groups":             []string{"group-1", "group-2"},
+	}))
+	defer b.Close()
+
+	p := testAzureRedeemProvider(b)
+	p.SetGroups([]string{"group-2", "group-3"})
+	s, err := p.Redeem(context.Background(), "http://redirect/", "imaginary_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", s.Email)
+	assert.Equal(t, "user@example.onmicrosoft.com", s.User)
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	assert.Equal(t, "new_refresh_token", s.RefreshToken)
+	assert.Equal(t, []string{"group-2"}, s.Groups)
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), s))
+
+	p.SetGroups([]string{"group-3"})
+	s, err = p.Redeem(context.Background(), "http://redirect/", "imaginary_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), s))
+}
+
+func TestAzureProviderRedeemPreferredUsername(t *testing.T) {
+	b := testAzureTokenBackend(t, testAzureIdToken(map[string]interface{}{
+		"preferred_username": "user@example.onmicrosoft.com",
+	}))
+	defer b.Close()
+
+	p := testAzureRedeemProvider(b)
+	s, err := p.Redeem(context.Background(), "http://redirect/", "imaginary_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.onmicrosoft.com", s.Email)
+	assert.Equal(t, []string(nil), s.Groups)
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), s))
+}
+
+func TestAzureProviderRedeemGroupsOverage(t *testing.T) {
+	b := testAzureTokenBackend(t, testAzureIdToken(map[string]interface{}{
+		"email":        "user@example.com",
+		"_claim_names": map[string]string{"groups": "src1"},
+	}))
+	defer b.Close()
+
+	p := testAzureRedeemProvider(b)
+	p.SetGroups([]string{"group-3"})
+	assert.Equal(t, "openid email profile offline_access User.Read GroupMember.Read.All", p.Scope)
+	s, err := p.Redeem(context.Background(), "http://redirect/", "imaginary_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group-3"}, s.Groups)
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), s))
+}
+
+func TestAzureProviderRedeemNestedGroups(t *testing.T) {
+	b := testAzureTokenBackend(t, testAzureIdToken(map[string]interface{}{
+		"email":        "user@example.com",
+		"_claim_names": map[string]string{"groups": "src1"},
+	}))
+	defer b.Close()
+
+	// group-3 is only a membership through group-2
+	p := testAzureRedeemProvider(b)
+	p.SetGroups([]string{"group-3", "group-4"})
+	s, err := p.Redeem(context.Background(), "http://redirect/", "imaginary_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group-3"}, s.Groups)
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), s))
+
+	p.SetGroups([]string{"group-4"})
+	s, err = p.Redeem(context.Background(), "http://redirect/", "imaginary_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), s))
+}
+
+func TestAzureProviderRefreshSession(t *testing.T) {
+	b := testAzureTokenBackend(t, testAzureIdToken(map[string]interface{}{
+		"email":  "user@example.com",
+		"groups": []string{"group-1"},
+	}))
+	defer b.Close()
+
+	p := testAzureRedeemProvider(b)
+	p.SetGroups([]string{"group-1"})
+	s := &SessionState{
+		Email:        "user@example.com",
+		AccessToken:  "old_access_token",
+		RefreshToken: "imaginary_refresh_token",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+		Groups:       []string{"group-1"},
+	}
+	refreshed, err := p.RefreshSessionIfNeeded(context.Background(), s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	assert.Equal(t, "new_refresh_token", s.RefreshToken)
+	assert.True(t, s.ExpiresOn.After(time.Now()))
+
+	// no longer in the group
+	p.SetGroups([]string{"group-2"})
+	s.RefreshToken = "imaginary_refresh_token"
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(context.Background(), s)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, refreshed)
+}
@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -8,9 +11,20 @@ import (
 	"github.com/ploxiln/oauth2_proxy/api"
 )
 
+// Bitbucket repository permission levels, in increasing order
+var bitbucketPermissions = map[string]int{
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
 type BitbucketProvider struct {
 	*ProviderData
-	Team string
+	Workspace string
+	// Repository is the "workspace/repo_slug" on which the user must have at
+	// least RepositoryPermission
+	Repository           string
+	RepositoryPermission string
 }
 
 func NewBitbucketProvider(p *ProviderData) *BitbucketProvider {
@@ -37,16 +51,151 @@ func NewBitbucketProvider(p *ProviderData) *BitbucketProvider {
 		}
 	}
 	if p.Scope == "" {
-		p.Scope = "account team"
+		p.Scope = "account"
 	}
 	return &BitbucketProvider{ProviderData: p}
 }
 
+// SetTeam is the deprecated name of SetWorkspace: Bitbucket teams became
+// workspaces
 func (p *BitbucketProvider) SetTeam(team string) {
-	p.Team = team
+	p.SetWorkspace(team)
+}
+
+// SetWorkspace restricts logins to members of the workspace (slug)
+func (p *BitbucketProvider) SetWorkspace(workspace string) {
+	p.Workspace = workspace
+}
+
+// SetRepository restricts logins to users with at least the given permission
+// ("read", "write" or "admin") on the repository ("workspace/repo_slug")
+func (p *BitbucketProvider) SetRepository(repository string, permission string) error {
+	if permission == "" {
+		permission = "read"
+	}
+	if _, ok := bitbucketPermissions[permission]; !ok {
+		return fmt.Errorf("invalid bitbucket repository permission %q", permission)
+	}
+	p.Repository = repository
+	p.RepositoryPermission = permission
+	if repository != "" {
+		p.Scope += " repository"
+	}
+	return nil
+}
+
+// apiURL builds the URL for a 2.0 API path on the ValidateURL host
+func (p *BitbucketProvider) apiURL(apiPath string, params url.Values) *url.URL {
+	return &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     apiPath,
+		RawQuery: params.Encode(),
+	}
+}
+
+// getPermissions fetches all pages of a /2.0/user/permissions/ listing,
+// calling add for each page
+func (p *BitbucketProvider) getPermissions(ctx context.Context, accessToken string, endpoint *url.URL, add func(body []byte) error) error {
+	next := endpoint.String()
+	for pn := 1; next != "" && pn <= 10; pn++ {
+		nextURL, err := url.Parse(next)
+		if err != nil {
+			return err
+		}
+		params := nextURL.Query()
+		params.Set("access_token", accessToken)
+		nextURL.RawQuery = params.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", nextURL.String(), nil)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Next string `json:"next"`
+		}
+		var raw json.RawMessage
+		if err := api.RequestJson(p.httpClient(), req, &raw); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return err
+		}
+		if err := add(raw); err != nil {
+			return err
+		}
+		next = page.Next
+	}
+	return nil
+}
+
+// hasWorkspace checks that the user is a member of the workspace
+func (p *BitbucketProvider) hasWorkspace(ctx context.Context, accessToken string) (bool, error) {
+	// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-workspaces/#api-user-permissions-workspaces-get
+	endpoint := p.apiURL("/2.0/user/permissions/workspaces", url.Values{
+		"q": {fmt.Sprintf("workspace.slug=%q", p.Workspace)},
+	})
+	found := false
+	err := p.getPermissions(ctx, accessToken, endpoint, func(body []byte) error {
+		var workspaces struct {
+			Values []struct {
+				Workspace struct {
+					Slug string `json:"slug"`
+				} `json:"workspace"`
+			} `json:"values"`
+		}
+		if err := json.Unmarshal(body, &workspaces); err != nil {
+			return err
+		}
+		for _, w := range workspaces.Values {
+			if w.Workspace.Slug == p.Workspace {
+				found = true
+			}
+		}
+		return nil
+	})
+	return found, err
 }
 
-func (p *BitbucketProvider) GetEmailAddress(s *SessionState) (string, error) {
+// hasRepository checks that the user has at least RepositoryPermission on
+// the repository
+func (p *BitbucketProvider) hasRepository(ctx context.Context, accessToken string) (bool, error) {
+	// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-repositories/#api-user-permissions-repositories-get
+	endpoint := p.apiURL("/2.0/user/permissions/repositories", url.Values{
+		"q": {fmt.Sprintf("repository.full_name=%q", p.Repository)},
+	})
+	permission := ""
+	err := p.getPermissions(ctx, accessToken, endpoint, func(body []byte) error {
+		var repositories struct {
+			Values []struct {
+				Permission string `json:"permission"`
+				Repository struct {
+					FullName string `json:"full_name"`
+				} `json:"repository"`
+			} `json:"values"`
+		}
+		if err := json.Unmarshal(body, &repositories); err != nil {
+			return err
+		}
+		for _, r := range repositories.Values {
+			if r.Repository.FullName == p.Repository {
+				permission = r.Permission
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if bitbucketPermissions[permission] < bitbucketPermissions[p.RepositoryPermission] {
+		log.Printf("repository permission %q on %s is insufficient, %q required",
+			permission, p.Repository, p.RepositoryPermission)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (p *BitbucketProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 
 	var emails struct {
 		Values []struct {
@@ -54,47 +203,39 @@ func (p *BitbucketProvider) GetEmailAddress(s *SessionState) (string, error) {
 			Primary bool   `json:"is_primary"`
 		}
 	}
-	var teams struct {
-		Values []struct {
-			Name string `json:"username"`
-		}
-	}
-	req, err := http.NewRequest("GET",
+	req, err := http.NewRequestWithContext(ctx, "GET",
 		p.ValidateURL.String()+"?access_token="+s.AccessToken, nil)
 	if err != nil {
 		log.Printf("failed building request %s", err)
 		return "", err
 	}
-	err = api.RequestJson(req, &emails)
+	err = api.RequestJson(p.httpClient(), req, &emails)
 	if err != nil {
 		log.Printf("failed making request %s", err)
 		return "", err
 	}
 
-	if p.Team != "" {
-		teamURL := &url.URL{}
-		*teamURL = *p.ValidateURL
-		teamURL.Path = "/2.0/teams"
-		req, err = http.NewRequest("GET",
-			teamURL.String()+"?role=member&access_token="+s.AccessToken, nil)
+	if p.Workspace != "" {
+		ok, err := p.hasWorkspace(ctx, s.AccessToken)
 		if err != nil {
-			log.Printf("failed building request %s", err)
+			log.Printf("failed requesting workspace membership %s", err)
 			return "", err
 		}
-		err = api.RequestJson(req, &teams)
+		if !ok {
+			log.Printf("workspace membership test failed, access denied")
+			return "", nil
+		}
+		s.Groups = []string{p.Workspace}
+	}
+
+	if p.Repository != "" {
+		ok, err := p.hasRepository(ctx, s.AccessToken)
 		if err != nil {
-			log.Printf("failed requesting teams membership %s", err)
+			log.Printf("failed requesting repository permission %s", err)
 			return "", err
 		}
-		var found = false
-		for _, team := range teams.Values {
-			if p.Team == team.Name {
-				found = true
-				break
-			}
-		}
-		if found != true {
-			log.Printf("team membership test failed, access denied")
+		if !ok {
+			log.Printf("repository permission test failed, access denied")
 			return "", nil
 		}
 	}
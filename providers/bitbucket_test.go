@@ -1,10 +1,12 @@
 package providers
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -35,8 +37,8 @@ func testBitbucketProvider(hostname, team string) *BitbucketProvider {
 
 func testBitbucketBackend(payload string) *httptest.Server {
 	paths := map[string]bool{
-		"/2.0/user/emails": true,
-		"/2.0/teams":       true,
+		"/2.0/user/emails":                 true,
+		"/2.0/user/permissions/workspaces": true,
 	}
 
 	return httptest.NewServer(http.HandlerFunc(
@@ -64,7 +66,7 @@ func TestBitbucketProviderDefaults(t *testing.T) {
 		p.Data().RedeemURL.String())
 	assert.Equal(t, "https://api.bitbucket.org/2.0/user/emails",
 		p.Data().ValidateURL.String())
-	assert.Equal(t, "account team", p.Data().Scope)
+	assert.Equal(t, "account", p.Data().Scope)
 }
 
 func TestBitbucketProviderOverrides(t *testing.T) {
@@ -102,22 +104,96 @@ func TestBitbucketProviderGetEmailAddress(t *testing.T) {
 	p := testBitbucketProvider(b_url.Host, "")
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "michael.bland@gsa.gov", email)
 }
 
 func TestBitbucketProviderGetEmailAddressAndGroup(t *testing.T) {
-	b := testBitbucketBackend("{\"values\": [ { \"email\": \"michael.bland@gsa.gov\", \"is_primary\": true, \"username\": \"bioinformatics\" } ] }")
+	b := testBitbucketBackend("{\"values\": [ { \"email\": \"michael.bland@gsa.gov\", \"is_primary\": true, \"workspace\": { \"slug\": \"bioinformatics\" } } ] }")
 	defer b.Close()
 
 	b_url, _ := url.Parse(b.URL)
 	p := testBitbucketProvider(b_url.Host, "bioinformatics")
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"bioinformatics"}, session.Groups)
+}
+
+// testBitbucketPathBackend serves each payload at its path, with the next
+// page of a listing at the path with "?page=2"
+func testBitbucketPathBackend(payloads map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			key := r.URL.Path
+			if page := r.URL.Query().Get("page"); page != "" {
+				key += "?page=" + page
+			}
+			payload, ok := payloads[key]
+			if !ok {
+				w.WriteHeader(404)
+			} else if r.URL.Query().Get("access_token") != "imaginary_access_token" {
+				w.WriteHeader(403)
+			} else {
+				w.WriteHeader(200)
+				w.Write([]byte(strings.Replace(payload, "BACKEND", "http://"+r.Host, -1)))
+			}
+		}))
+}
+
+func TestBitbucketProviderWorkspaceAndRepository(t *testing.T) {
+	b := testBitbucketPathBackend(map[string]string{
+		"/2.0/user/emails": `{"values": [{"email": "michael.bland@gsa.gov", "is_primary": true}]}`,
+		"/2.0/user/permissions/workspaces": `{"values": [{"workspace": {"slug": "other"}}],
+			"next": "BACKEND/2.0/user/permissions/workspaces?page=2"}`,
+		"/2.0/user/permissions/workspaces?page=2": `{"values": [{"workspace": {"slug": "bioinformatics"}}]}`,
+		"/2.0/user/permissions/repositories": `{"values": [
+			{"permission": "write", "repository": {"full_name": "bioinformatics/pipeline"}}]}`,
+	})
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(b_url.Host, "")
+	p.SetWorkspace("bioinformatics")
+	assert.Equal(t, nil, p.SetRepository("bioinformatics/pipeline", "write"))
+	assert.Equal(t, "account repository", p.Data().Scope)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"bioinformatics"}, session.Groups)
+
+	assert.Equal(t, nil, p.SetRepository("bioinformatics/pipeline", "admin"))
+	email, err = p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+
+	assert.Equal(t, nil, p.SetRepository("bioinformatics/other", ""))
+	email, err = p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+
+	assert.NotEqual(t, nil, p.SetRepository("bioinformatics/pipeline", "owner"))
+}
+
+func TestBitbucketProviderNotInWorkspace(t *testing.T) {
+	b := testBitbucketPathBackend(map[string]string{
+		"/2.0/user/emails":                 `{"values": [{"email": "michael.bland@gsa.gov", "is_primary": true}]}`,
+		"/2.0/user/permissions/workspaces": `{"values": []}`,
+	})
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(b_url.Host, "bioinformatics")
+	assert.Equal(t, "bioinformatics", p.Workspace)
+
+	email, err := p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
 }
 
 // Note that trying to trigger the "failed building request" case is not
@@ -133,7 +209,7 @@ func TestBitbucketProviderGetEmailAddressFailedRequest(t *testing.T) {
 	// token. Alternatively, we could allow the parsing of the payload as
 	// JSON to fail.
 	session := &SessionState{AccessToken: "unexpected_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
@@ -146,7 +222,7 @@ func TestBitbucketProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T)
 	p := testBitbucketProvider(b_url.Host, "")
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, "", email)
 	assert.Equal(t, nil, err)
 }
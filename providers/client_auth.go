@@ -0,0 +1,285 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/ploxiln/oauth2_proxy/cookie"
+)
+
+// ClientAuthenticator authenticates the client (oauth2_proxy) in requests to
+// the provider's token endpoint, and other endpoints which require client
+// authentication (e.g. device authorization, introspection and revocation)
+// https://tools.ietf.org/html/rfc6749#section-2.3
+type ClientAuthenticator interface {
+	// AuthenticateClient adds the client's credentials for a request to
+	// endpoint, to the form params or the request header
+	AuthenticateClient(endpoint string, params url.Values, header http.Header) error
+	// HTTPClient returns the client to make the request with, or nil for the
+	// provider's client
+	HTTPClient() *http.Client
+}
+
+// clientSecretPost sends the client_id and client_secret as form params
+type clientSecretPost struct {
+	clientID     string
+	clientSecret string
+}
+
+func NewClientSecretPost(clientID, clientSecret string) ClientAuthenticator {
+	return &clientSecretPost{clientID: clientID, clientSecret: clientSecret}
+}
+
+func (a *clientSecretPost) AuthenticateClient(endpoint string, params url.Values, header http.Header) error {
+	params.Set("client_id", a.clientID)
+	params.Set("client_secret", a.clientSecret)
+	return nil
+}
+
+func (a *clientSecretPost) HTTPClient() *http.Client { return nil }
+
+// clientSecretBasic sends the client_id and client_secret with HTTP Basic auth
+type clientSecretBasic struct {
+	clientID     string
+	clientSecret string
+}
+
+func NewClientSecretBasic(clientID, clientSecret string) ClientAuthenticator {
+	return &clientSecretBasic{clientID: clientID, clientSecret: clientSecret}
+}
+
+func (a *clientSecretBasic) AuthenticateClient(endpoint string, params url.Values, header http.Header) error {
+	// the id and secret are form-urlencoded first (RFC 6749 section 2.3.1)
+	auth := url.QueryEscape(a.clientID) + ":" + url.QueryEscape(a.clientSecret)
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	return nil
+}
+
+func (a *clientSecretBasic) HTTPClient() *http.Client { return nil }
+
+// privateKeyJWT sends a client_assertion JWT, signed with the client's
+// private key, for which the provider has the public key (RFC 7523)
+// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+type privateKeyJWT struct {
+	clientID string
+	signer   jose.Signer
+}
+
+// NewPrivateKeyJWT signs client assertions with the PEM encoded RSA or EC
+// private key. The keyID, if not empty, is set as the "kid" header, for
+// providers which have more than one key registered for the client.
+func NewPrivateKeyJWT(clientID string, keyPEM []byte, keyID string) (ClientAuthenticator, error) {
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	var alg jose.SignatureAlgorithm
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			alg = jose.ES256
+		case elliptic.P384():
+			alg = jose.ES384
+		case elliptic.P521():
+			alg = jose.ES512
+		default:
+			return nil, errors.New("unsupported elliptic curve")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	opts := &jose.SignerOptions{}
+	opts.WithType("JWT")
+	if keyID != "" {
+		opts.WithHeader("kid", keyID)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &privateKeyJWT{clientID: clientID, signer: signer}, nil
+}
+
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unable to parse %s private key", block.Type)
+}
+
+func (a *privateKeyJWT) AuthenticateClient(endpoint string, params url.Values, header http.Header) error {
+	jti, err := cookie.Nonce()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	assertion, err := jwt.Signed(a.signer).Claims(jwt.Claims{
+		Issuer:   a.clientID,
+		Subject:  a.clientID,
+		Audience: jwt.Audience{endpoint},
+		ID:       jti,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(5 * time.Minute)),
+	}).CompactSerialize()
+	if err != nil {
+		return err
+	}
+	params.Set("client_id", a.clientID)
+	params.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	params.Set("client_assertion", assertion)
+	return nil
+}
+
+func (a *privateKeyJWT) HTTPClient() *http.Client { return nil }
+
+// tlsClientAuth authenticates with a client certificate, in the TLS handshake
+// https://tools.ietf.org/html/rfc8705#section-2.1
+type tlsClientAuth struct {
+	clientID string
+	client   *http.Client
+}
+
+// NewTLSClientAuth loads the client certificate and key (PEM files), for a
+// client otherwise configured like the provider's
+func NewTLSClientAuth(clientID, certFile, keyFile string, config HTTPClientConfig) (ClientAuthenticator, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+	client, err := NewHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsClientAuth{clientID: clientID, client: client}, nil
+}
+
+func (a *tlsClientAuth) AuthenticateClient(endpoint string, params url.Values, header http.Header) error {
+	params.Set("client_id", a.clientID)
+	return nil
+}
+
+func (a *tlsClientAuth) HTTPClient() *http.Client { return a.client }
+
+// clientAuth returns the configured ClientAuthenticator, by default
+// client_secret_post
+func (p *ProviderData) clientAuth() ClientAuthenticator {
+	if p.ClientAuth != nil {
+		return p.ClientAuth
+	}
+	return NewClientSecretPost(p.ClientID, p.ClientSecret)
+}
+
+// postToken posts params to endpoint, with client authentication, and returns
+// the status code and body. Error responses are returned for the caller to
+// interpret.
+func (p *ProviderData) postToken(ctx context.Context, endpoint *url.URL, params url.Values) (int, []byte, error) {
+	auth := p.clientAuth()
+	header := make(http.Header)
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// GitHub responds with x-www-form-urlencoded unless asked for json
+	header.Set("Accept", "application/json")
+	if err := auth.AuthenticateClient(endpoint.String(), params, header); err != nil {
+		return 0, nil, fmt.Errorf("client authentication: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header = header
+	client := auth.HTTPClient()
+	if client == nil {
+		client = p.httpClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// tokenResponse is a token endpoint response, which may be an error
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	IdToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// redeemToken requests a token from the token endpoint with the grant in
+// params. Other response fields (e.g. "id_token") are available from the
+// token's Extra().
+func (p *ProviderData) redeemToken(ctx context.Context, params url.Values) (*oauth2.Token, error) {
+	status, body, err := p.postToken(ctx, p.RedeemURL, params)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, newStatusError(status, p.RedeemURL, body)
+	}
+
+	var r tokenResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	if r.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(body, &raw)
+
+	token := &oauth2.Token{
+		AccessToken:  r.AccessToken,
+		TokenType:    r.TokenType,
+		RefreshToken: r.RefreshToken,
+	}
+	if r.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	return token.WithExtra(raw), nil
+}
@@ -0,0 +1,186 @@
+package providers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func testClientAuthProvider(backendURL string, auth ClientAuthenticator) *ProviderData {
+	u, _ := url.Parse(backendURL)
+	return &ProviderData{
+		ClientID:     "client_id",
+		ClientSecret: "client_secret",
+		ClientAuth:   auth,
+		RedeemURL:    &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/token"},
+	}
+}
+
+func testClientAuthBackend(check func(r *http.Request) bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "code1234" || !check(r) {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"error": "invalid_client"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "imaginary_access_token", "token_type": "Bearer",
+			"expires_in": 3600, "id_token": "header.payload.signature"}`))
+	}))
+}
+
+func TestClientSecretPost(t *testing.T) {
+	b := testClientAuthBackend(func(r *http.Request) bool {
+		_, _, basic := r.BasicAuth()
+		return !basic && r.PostForm.Get("client_id") == "client_id" && r.PostForm.Get("client_secret") == "client_secret"
+	})
+	defer b.Close()
+
+	// the default, without a ClientAuth
+	p := testClientAuthProvider(b.URL, nil)
+	token, err := p.redeemToken(context.Background(), url.Values{"code": {"code1234"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "imaginary_access_token", token.AccessToken)
+	assert.Equal(t, "header.payload.signature", token.Extra("id_token"))
+	assert.True(t, token.Expiry.After(time.Now().Add(59*time.Minute)))
+
+	p = testClientAuthProvider(b.URL, NewClientSecretPost("client_id", "wrong_secret"))
+	_, err = p.redeemToken(context.Background(), url.Values{"code": {"code1234"}})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestClientSecretBasic(t *testing.T) {
+	b := testClientAuthBackend(func(r *http.Request) bool {
+		id, secret, ok := r.BasicAuth()
+		return ok && id == "client%2Fid" && secret == "se+cret" && r.PostForm.Get("client_secret") == ""
+	})
+	defer b.Close()
+
+	p := testClientAuthProvider(b.URL, NewClientSecretBasic("client/id", "se cret"))
+	token, err := p.redeemToken(context.Background(), url.Values{"code": {"code1234"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "imaginary_access_token", token.AccessToken)
+}
+
+func TestPrivateKeyJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Equal(t, nil, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	var tokenURL string
+	b := testClientAuthBackend(func(r *http.Request) bool {
+		if r.PostForm.Get("client_secret") != "" ||
+			r.PostForm.Get("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" {
+			return false
+		}
+		assertion, err := jwt.ParseSigned(r.PostForm.Get("client_assertion"))
+		if err != nil || assertion.Headers[0].KeyID != "key1" || assertion.Headers[0].Algorithm != "ES256" {
+			return false
+		}
+		var claims jwt.Claims
+		if err := assertion.Claims(&key.PublicKey, &claims); err != nil {
+			return false
+		}
+		return claims.Validate(jwt.Expected{
+			Issuer:   "client_id",
+			Subject:  "client_id",
+			Audience: jwt.Audience{tokenURL},
+			Time:     time.Now(),
+		}) == nil && claims.ID != ""
+	})
+	defer b.Close()
+
+	auth, err := NewPrivateKeyJWT("client_id", keyPEM, "key1")
+	assert.Equal(t, nil, err)
+	p := testClientAuthProvider(b.URL, auth)
+	tokenURL = p.RedeemURL.String()
+	token, err := p.redeemToken(context.Background(), url.Values{"code": {"code1234"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "imaginary_access_token", token.AccessToken)
+
+	// a signature from another key is rejected
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: otherKey}, nil)
+	p.ClientAuth = &privateKeyJWT{clientID: "client_id", signer: signer}
+	_, err = p.redeemToken(context.Background(), url.Values{"code": {"code1234"}})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPrivateKeyJWTInvalidKey(t *testing.T) {
+	_, err := NewPrivateKeyJWT("client_id", []byte("not a key"), "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client_id"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, nil, err)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	dir, err := ioutil.TempDir("", "client_auth_test")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	b := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if len(r.TLS.PeerCertificates) != 1 || r.TLS.PeerCertificates[0].Subject.CommonName != "client_id" ||
+			r.PostForm.Get("client_id") != "client_id" || r.PostForm.Get("client_secret") != "" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"access_token": "imaginary_access_token"}`))
+	}))
+	b.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	b.StartTLS()
+	defer b.Close()
+
+	// trust the test server's certificate
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b.Certificate().Raw}), 0600)
+	config := HTTPClientConfig{CAFiles: []string{caFile}}
+
+	auth, err := NewTLSClientAuth("client_id", certFile, keyFile, config)
+	assert.Equal(t, nil, err)
+	p := testClientAuthProvider(b.URL, auth)
+	token, err := p.redeemToken(context.Background(), url.Values{"code": {"code1234"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "imaginary_access_token", token.AccessToken)
+
+	// without the client certificate the handshake fails
+	p.HTTPClient, err = NewHTTPClient(config)
+	assert.Equal(t, nil, err)
+	p.ClientAuth = NewClientSecretPost("client_id", "")
+	_, err = p.redeemToken(context.Background(), url.Values{"code": {"code1234"}})
+	assert.NotEqual(t, nil, err)
+}
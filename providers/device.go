@@ -0,0 +1,135 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DeviceAuth is a provider's response to a device authorization request
+// https://tools.ietf.org/html/rfc8628#section-3.2
+type DeviceAuth struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// DeviceAuthError is an error response from the token endpoint while polling
+// with a device code, e.g. "authorization_pending" or "slow_down"
+// https://tools.ietf.org/html/rfc8628#section-3.5
+type DeviceAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *DeviceAuthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	return e.Code
+}
+
+// Pending is true when the user has not yet completed (or denied) the
+// authorization, and the client should poll again later
+func (e *DeviceAuthError) Pending() bool {
+	return e.Code == "authorization_pending" || e.Code == "slow_down"
+}
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// StartDeviceAuth requests a device code and user code from the provider's
+// device authorization endpoint
+func (p *ProviderData) StartDeviceAuth(ctx context.Context) (*DeviceAuth, error) {
+	if p.DeviceAuthURL == nil || p.DeviceAuthURL.String() == "" {
+		return nil, errors.New("device authorization is not configured")
+	}
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("scope", p.Scope)
+	status, body, err := p.postToken(ctx, p.DeviceAuthURL, params)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", status, p.DeviceAuthURL.String(), body)
+	}
+
+	var d struct {
+		DeviceAuth
+		// Microsoft's v2.0 endpoint and some others use "verification_url"
+		VerificationURL string `json:"verification_url"`
+	}
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	if d.DeviceCode == "" || d.UserCode == "" {
+		return nil, fmt.Errorf("no device code found %s", body)
+	}
+	if d.VerificationURI == "" {
+		d.VerificationURI = d.VerificationURL
+	}
+	return &d.DeviceAuth, nil
+}
+
+// redeemDeviceCodeResponse polls the token endpoint with the device code,
+// returning a *DeviceAuthError if the authorization is not (yet) granted
+func (p *ProviderData) redeemDeviceCodeResponse(ctx context.Context, deviceCode string) (*tokenResponse, error) {
+	if deviceCode == "" {
+		return nil, errors.New("missing device code")
+	}
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("device_code", deviceCode)
+	params.Add("grant_type", deviceCodeGrantType)
+	status, body, err := p.postToken(ctx, p.RedeemURL, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var r tokenResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("got %d from %q %s", status, p.RedeemURL.String(), body)
+	}
+	// GitHub reports errors with a 200 status
+	if r.Error != "" {
+		return nil, &DeviceAuthError{Code: r.Error, Description: r.ErrorDescription}
+	}
+	if status != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", status, p.RedeemURL.String(), body)
+	}
+	if r.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+	return &r, nil
+}
+
+// RedeemDeviceCode polls the token endpoint with the device code. Until the
+// user has authorized the device, a *DeviceAuthError is returned.
+func (p *ProviderData) RedeemDeviceCode(ctx context.Context, deviceCode string) (*SessionState, error) {
+	r, err := p.redeemDeviceCodeResponse(ctx, deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	s := &SessionState{
+		AccessToken:  r.AccessToken,
+		RefreshToken: r.RefreshToken,
+	}
+	if r.ExpiresIn > 0 {
+		s.ExpiresOn = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second).Truncate(time.Second)
+	}
+	// the id_token comes directly from the token endpoint, so the email can
+	// be taken from it, if it is present and verified
+	if strings.Contains(r.IdToken, ".") {
+		if email, err := emailFromIdToken(r.IdToken); err == nil {
+			s.Email = email
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,89 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDeviceProvider(backendURL string) *ProviderData {
+	u, _ := url.Parse(backendURL)
+	return &ProviderData{
+		ClientID:      "client_id",
+		ClientSecret:  "client_secret",
+		RedeemURL:     &url.URL{Scheme: "http", Host: u.Host, Path: "/token"},
+		DeviceAuthURL: &url.URL{Scheme: "http", Host: u.Host, Path: "/device"},
+		Scope:         "openid email",
+	}
+}
+
+func TestProviderDataStartDeviceAuth(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/device" || r.Form.Get("client_id") != "client_id" || r.Form.Get("scope") != "openid email" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte(`{"device_code": "imaginary_device_code", "user_code": "WDJB-MJHT",
+			"verification_url": "https://example.com/device", "expires_in": 900}`))
+	}))
+	defer b.Close()
+
+	p := testDeviceProvider(b.URL)
+	d, err := p.StartDeviceAuth(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &DeviceAuth{
+		DeviceCode:      "imaginary_device_code",
+		UserCode:        "WDJB-MJHT",
+		VerificationURI: "https://example.com/device",
+		ExpiresIn:       900,
+	}, d)
+
+	p.DeviceAuthURL = &url.URL{}
+	_, err = p.StartDeviceAuth(context.Background())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestProviderDataRedeemDeviceCode(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "unsupported_grant_type"}`))
+			return
+		}
+		switch r.Form.Get("device_code") {
+		case "imaginary_device_code":
+			w.Write([]byte(`{"access_token": "imaginary_access_token", "refresh_token": "imaginary_refresh_token",
+				"expires_in": 3600, "id_token": "` + testAzureIdToken(map[string]interface{}{"email": "michael.bland@gsa.gov", "email_verified": true}) + `"}`))
+		case "pending_device_code":
+			// GitHub reports errors with a 200 status
+			w.Write([]byte(`{"error": "authorization_pending", "error_description": "The authorization request is still pending."}`))
+		default:
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "expired_token"}`))
+		}
+	}))
+	defer b.Close()
+
+	p := testDeviceProvider(b.URL)
+	s, err := p.RedeemDeviceCode(context.Background(), "imaginary_device_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	assert.Equal(t, "imaginary_refresh_token", s.RefreshToken)
+	assert.Equal(t, "michael.bland@gsa.gov", s.Email)
+	assert.Equal(t, false, s.ExpiresOn.IsZero())
+
+	_, err = p.RedeemDeviceCode(context.Background(), "pending_device_code")
+	assert.Equal(t, &DeviceAuthError{Code: "authorization_pending",
+		Description: "The authorization request is still pending."}, err)
+	assert.Equal(t, true, err.(*DeviceAuthError).Pending())
+
+	_, err = p.RedeemDeviceCode(context.Background(), "old_device_code")
+	assert.Equal(t, &DeviceAuthError{Code: "expired_token"}, err)
+	assert.Equal(t, false, err.(*DeviceAuthError).Pending())
+}
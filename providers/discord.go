@@ -1,16 +1,26 @@
 package providers
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"path"
+	"time"
 
 	"github.com/ploxiln/oauth2_proxy/api"
 )
 
 type DiscordProvider struct {
 	*ProviderData
+	// Guilds are ids of guilds (servers), any of which the user must be in
+	Guilds []string
+	// Roles are ids of roles, any of which the user must have in one of Guilds
+	Roles []string
 }
 
 type DiscordUserInfo struct {
@@ -62,18 +72,18 @@ func getDiscordHeader(access_token string) http.Header {
 	return header
 }
 
-func getUserInfo(p *DiscordProvider, s *SessionState) (DiscordUserInfo, error) {
+func getUserInfo(ctx context.Context, p *DiscordProvider, s *SessionState) (DiscordUserInfo, error) {
 	var r DiscordUserInfo
 	if s.AccessToken == "" {
 		return r, errors.New("missing access token")
 	}
-	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", p.ProfileURL.String(), nil)
 	if err != nil {
 		return r, err
 	}
 	req.Header = getDiscordHeader(s.AccessToken)
 
-	err = api.RequestJson(req, &r)
+	err = api.RequestJson(p.httpClient(), req, &r)
 	if err != nil {
 		return r, err
 	}
@@ -84,8 +94,8 @@ func getUserInfo(p *DiscordProvider, s *SessionState) (DiscordUserInfo, error) {
 // authenticated user, as this is NOT STABLE and can be changed at any
 // time! Instead, the user id which is guratanteed to be stable by
 // Discord is provided.
-func (p *DiscordProvider) GetUserName(s *SessionState) (string, error) {
-	r, err := getUserInfo(p, s)
+func (p *DiscordProvider) GetUserName(ctx context.Context, s *SessionState) (string, error) {
+	r, err := getUserInfo(ctx, p, s)
 	if err != nil {
 		return "", err
 	}
@@ -95,8 +105,8 @@ func (p *DiscordProvider) GetUserName(s *SessionState) (string, error) {
 	return r.Id, nil
 }
 
-func (p *DiscordProvider) GetEmailAddress(s *SessionState) (string, error) {
-	r, err := getUserInfo(p, s)
+func (p *DiscordProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
+	r, err := getUserInfo(ctx, p, s)
 	if err != nil {
 		return "", err
 	}
@@ -106,6 +116,243 @@ func (p *DiscordProvider) GetEmailAddress(s *SessionState) (string, error) {
 	return r.Email, nil
 }
 
-func (p *DiscordProvider) ValidateSessionState(s *SessionState) bool {
-	return validateToken(p, s.AccessToken, getDiscordHeader(s.AccessToken))
+// SetGuildsRoles restricts logins to members of any of the guilds, and if
+// roles are given, to those with any of the roles in those guilds
+func (p *DiscordProvider) SetGuildsRoles(guilds []string, roles []string) {
+	p.Guilds = guilds
+	p.Roles = roles
+	if len(roles) > 0 {
+		p.Scope += " guilds.members.read"
+	} else if len(guilds) > 0 {
+		p.Scope += " guilds"
+	}
+}
+
+// apiURL builds the URL for a path relative to the current user's profile
+// endpoint, e.g. "guilds" for /api/users/@me/guilds
+func (p *DiscordProvider) apiURL(apiPath string, params url.Values) *url.URL {
+	return &url.URL{
+		Scheme:   p.ProfileURL.Scheme,
+		Host:     p.ProfileURL.Host,
+		Path:     path.Join(p.ProfileURL.Path, apiPath),
+		RawQuery: params.Encode(),
+	}
+}
+
+// userGuilds returns the configured guilds the user is a member of
+func (p *DiscordProvider) userGuilds(ctx context.Context, accessToken string) ([]string, error) {
+	// https://discord.com/developers/docs/resources/user#get-current-user-guilds
+	var found []string
+	after := ""
+	for pn := 1; pn <= 10; pn++ {
+		params := url.Values{"limit": {"200"}}
+		if after != "" {
+			params.Set("after", after)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", p.apiURL("guilds", params).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = getDiscordHeader(accessToken)
+
+		var guilds []struct {
+			Id string `json:"id"`
+		}
+		if err := api.RequestJson(p.httpClient(), req, &guilds); err != nil {
+			return nil, err
+		}
+		for _, guild := range guilds {
+			for _, g := range p.Guilds {
+				if g == guild.Id {
+					found = append(found, g)
+				}
+			}
+		}
+		if len(guilds) < 200 {
+			break
+		}
+		after = guilds[len(guilds)-1].Id
+	}
+	return found, nil
+}
+
+// guildMemberRoles returns the roles of the user in the guild, and whether the
+// user is a member of it at all
+func (p *DiscordProvider) guildMemberRoles(ctx context.Context, accessToken string, guild string) ([]string, bool, error) {
+	// https://discord.com/developers/docs/resources/user#get-current-user-guild-member
+	endpoint := p.apiURL(path.Join("guilds", guild, "member"), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header = getDiscordHeader(accessToken)
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode == 403 || resp.StatusCode == 404 {
+		return nil, false, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, false, fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+
+	var member struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.Unmarshal(body, &member); err != nil {
+		return nil, false, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	return member.Roles, true, nil
+}
+
+// userGuildRoles returns the configured roles the user has in any of the
+// configured guilds
+func (p *DiscordProvider) userGuildRoles(ctx context.Context, accessToken string) ([]string, error) {
+	var found []string
+	for _, guild := range p.Guilds {
+		roles, isMember, err := p.guildMemberRoles(ctx, accessToken, guild)
+		if err != nil {
+			return nil, err
+		}
+		if !isMember {
+			continue
+		}
+		for _, role := range roles {
+			for _, r := range p.Roles {
+				if r == role {
+					found = append(found, r)
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+// ValidateGroup checks that the user is in any of the configured guilds, and
+// has any of the configured roles. The matching guilds or roles are recorded
+// in the session.
+func (p *DiscordProvider) ValidateGroup(ctx context.Context, s *SessionState) bool {
+	ok, err := p.validateGroup(ctx, s)
+	if err != nil {
+		log.Printf("error checking Discord guilds for %s: %s", s.Email, err)
+	}
+	return ok
+}
+
+// validateGroup is ValidateGroup, but returns the error if the guilds or
+// roles could not be looked up, so that an outage is not taken for a removed
+// member
+func (p *DiscordProvider) validateGroup(ctx context.Context, s *SessionState) (bool, error) {
+	if len(p.Guilds) == 0 {
+		return true, nil
+	}
+
+	var found []string
+	var err error
+	if len(p.Roles) > 0 {
+		found, err = p.userGuildRoles(ctx, s.AccessToken)
+	} else {
+		found, err = p.userGuilds(ctx, s.AccessToken)
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(found) == 0 {
+		log.Printf("%s not found in any allowed guilds or roles", s.Email)
+		return false, nil
+	}
+	s.Groups = found
+	return true, nil
+}
+
+func (p *DiscordProvider) ValidateSessionState(ctx context.Context, s *SessionState) error {
+	if err := validateToken(ctx, p, s.AccessToken, getDiscordHeader(s.AccessToken)); err != nil {
+		return err
+	}
+	if ok, err := p.validateGroup(ctx, s); err != nil {
+		return fmt.Errorf("checking the guild(s) or role(s) of %s: %w", s.Email, err)
+	} else if !ok {
+		return fmt.Errorf("%s is no longer in the guild(s) or role(s)", s.Email)
+	}
+	return nil
+}
+
+func (p *DiscordProvider) Redeem(ctx context.Context, redirectURL, code string) (*SessionState, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	return p.redeemTokens(ctx, params)
+}
+
+func (p *DiscordProvider) redeemTokens(ctx context.Context, params url.Values) (*SessionState, error) {
+	// https://discord.com/developers/docs/topics/oauth2#authorization-code-grant
+	status, body, err := p.postToken(ctx, p.RedeemURL, params)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, newStatusError(status, p.RedeemURL, body)
+	}
+
+	var jsonResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+	if jsonResponse.AccessToken == "" {
+		return nil, errors.New("no access token found")
+	}
+	s := &SessionState{
+		AccessToken:  jsonResponse.AccessToken,
+		RefreshToken: jsonResponse.RefreshToken,
+	}
+	if jsonResponse.ExpiresIn > 0 {
+		s.ExpiresOn = time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second)
+	}
+	return s, nil
+}
+
+func (p *DiscordProvider) RefreshSessionIfNeeded(ctx context.Context, s *SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+
+	params := url.Values{}
+	params.Add("refresh_token", s.RefreshToken)
+	params.Add("grant_type", "refresh_token")
+	newSession, err := p.redeemTokens(ctx, params)
+	if err != nil {
+		return false, err
+	}
+	newSession.Email = s.Email
+
+	// re-check that the user is in the proper guild(s) and role(s)
+	if ok, err := p.validateGroup(ctx, newSession); err != nil {
+		return false, fmt.Errorf("checking the guild(s) or role(s) of %s: %w", s.Email, err)
+	} else if !ok {
+		return false, fmt.Errorf("%s is no longer in the guild(s) or role(s)", s.Email)
+	}
+
+	origExpiration := s.ExpiresOn
+	s.AccessToken = newSession.AccessToken
+	if newSession.RefreshToken != "" {
+		s.RefreshToken = newSession.RefreshToken
+	}
+	s.ExpiresOn = newSession.ExpiresOn
+	s.Groups = newSession.Groups
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
 }
@@ -0,0 +1,191 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDiscordProvider(hostname string) *DiscordProvider {
+	p := NewDiscordProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testDiscordBackend serves each payload at its path, for the access token
+// "imaginary_access_token", and the token endpoint
+func testDiscordBackend(payloads map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/oauth2/token" {
+				r.ParseForm()
+				if r.Form.Get("refresh_token") != "imaginary_refresh_token" {
+					w.WriteHeader(400)
+					return
+				}
+				w.Write([]byte(`{"access_token": "imaginary_access_token",
+					"refresh_token": "new_refresh_token", "expires_in": 604800}`))
+				return
+			}
+			payload, ok := payloads[r.URL.Path]
+			if !ok {
+				w.WriteHeader(404)
+			} else if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+			} else {
+				w.WriteHeader(200)
+				w.Write([]byte(payload))
+			}
+		}))
+}
+
+func TestDiscordProviderDefaults(t *testing.T) {
+	p := testDiscordProvider("")
+	assert.Equal(t, "Discord", p.Data().ProviderName)
+	assert.Equal(t, "https://discordapp.com/api/oauth2/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://discordapp.com/api/oauth2/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://discordapp.com/api/users/@me",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "identify email connections", p.Data().Scope)
+
+	p.SetGuildsRoles([]string{"1234"}, nil)
+	assert.Equal(t, "identify email connections guilds", p.Data().Scope)
+	p = testDiscordProvider("")
+	p.SetGuildsRoles([]string{"1234"}, []string{"5678"})
+	assert.Equal(t, "identify email connections guilds.members.read", p.Data().Scope)
+}
+
+func TestDiscordProviderGetEmailAddress(t *testing.T) {
+	b := testDiscordBackend(map[string]string{
+		"/api/users/@me": `{"id": "80351110224678912", "email": "nelly@discordapp.com", "verified": true}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testDiscordProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "nelly@discordapp.com", email)
+	user, err := p.GetUserName(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "80351110224678912", user)
+}
+
+func TestDiscordProviderValidateGuilds(t *testing.T) {
+	b := testDiscordBackend(map[string]string{
+		"/api/users/@me/guilds": `[{"id": "1001"}, {"id": "1002"}]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testDiscordProvider(bURL.Host)
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), &SessionState{AccessToken: "imaginary_access_token"}))
+
+	p.SetGuildsRoles([]string{"1002", "1003"}, nil)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), session))
+	assert.Equal(t, []string{"1002"}, session.Groups)
+
+	p.SetGuildsRoles([]string{"1003"}, nil)
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), &SessionState{AccessToken: "imaginary_access_token"}))
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), &SessionState{AccessToken: "unexpected_access_token"}))
+}
+
+func TestDiscordProviderValidateRoles(t *testing.T) {
+	b := testDiscordBackend(map[string]string{
+		"/api/users/@me/guilds/1001/member": `{"roles": ["2001", "2002"]}`,
+		"/api/users/@me/guilds/1002/member": `{"roles": ["2003"]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testDiscordProvider(bURL.Host)
+
+	p.SetGuildsRoles([]string{"1003", "1002"}, []string{"2003", "2004"})
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), session))
+	assert.Equal(t, []string{"2003"}, session.Groups)
+
+	// roles in other guilds do not count
+	p.SetGuildsRoles([]string{"1002"}, []string{"2001"})
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), &SessionState{AccessToken: "imaginary_access_token"}))
+}
+
+func TestDiscordProviderRefreshSession(t *testing.T) {
+	b := testDiscordBackend(map[string]string{
+		"/api/users/@me/guilds": `[{"id": "1001"}]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testDiscordProvider(bURL.Host)
+	p.SetGuildsRoles([]string{"1001"}, nil)
+
+	session := &SessionState{
+		Email:        "nelly@discordapp.com",
+		AccessToken:  "old_access_token",
+		RefreshToken: "imaginary_refresh_token",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	}
+	refreshed, err := p.RefreshSessionIfNeeded(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "imaginary_access_token", session.AccessToken)
+	assert.Equal(t, "new_refresh_token", session.RefreshToken)
+	assert.Equal(t, []string{"1001"}, session.Groups)
+
+	// no longer in the guild
+	p.SetGuildsRoles([]string{"1002"}, nil)
+	session.RefreshToken = "imaginary_refresh_token"
+	session.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(context.Background(), session)
+	assert.Equal(t, fmt.Errorf("nelly@discordapp.com is no longer in the guild(s) or role(s)"), err)
+	assert.Equal(t, false, refreshed)
+}
+
+func TestDiscordProviderValidateSessionStateGuildsUnavailable(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/users/@me":
+			w.Write([]byte(`{"id": "80351110224678912"}`))
+		case "/api/users/@me/guilds":
+			w.WriteHeader(503)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testDiscordProvider(bURL.Host)
+	p.ValidateURL.Path = "/api/users/@me"
+	p.SetGuildsRoles([]string{"1001"}, nil)
+
+	// a failing guilds lookup is not taken for a removed member
+	err := p.ValidateSessionState(context.Background(), &SessionState{Email: "nelly@discordapp.com", AccessToken: "imaginary_access_token"})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, IsUnavailable(err))
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), &SessionState{AccessToken: "imaginary_access_token"}))
+}
@@ -1,16 +1,43 @@
 package providers
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/ploxiln/oauth2_proxy/api"
 )
 
+// facebookGraphVersion is the default Graph API version
+// https://developers.facebook.com/docs/graph-api/changelog
+const facebookGraphVersion = "v19.0"
+
+// facebookRefreshBefore is how long before a long-lived token expires that it
+// is exchanged for a new one
+const facebookRefreshBefore = time.Duration(7*24) * time.Hour
+
+// facebookExchangeInterval is how often a token is exchanged, as Facebook
+// extends a token at most once a day
+const facebookExchangeInterval = time.Duration(24) * time.Hour
+
+var facebookVersionPath = regexp.MustCompile(`^/v[0-9]+\.[0-9]+/`)
+
 type FacebookProvider struct {
 	*ProviderData
+
+	mu sync.Mutex
+	// exchanged is when each token (by hash) was last exchanged
+	exchanged map[string]time.Time
 }
 
 func NewFacebookProvider(p *ProviderData) *FacebookProvider {
@@ -18,20 +45,20 @@ func NewFacebookProvider(p *ProviderData) *FacebookProvider {
 	if p.LoginURL.String() == "" {
 		p.LoginURL = &url.URL{Scheme: "https",
 			Host: "www.facebook.com",
-			Path: "/v2.5/dialog/oauth",
+			Path: "/" + facebookGraphVersion + "/dialog/oauth",
 			// ?granted_scopes=true
 		}
 	}
 	if p.RedeemURL.String() == "" {
 		p.RedeemURL = &url.URL{Scheme: "https",
 			Host: "graph.facebook.com",
-			Path: "/v2.5/oauth/access_token",
+			Path: "/" + facebookGraphVersion + "/oauth/access_token",
 		}
 	}
 	if p.ProfileURL.String() == "" {
 		p.ProfileURL = &url.URL{Scheme: "https",
 			Host: "graph.facebook.com",
-			Path: "/v2.5/me",
+			Path: "/" + facebookGraphVersion + "/me",
 		}
 	}
 	if p.ValidateURL.String() == "" {
@@ -43,6 +70,20 @@ func NewFacebookProvider(p *ProviderData) *FacebookProvider {
 	return &FacebookProvider{ProviderData: p}
 }
 
+// SetGraphVersion sets the Graph API version (e.g. "v19.0") of the default
+// facebook.com urls. Urls which were configured explicitly are not changed.
+func (p *FacebookProvider) SetGraphVersion(version string) {
+	if version == "" {
+		return
+	}
+	for _, u := range []*url.URL{p.LoginURL, p.RedeemURL, p.ProfileURL, p.ValidateURL} {
+		if u.Host != "www.facebook.com" && u.Host != "graph.facebook.com" {
+			continue
+		}
+		u.Path = facebookVersionPath.ReplaceAllLiteralString(u.Path, "/"+version+"/")
+	}
+}
+
 func getFacebookHeader(access_token string) http.Header {
 	header := make(http.Header)
 	header.Set("Accept", "application/json")
@@ -51,11 +92,132 @@ func getFacebookHeader(access_token string) http.Header {
 	return header
 }
 
-func (p *FacebookProvider) GetEmailAddress(s *SessionState) (string, error) {
+// appSecretProof signs the access token with the app secret, which Graph API
+// calls must include when the app has "Require App Secret" enabled
+// https://developers.facebook.com/docs/graph-api/securing-requests#appsecret_proof
+func (p *FacebookProvider) appSecretProof(accessToken string) string {
+	mac := hmac.New(sha256.New, []byte(p.ClientSecret))
+	mac.Write([]byte(accessToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// graphURL returns endpoint with the params and the appsecret_proof added
+func (p *FacebookProvider) graphURL(endpoint *url.URL, accessToken string, params url.Values) string {
+	u := *endpoint
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	q.Set("appsecret_proof", p.appSecretProof(accessToken))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (p *FacebookProvider) Redeem(ctx context.Context, redirectURL, code string) (*SessionState, error) {
+	s, err := p.ProviderData.Redeem(ctx, redirectURL, code)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.exchangeToken(ctx, s); err != nil {
+		return nil, fmt.Errorf("unable to get long-lived token: %s", err)
+	}
+	return s, nil
+}
+
+// exchangeToken exchanges the session's access token for a long-lived one,
+// with the configured client authentication
+// https://developers.facebook.com/docs/facebook-login/guides/access-tokens/get-long-lived
+func (p *FacebookProvider) exchangeToken(ctx context.Context, s *SessionState) error {
+	params := url.Values{
+		"grant_type":        {"fb_exchange_token"},
+		"client_id":         {p.ClientID},
+		"fb_exchange_token": {s.AccessToken},
+	}
+	status, body, err := p.postToken(ctx, p.RedeemURL, params)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return newStatusError(status, p.RedeemURL, body)
+	}
+
+	var r struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return err
+	}
+	if r.AccessToken == "" {
+		return errors.New("no access token")
+	}
+	s.AccessToken = r.AccessToken
+	if r.ExpiresIn > 0 {
+		s.ExpiresOn = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second).Truncate(time.Second)
+	}
+	return nil
+}
+
+// RefreshSessionIfNeeded exchanges a long-lived token which will expire soon
+// for a new one. Facebook has no refresh tokens, and an expired token can not
+// be exchanged, so the user must then log in again.
+func (p *FacebookProvider) RefreshSessionIfNeeded(ctx context.Context, s *SessionState) (bool, error) {
+	if s == nil || s.AccessToken == "" || s.ExpiresOn.IsZero() {
+		return false, nil
+	}
+	now := time.Now()
+	if s.ExpiresOn.Before(now) || s.ExpiresOn.After(now.Add(facebookRefreshBefore)) {
+		return false, nil
+	}
+
+	if !p.startExchange(s.AccessToken, now) {
+		return false, nil
+	}
+
+	origExpiration := s.ExpiresOn
+	newSession := &SessionState{AccessToken: s.AccessToken}
+	if err := p.exchangeToken(ctx, newSession); err != nil {
+		return false, fmt.Errorf("unable to exchange token: %w", err)
+	}
+	if !newSession.ExpiresOn.After(origExpiration) {
+		// not extended (Facebook extends a token at most once a day)
+		return false, nil
+	}
+	s.AccessToken = newSession.AccessToken
+	s.ExpiresOn = newSession.ExpiresOn
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
+// startExchange records an attempt to exchange the token, returning false if
+// it was already attempted in the last facebookExchangeInterval
+func (p *FacebookProvider) startExchange(accessToken string, now time.Time) bool {
+	sum := sha256.Sum256([]byte(accessToken))
+	key := hex.EncodeToString(sum[:])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, t := range p.exchanged {
+		if now.Sub(t) >= facebookExchangeInterval {
+			delete(p.exchanged, k)
+		}
+	}
+	if _, ok := p.exchanged[key]; ok {
+		return false
+	}
+	if p.exchanged == nil {
+		p.exchanged = make(map[string]time.Time)
+	}
+	p.exchanged[key] = now
+	return true
+}
+
+func (p *FacebookProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	if s.AccessToken == "" {
 		return "", errors.New("missing access token")
 	}
-	req, err := http.NewRequest("GET", p.ProfileURL.String()+"?fields=name,email", nil)
+	endpoint := p.graphURL(p.ProfileURL, s.AccessToken, url.Values{"fields": {"name,email"}})
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return "", err
 	}
@@ -65,7 +227,7 @@ func (p *FacebookProvider) GetEmailAddress(s *SessionState) (string, error) {
 		Email string
 	}
 	var r result
-	err = api.RequestJson(req, &r)
+	err = api.RequestJson(p.httpClient(), req, &r)
 	if err != nil {
 		return "", err
 	}
@@ -75,6 +237,10 @@ func (p *FacebookProvider) GetEmailAddress(s *SessionState) (string, error) {
 	return r.Email, nil
 }
 
-func (p *FacebookProvider) ValidateSessionState(s *SessionState) bool {
-	return validateToken(p, s.AccessToken, getFacebookHeader(s.AccessToken))
+func (p *FacebookProvider) ValidateSessionState(ctx context.Context, s *SessionState) error {
+	if s.AccessToken == "" {
+		return errors.New("no access token")
+	}
+	endpoint := p.graphURL(p.ValidateURL, s.AccessToken, nil)
+	return validateTokenURL(ctx, p.httpClient(), endpoint, s.AccessToken, getFacebookHeader(s.AccessToken))
 }
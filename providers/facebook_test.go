@@ -0,0 +1,197 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFacebookProvider(hostname string) *FacebookProvider {
+	p := NewFacebookProvider(
+		&ProviderData{
+			ProviderName: "",
+			ClientID:     "imaginary_client_id",
+			ClientSecret: "imaginary_client_secret",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+	}
+	return p
+}
+
+// testFacebookBackend serves the token endpoint, exchanging "short_token" or
+// "long_token" for "long_token", and the profile, which requires the
+// appsecret_proof of the access token
+func testFacebookBackend(t *testing.T, p *FacebookProvider, payload string) *httptest.Server {
+	proof := p.appSecretProof("long_token")
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			switch r.URL.Path {
+			case "/v19.0/oauth/access_token":
+				if r.Form.Get("grant_type") == "authorization_code" && r.Form.Get("code") == "imaginary_code" {
+					w.Write([]byte(`{"access_token": "short_token", "token_type": "bearer", "expires_in": 3600}`))
+				} else if r.Form.Get("grant_type") == "fb_exchange_token" && r.Method == "POST" &&
+					testFacebookClientSecret(r) == "imaginary_client_secret" &&
+					(r.Form.Get("fb_exchange_token") == "short_token" || r.Form.Get("fb_exchange_token") == "long_token") {
+					w.Write([]byte(`{"access_token": "long_token", "token_type": "bearer", "expires_in": 5183944}`))
+				} else {
+					w.WriteHeader(400)
+				}
+			case "/v19.0/me":
+				if r.Header.Get("Authorization") != "Bearer long_token" {
+					w.WriteHeader(401)
+				} else if r.Form.Get("appsecret_proof") != proof {
+					w.WriteHeader(400)
+					w.Write([]byte(`{"error": {"message": "Invalid appsecret_proof provided in the API argument"}}`))
+				} else {
+					w.Write([]byte(payload))
+				}
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+// testFacebookClientSecret returns the client secret from the form or Basic auth
+func testFacebookClientSecret(r *http.Request) string {
+	if _, secret, ok := r.BasicAuth(); ok {
+		return secret
+	}
+	return r.Form.Get("client_secret")
+}
+
+func TestFacebookProviderDefaults(t *testing.T) {
+	p := testFacebookProvider("")
+	assert.Equal(t, "Facebook", p.Data().ProviderName)
+	assert.Equal(t, "https://www.facebook.com/v19.0/dialog/oauth",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://graph.facebook.com/v19.0/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://graph.facebook.com/v19.0/me",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://graph.facebook.com/v19.0/me",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "public_profile email", p.Data().Scope)
+
+	p.SetGraphVersion("v21.0")
+	assert.Equal(t, "https://www.facebook.com/v21.0/dialog/oauth",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://graph.facebook.com/v21.0/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://graph.facebook.com/v21.0/me",
+		p.Data().ValidateURL.String())
+}
+
+func TestFacebookProviderAppSecretProof(t *testing.T) {
+	p := testFacebookProvider("")
+	p.ClientSecret = "secret"
+	// echo -n token | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "e941110e3d2bfe82621f0e3e1434730d7305d106c5f68c87165d0b27a4611a4a",
+		p.appSecretProof("token"))
+}
+
+func TestFacebookProviderRedeem(t *testing.T) {
+	p := testFacebookProvider("")
+	b := testFacebookBackend(t, p, `{"name": "Mark", "email": "mark@example.com"}`)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	updateURL(p.Data().RedeemURL, bURL.Host)
+	updateURL(p.Data().ProfileURL, bURL.Host)
+
+	session, err := p.Redeem(context.Background(), "https://example.com/oauth2/callback", "imaginary_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "long_token", session.AccessToken)
+	assert.Equal(t, true, session.ExpiresOn.After(time.Now().Add(59*24*time.Hour)))
+
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mark@example.com", email)
+	assert.Equal(t, nil, p.ValidateSessionState(context.Background(), session))
+
+	// the appsecret_proof is signed with the app secret
+	p.ClientSecret = "other_client_secret"
+	_, err = p.GetEmailAddress(context.Background(), session)
+	assert.NotEqual(t, nil, err)
+	assert.NotEqual(t, nil, p.ValidateSessionState(context.Background(), session))
+}
+
+func TestFacebookProviderRefreshSession(t *testing.T) {
+	p := testFacebookProvider("")
+	b := testFacebookBackend(t, p, `{}`)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	updateURL(p.Data().RedeemURL, bURL.Host)
+
+	// not expiring soon
+	expiresOn := time.Now().Add(30 * 24 * time.Hour)
+	session := &SessionState{AccessToken: "long_token", ExpiresOn: expiresOn}
+	refreshed, err := p.RefreshSessionIfNeeded(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+
+	session.ExpiresOn = time.Now().Add(24 * time.Hour)
+	refreshed, err = p.RefreshSessionIfNeeded(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "long_token", session.AccessToken)
+	assert.Equal(t, true, session.ExpiresOn.After(time.Now().Add(59*24*time.Hour)))
+
+	// the token is not exchanged again until a day has passed
+	session.ExpiresOn = time.Now().Add(24 * time.Hour)
+	b.Close()
+	refreshed, err = p.RefreshSessionIfNeeded(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	b = testFacebookBackend(t, p, `{}`)
+	defer b.Close()
+	bURL, _ = url.Parse(b.URL)
+	updateURL(p.Data().RedeemURL, bURL.Host)
+	for k := range p.exchanged {
+		p.exchanged[k] = time.Now().Add(-25 * time.Hour)
+	}
+	refreshed, err = p.RefreshSessionIfNeeded(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+
+	// an expired token can not be exchanged
+	session.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+
+	session = &SessionState{AccessToken: "revoked_token", ExpiresOn: time.Now().Add(time.Hour)}
+	refreshed, err = p.RefreshSessionIfNeeded(context.Background(), session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, refreshed)
+}
+
+func TestFacebookProviderExchangeClientAuth(t *testing.T) {
+	p := testFacebookProvider("")
+	b := testFacebookBackend(t, p, `{}`)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	updateURL(p.Data().RedeemURL, bURL.Host)
+
+	p.ClientAuth = NewClientSecretBasic(p.ClientID, p.ClientSecret)
+	session := &SessionState{AccessToken: "short_token"}
+	assert.Equal(t, nil, p.exchangeToken(context.Background(), session))
+	assert.Equal(t, "long_token", session.AccessToken)
+
+	p.ClientAuth = NewClientSecretBasic(p.ClientID, "other_client_secret")
+	assert.NotEqual(t, nil, p.exchangeToken(context.Background(), session))
+}
@@ -0,0 +1,263 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// GiteaProvider supports Gitea and Forgejo, which share an API
+type GiteaProvider struct {
+	*ProviderData
+	Orgs  []string
+	Teams []string
+}
+
+func NewGiteaProvider(p *ProviderData) *GiteaProvider {
+	p.ProviderName = "Gitea"
+	giteaProvider := &GiteaProvider{ProviderData: p}
+	giteaProvider.SetBaseURL(&url.URL{Scheme: "https", Host: "gitea.com"})
+	if p.Scope == "" {
+		p.Scope = "read:user"
+	}
+	return giteaProvider
+}
+
+// SetBaseURL configures the provider for a self-hosted instance
+// (e.g. https://gitea.example.com). The login, redeem and validate URLs are
+// derived from it, unless they were explicitly configured.
+func (p *GiteaProvider) SetBaseURL(baseURL *url.URL) {
+	if baseURL == nil || baseURL.Host == "" {
+		return
+	}
+	basePath := strings.TrimSuffix(baseURL.Path, "/")
+	if p.LoginURL == nil || p.LoginURL.String() == "" || p.LoginURL.Host == "gitea.com" {
+		p.LoginURL = &url.URL{
+			Scheme: baseURL.Scheme,
+			Host:   baseURL.Host,
+			Path:   basePath + "/login/oauth/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" || p.RedeemURL.Host == "gitea.com" {
+		p.RedeemURL = &url.URL{
+			Scheme: baseURL.Scheme,
+			Host:   baseURL.Host,
+			Path:   basePath + "/login/oauth/access_token",
+		}
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" || p.ValidateURL.Host == "gitea.com" {
+		p.ValidateURL = &url.URL{
+			Scheme: baseURL.Scheme,
+			Host:   baseURL.Host,
+			Path:   basePath + "/api/v1/user",
+		}
+	}
+}
+
+// SetOrgTeam restricts logins to members of any of the orgs, and if teams are
+// given, to members of one of those teams (names) in one of the orgs
+func (p *GiteaProvider) SetOrgTeam(orgs []string, teams []string) {
+	p.Orgs = orgs
+	p.Teams = teams
+	if len(orgs) > 0 || len(teams) > 0 {
+		p.Scope += " read:organization"
+	}
+}
+
+// apiURL builds the URL for an API path, relative to the API base URL which
+// is the parent of ValidateURL (/api/v1/user)
+func (p *GiteaProvider) apiURL(apiPath string, params url.Values) *url.URL {
+	u := &url.URL{
+		Scheme: p.ValidateURL.Scheme,
+		Host:   p.ValidateURL.Host,
+		Path:   path.Join(p.ValidateURL.Path, "..", apiPath),
+	}
+	if params != nil {
+		u.RawQuery = params.Encode()
+	}
+	return u
+}
+
+func getGiteaHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
+	return header
+}
+
+// apiGet requests an API endpoint, decoding a 200 response into v. The status
+// code is returned, and 204 and 404 responses are not errors.
+func (p *GiteaProvider) apiGet(ctx context.Context, accessToken string, endpoint *url.URL, v interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header = getGiteaHeader(accessToken)
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("got %d from %q", resp.StatusCode, endpoint.String())
+
+	switch resp.StatusCode {
+	case 200:
+		if v == nil {
+			break
+		}
+		if err := json.Unmarshal(body, v); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s unmarshaling %s", err, body)
+		}
+	case 204, 404:
+	default:
+		return resp.StatusCode, fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+	return resp.StatusCode, nil
+}
+
+// userOrgs returns the configured orgs the user is a member of
+func (p *GiteaProvider) userOrgs(ctx context.Context, accessToken, login string) ([]string, error) {
+	// https://try.gitea.io/api/swagger#/organization/orgIsMember
+	var found []string
+	for _, org := range p.Orgs {
+		status, err := p.apiGet(ctx, accessToken, p.apiURL(path.Join("/orgs", org, "members", login), nil), nil)
+		if err != nil {
+			return nil, err
+		}
+		if status == 204 {
+			log.Printf("Found Gitea Organization: %q", org)
+			found = append(found, org)
+		}
+	}
+	return found, nil
+}
+
+// userTeams returns the configured teams, in the configured orgs, which the
+// user is a member of, as "org/team"
+func (p *GiteaProvider) userTeams(ctx context.Context, accessToken string) ([]string, error) {
+	// https://try.gitea.io/api/swagger#/user/userListTeams
+	var found []string
+	for pn := 1; pn <= 10; pn++ {
+		params := url.Values{
+			"limit": {"50"},
+			"page":  {strconv.Itoa(pn)},
+		}
+		var teams []struct {
+			Name         string `json:"name"`
+			Organization struct {
+				Name     string `json:"name"`
+				UserName string `json:"username"`
+			} `json:"organization"`
+		}
+		status, err := p.apiGet(ctx, accessToken, p.apiURL("/user/teams", params), &teams)
+		if err != nil {
+			return nil, err
+		}
+		if status != 200 || len(teams) == 0 {
+			break
+		}
+		for _, team := range teams {
+			org := team.Organization.UserName
+			if org == "" {
+				org = team.Organization.Name
+			}
+			if !containsFold(p.Orgs, org) || !containsFold(p.Teams, team.Name) {
+				continue
+			}
+			log.Printf("Found Gitea Organization: %q Team: %q", org, team.Name)
+			found = append(found, org+"/"+team.Name)
+		}
+	}
+	return found, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *GiteaProvider) GetUserName(ctx context.Context, s *SessionState) (string, error) {
+	var user struct {
+		Login string `json:"login"`
+	}
+	status, err := p.apiGet(ctx, s.AccessToken, p.apiURL("/user", nil), &user)
+	if err != nil {
+		return "", err
+	}
+	if status != 200 || user.Login == "" {
+		return "", errors.New("no user login")
+	}
+	return user.Login, nil
+}
+
+func (p *GiteaProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
+	// if we require an Org or Team, check that first
+	if len(p.Orgs) > 0 {
+		var groups []string
+		var err error
+		if len(p.Teams) > 0 {
+			groups, err = p.userTeams(ctx, s.AccessToken)
+		} else {
+			if s.User == "" {
+				s.User, err = p.GetUserName(ctx, s)
+				if err != nil {
+					return "", err
+				}
+			}
+			groups, err = p.userOrgs(ctx, s.AccessToken, s.User)
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(groups) == 0 {
+			log.Printf("Missing Gitea Organization:%v Team:%v", p.Orgs, p.Teams)
+			return "", nil
+		}
+		s.Groups = groups
+	}
+
+	// https://try.gitea.io/api/swagger#/user/userListEmails
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	status, err := p.apiGet(ctx, s.AccessToken, p.apiURL("/user/emails", nil), &emails)
+	if err != nil {
+		return "", err
+	}
+	if status != 200 {
+		return "", fmt.Errorf("got %d listing user emails", status)
+	}
+
+	returnEmail := ""
+	for _, email := range emails {
+		if email.Verified {
+			returnEmail = email.Email
+			if email.Primary {
+				return returnEmail, nil
+			}
+		}
+	}
+	return returnEmail, nil
+}
+
+func (p *GiteaProvider) ValidateSessionState(ctx context.Context, s *SessionState) error {
+	return validateToken(ctx, p, s.AccessToken, getGiteaHeader(s.AccessToken))
+}
@@ -0,0 +1,182 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testGiteaProvider(hostname string) *GiteaProvider {
+	p := NewGiteaProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testGiteaBackend serves each payload at its path, for the access token
+// "imaginary_access_token"; a "" payload is a 204 No Content response
+func testGiteaBackend(payloads map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			payload, ok := payloads[r.URL.Path]
+			if !ok {
+				w.WriteHeader(404)
+			} else if r.Header.Get("Authorization") != "token imaginary_access_token" {
+				w.WriteHeader(401)
+			} else if r.URL.Query().Get("page") > "1" {
+				w.Write([]byte("[]"))
+			} else if payload == "" {
+				w.WriteHeader(204)
+			} else {
+				w.Write([]byte(payload))
+			}
+		}))
+}
+
+func TestGiteaProviderDefaults(t *testing.T) {
+	p := testGiteaProvider("")
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Gitea", p.Data().ProviderName)
+	assert.Equal(t, "https://gitea.com/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://gitea.com/login/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://gitea.com/api/v1/user",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "read:user", p.Data().Scope)
+
+	assert.Equal(t, "Forgejo", New("forgejo", &ProviderData{
+		LoginURL: &url.URL{}, RedeemURL: &url.URL{}, ValidateURL: &url.URL{},
+	}).Data().ProviderName)
+}
+
+func TestGiteaProviderBaseURL(t *testing.T) {
+	p := testGiteaProvider("")
+	p.SetBaseURL(&url.URL{Scheme: "https", Host: "git.example.com", Path: "/gitea/"})
+	assert.Equal(t, "https://git.example.com/gitea/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://git.example.com/gitea/login/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://git.example.com/gitea/api/v1/user",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "https://git.example.com/gitea/api/v1/user/emails",
+		p.apiURL("/user/emails", nil).String())
+}
+
+func TestGiteaProviderOverrides(t *testing.T) {
+	p := NewGiteaProvider(
+		&ProviderData{
+			LoginURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/oauth/auth"},
+			RedeemURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/oauth/token"},
+			ValidateURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/api/v1/user"},
+			Scope: "profile"})
+	p.SetBaseURL(&url.URL{Scheme: "https", Host: "git.example.com"})
+	assert.Equal(t, "https://example.com/oauth/auth",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://example.com/oauth/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://example.com/api/v1/user",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "profile", p.Data().Scope)
+}
+
+func TestGiteaProviderGetEmailAddress(t *testing.T) {
+	b := testGiteaBackend(map[string]string{
+		"/api/v1/user/emails": `[{"email": "old@example.com", "verified": true, "primary": false},
+			{"email": "unverified@example.com", "verified": false, "primary": false},
+			{"email": "mbland@acm.org", "verified": true, "primary": true}]`,
+		"/api/v1/user": `{"login": "mbland"}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGiteaProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland@acm.org", email)
+
+	user, err := p.GetUserName(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", user)
+
+	_, err = p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "unexpected_access_token"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGiteaProviderOrgs(t *testing.T) {
+	b := testGiteaBackend(map[string]string{
+		"/api/v1/user":                     `{"login": "mbland"}`,
+		"/api/v1/user/emails":              `[{"email": "mbland@acm.org", "verified": true, "primary": true}]`,
+		"/api/v1/orgs/org2/members/mbland": "",
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGiteaProvider(bURL.Host)
+	p.SetOrgTeam([]string{"org1", "org2"}, nil)
+	assert.Equal(t, "read:user read:organization", p.Data().Scope)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland@acm.org", email)
+	assert.Equal(t, "mbland", session.User)
+	assert.Equal(t, []string{"org2"}, session.Groups)
+
+	p.SetOrgTeam([]string{"org1"}, nil)
+	email, err = p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGiteaProviderTeams(t *testing.T) {
+	b := testGiteaBackend(map[string]string{
+		"/api/v1/user/emails": `[{"email": "mbland@acm.org", "verified": true, "primary": true}]`,
+		"/api/v1/user/teams": `[{"name": "Owners", "organization": {"username": "org1"}},
+			{"name": "devs", "organization": {"username": "org2"}},
+			{"name": "ops", "organization": {"username": "org3"}}]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGiteaProvider(bURL.Host)
+	p.SetOrgTeam([]string{"org1", "org2"}, []string{"devs", "ops"})
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland@acm.org", email)
+	assert.Equal(t, []string{"org2/devs"}, session.Groups)
+
+	// the team must be in one of the orgs
+	p.SetOrgTeam([]string{"org1"}, []string{"devs", "ops"})
+	email, err = p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,14 +9,21 @@ import (
 	"net/http"
 	"net/url"
 	"path"
-	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type GitHubProvider struct {
 	*ProviderData
-	Org   string
+	Orgs  []string
 	Teams []string
+	Repo  string
+	// Enterprise is set for a GitHub Enterprise Server instance, which
+	// may lack some of the newer API endpoints
+	Enterprise bool
+
+	cache *membershipCache
 }
 
 func NewGitHubProvider(p *ProviderData) *GitHubProvider {
@@ -48,6 +56,59 @@ func NewGitHubProvider(p *ProviderData) *GitHubProvider {
 	return &GitHubProvider{ProviderData: p}
 }
 
+// SetBaseURL configures the provider for a GitHub Enterprise Server instance
+// (e.g. https://github.example.com). The login, redeem and API URLs are derived
+// from it, unless they were explicitly configured.
+func (p *GitHubProvider) SetBaseURL(baseURL *url.URL) {
+	if baseURL == nil || baseURL.Host == "" {
+		return
+	}
+	basePath := strings.TrimSuffix(baseURL.Path, "/")
+	if p.LoginURL.Host == "github.com" {
+		p.LoginURL = &url.URL{
+			Scheme: baseURL.Scheme,
+			Host:   baseURL.Host,
+			Path:   basePath + "/login/oauth/authorize",
+		}
+	}
+	if p.RedeemURL.Host == "github.com" {
+		p.RedeemURL = &url.URL{
+			Scheme: baseURL.Scheme,
+			Host:   baseURL.Host,
+			Path:   basePath + "/login/oauth/access_token",
+		}
+	}
+	if p.ValidateURL.Host == "api.github.com" {
+		// GHES serves the REST API under /api/v3 on the main host
+		p.ValidateURL = &url.URL{
+			Scheme: baseURL.Scheme,
+			Host:   baseURL.Host,
+			Path:   basePath + "/api/v3/",
+		}
+	}
+	p.Enterprise = baseURL.Host != "github.com"
+}
+
+// SetMembershipCacheTTL caches org and team membership lookups for ttl
+// (0 disables caching)
+func (p *GitHubProvider) SetMembershipCacheTTL(ttl time.Duration) {
+	p.cache = newMembershipCache(ttl, ttl, 0)
+}
+
+// apiURL builds the URL for a REST API path relative to the API base URL
+// (which has an /api/v3 prefix on GitHub Enterprise Server)
+func (p *GitHubProvider) apiURL(apiPath string, params url.Values) *url.URL {
+	u := &url.URL{
+		Scheme: p.ValidateURL.Scheme,
+		Host:   p.ValidateURL.Host,
+		Path:   path.Join(p.ValidateURL.Path, apiPath),
+	}
+	if params != nil {
+		u.RawQuery = params.Encode()
+	}
+	return u
+}
+
 func getGitHubHeader(accessToken string) http.Header {
 	header := make(http.Header)
 	header.Set("Accept", "application/vnd.github.v3+json")
@@ -55,159 +116,299 @@ func getGitHubHeader(accessToken string) http.Header {
 	return header
 }
 
-func (p *GitHubProvider) SetOrgTeam(org string, teams []string) {
-	p.Org = org
+// SetOrgTeam restricts logins to members of any of the orgs, and if teams are
+// given, to members of one of those teams (slugs) in one of the orgs
+func (p *GitHubProvider) SetOrgTeam(orgs []string, teams []string) {
+	p.Orgs = orgs
 	p.Teams = teams
-	if org != "" || len(teams) > 0 {
+	if len(orgs) > 0 || len(teams) > 0 {
 		p.Scope += " read:org"
 	}
 }
 
-func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
-	// https://developer.github.com/v3/orgs/#list-your-organizations
-	var orgs []struct {
-		Login string `json:"login"`
-	}
-	type orgsPage []struct {
-		Login string `json:"login"`
+// SetRepo allows logins by users with push access to the repository
+// ("owner/repo"), in addition to members of the configured orgs/teams. This
+// requests the "repo" scope, which GitHub requires to read the permissions of
+// private repositories, but which also grants full access to the user's
+// repositories.
+func (p *GitHubProvider) SetRepo(repo string) {
+	p.Repo = repo
+	if repo != "" {
+		p.Scope += " repo"
 	}
+}
 
-	for pn := 1; pn <= 10; pn++ {
-		params := url.Values{
-			"per_page": {"100"},
-			"page":     {strconv.Itoa(pn)},
-		}
-		endpoint := &url.URL{
-			Scheme:   p.ValidateURL.Scheme,
-			Host:     p.ValidateURL.Host,
-			Path:     path.Join(p.ValidateURL.Path, "/user/orgs"),
-			RawQuery: params.Encode(),
-		}
-		req, _ := http.NewRequest("GET", endpoint.String(), nil)
-		req.Header = getGitHubHeader(accessToken)
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return false, err
+func (p *GitHubProvider) isOrg(login string) bool {
+	for _, org := range p.Orgs {
+		if org == login {
+			return true
 		}
+	}
+	return false
+}
+
+// getMembership fetches an org or team membership resource and returns its
+// state ("active" or "pending"), or "" if the user is not a member
+func (p *GitHubProvider) getMembership(ctx context.Context, accessToken string, endpoint *url.URL) (string, error) {
+	var membership struct {
+		State string `json:"state"`
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	req.Header = getGitHubHeader(accessToken)
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == 403 || resp.StatusCode == 404 {
+		return "", nil
+	}
+	if resp.StatusCode != 200 {
+		return "", newStatusError(resp.StatusCode, endpoint, body)
+	}
+
+	if err := json.Unmarshal(body, &membership); err != nil {
+		return "", fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	return membership.State, nil
+}
+
+// getTeamID looks up the numeric id of a team by its slug, or 0 if the team
+// does not exist or is not visible to the user
+func (p *GitHubProvider) getTeamID(ctx context.Context, accessToken, org, slug string) (int, error) {
+	// https://developer.github.com/enterprise/2.20/v3/teams/#get-a-team-by-name
+	var team struct {
+		ID int `json:"id"`
+	}
+
+	endpoint := p.apiURL(path.Join("/orgs", org, "teams", slug), nil)
+	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	req.Header = getGitHubHeader(accessToken)
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == 403 || resp.StatusCode == 404 {
+		return 0, nil
+	}
+	if resp.StatusCode != 200 {
+		return 0, newStatusError(resp.StatusCode, endpoint, body)
+	}
+
+	if err := json.Unmarshal(body, &team); err != nil {
+		return 0, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	return team.ID, nil
+}
+
+func (p *GitHubProvider) isOrgMember(ctx context.Context, accessToken, login, org string) (bool, error) {
+	key := "org:" + org + ":" + login
+	if member, ok := p.cache.get(key); ok {
+		return member, nil
+	}
+
+	// https://developer.github.com/v3/orgs/members/#get-an-organization-membership-for-the-authenticated-user
+	state, err := p.getMembership(ctx, accessToken, p.apiURL(path.Join("/user/memberships/orgs", org), nil))
+	if err != nil {
+		return false, err
+	}
+	if state == "pending" {
+		log.Printf("Pending Github Organization:%q membership for %q (invitation not accepted)", org, login)
+	}
+
+	member := state == "active"
+	p.cache.set(key, member)
+	return member, nil
+}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+func (p *GitHubProvider) isTeamMember(ctx context.Context, accessToken, login, org, slug string) (bool, error) {
+	key := "team:" + org + "/" + slug + ":" + login
+	if member, ok := p.cache.get(key); ok {
+		return member, nil
+	}
+
+	// https://developer.github.com/v3/teams/members/#get-team-membership-for-a-user
+	state, err := p.getMembership(ctx, accessToken, p.apiURL(path.Join("/orgs", org, "teams", slug, "memberships", login), nil))
+	if err != nil {
+		return false, err
+	}
+	if state == "" && p.Enterprise {
+		// GitHub Enterprise Server before 2.21 only has the legacy
+		// membership endpoint, addressed by numeric team id
+		var id int
+		id, err = p.getTeamID(ctx, accessToken, org, slug)
 		if err != nil {
 			return false, err
 		}
-		if resp.StatusCode != 200 {
-			return false, fmt.Errorf(
-				"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+		if id != 0 {
+			state, err = p.getMembership(ctx, accessToken, p.apiURL(path.Join("/teams", strconv.Itoa(id), "memberships", login), nil))
+			if err != nil {
+				return false, err
+			}
 		}
+	}
+	if state == "pending" {
+		log.Printf("Pending Github Organization:%q Team:%q membership for %q", org, slug, login)
+	}
 
-		var op orgsPage
-		if err := json.Unmarshal(body, &op); err != nil {
-			return false, err
+	member := state == "active"
+	p.cache.set(key, member)
+	return member, nil
+}
+
+// memberOrgs returns the orgs the user is a member of. An error looking up
+// one org is only returned if the user is not a member of any other.
+func (p *GitHubProvider) memberOrgs(ctx context.Context, accessToken, login string) ([]string, error) {
+	var found []string
+	var lookupErr error
+	for _, org := range p.Orgs {
+		ok, err := p.isOrgMember(ctx, accessToken, login, org)
+		if err != nil {
+			lookupErr = err
+			continue
 		}
-		if len(op) == 0 {
-			break
+		if ok {
+			log.Printf("Found Github Organization:%q for %q", org, login)
+			found = append(found, org)
 		}
-
-		orgs = append(orgs, op...)
+	}
+	if len(found) > 0 {
+		return found, nil
+	}
+	if lookupErr != nil {
+		return nil, lookupErr
 	}
 
-	var presentOrgs []string
-	for _, org := range orgs {
-		if p.Org == org.Login {
-			log.Printf("Found Github Organization: %q", org.Login)
-			return true, nil
+	log.Printf("Missing Organization:%v for %q", p.Orgs, login)
+	return nil, nil
+}
+
+// memberTeams returns the teams (as "org/team") the user is a member of, in
+// any of the orgs, and like memberOrgs only returns a lookup error if the
+// user is not a member of any other team
+func (p *GitHubProvider) memberTeams(ctx context.Context, accessToken, login string) ([]string, error) {
+	var found []string
+	var lookupErr error
+	for _, org := range p.Orgs {
+		for _, team := range p.Teams {
+			ok, err := p.isTeamMember(ctx, accessToken, login, org, team)
+			if err != nil {
+				lookupErr = err
+				continue
+			}
+			if ok {
+				log.Printf("Found Github Organization:%q Team:%q for %q", org, team, login)
+				found = append(found, org+"/"+team)
+			}
 		}
-		presentOrgs = append(presentOrgs, org.Login)
+	}
+	if len(found) > 0 {
+		return found, nil
+	}
+	if lookupErr != nil {
+		return nil, lookupErr
 	}
 
-	log.Printf("Missing Organization:%q in %v", p.Org, presentOrgs)
-	return false, nil
+	log.Printf("Missing Team:%v from Org:%v for %q", p.Teams, p.Orgs, login)
+	return nil, nil
 }
 
-func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
-	// https://developer.github.com/v3/orgs/teams/#list-user-teams
+func (p *GitHubProvider) hasRepo(ctx context.Context, accessToken, login string) (bool, error) {
+	// https://developer.github.com/v3/repos/collaborators/#review-a-users-permission-level
+	var permission struct {
+		Permission string `json:"permission"`
+	}
 
-	var teams []struct {
-		Name string `json:"name"`
-		Slug string `json:"slug"`
-		Org  struct {
-			Login string `json:"login"`
-		} `json:"organization"`
+	endpoint := p.apiURL(path.Join("/repos", p.Repo, "collaborators", login, "permission"), nil)
+	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	req.Header = getGitHubHeader(accessToken)
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return false, err
 	}
 
-	params := url.Values{
-		"per_page": {"100"},
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == 403 || resp.StatusCode == 404 {
+		// the user can not see the repository or its collaborators
+		log.Printf("Missing Repository:%q for %q (got %d)", p.Repo, login, resp.StatusCode)
+		return false, nil
 	}
-	endpoint := &url.URL{
-		Scheme:   p.ValidateURL.Scheme,
-		Host:     p.ValidateURL.Host,
-		Path:     path.Join(p.ValidateURL.Path, "/user/teams"),
-		RawQuery: params.Encode(),
+	if resp.StatusCode != 200 {
+		return false, newStatusError(resp.StatusCode, endpoint, body)
 	}
-	team_url := endpoint.String()
 
-	pattern := regexp.MustCompile(`<([^>]+)>; rel="next"`)
-	var hasOrg bool
-	presentOrgs := make(map[string]bool)
-	var presentTeams []string
+	if err := json.Unmarshal(body, &permission); err != nil {
+		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
 
-	for i := 0; i < 10; i++ {
-		req, _ := http.NewRequest("GET", team_url, nil)
-		req.Header = getGitHubHeader(accessToken)
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return false, err
-		}
+	switch permission.Permission {
+	case "admin", "write":
+		log.Printf("Found Github Repository:%q %q permission for %q", p.Repo, permission.Permission, login)
+		return true, nil
+	}
+	log.Printf("Missing push access to Repository:%q for %q (permission %q)", p.Repo, login, permission.Permission)
+	return false, nil
+}
+
+// isAuthorized checks the configured org, team and repository restrictions.
+// Membership in an org (and team) or push access to the repository is enough.
+func (p *GitHubProvider) isAuthorized(ctx context.Context, s *SessionState) (bool, error) {
+	if len(p.Orgs) == 0 && p.Repo == "" {
+		return true, nil
+	}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+	// membership is looked up by login
+	if s.User == "" {
+		login, err := p.GetUserName(ctx, s)
 		if err != nil {
 			return false, err
 		}
-		if resp.StatusCode != 200 {
-			return false, fmt.Errorf(
-				"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
-		}
-
-		if err := json.Unmarshal(body, &teams); err != nil {
-			return false, fmt.Errorf("%s unmarshaling %s", err, body)
-		}
+		s.User = login
+	}
 
-		for _, team := range teams {
-			presentOrgs[team.Org.Login] = true
-			if p.Org == team.Org.Login {
-				hasOrg = true
-				for _, t := range p.Teams {
-					if t == team.Slug {
-						log.Printf("Found Github Organization:%q Team:%q (Name:%q)",
-							team.Org.Login, team.Slug, team.Name)
-						return true, nil
-					}
-				}
-				presentTeams = append(presentTeams, team.Slug)
-			}
+	// the user is allowed by either the orgs (and teams) or the repo, so an
+	// error from one is only returned if the other does not allow the user.
+	// The orgs or teams are recorded in the session's groups.
+	var orgErr error
+	if len(p.Orgs) > 0 {
+		var groups []string
+		if len(p.Teams) > 0 {
+			groups, orgErr = p.memberTeams(ctx, s.AccessToken, s.User)
+		} else {
+			groups, orgErr = p.memberOrgs(ctx, s.AccessToken, s.User)
 		}
-
-		matches := pattern.FindStringSubmatch(resp.Header.Get("Link"))
-		if len(matches) == 0 {
-			break
+		if len(groups) > 0 {
+			s.Groups = groups
+			return true, nil
 		}
-		team_url = matches[1]
 	}
 
-	if hasOrg {
-		log.Printf("Missing Team:%v from Org:%q in teams: %v", p.Teams, p.Org, presentTeams)
-	} else {
-		var allOrgs []string
-		for org, _ := range presentOrgs {
-			allOrgs = append(allOrgs, org)
+	if p.Repo != "" {
+		ok, err := p.hasRepo(ctx, s.AccessToken, s.User)
+		if ok || (err != nil && orgErr == nil) {
+			return ok, err
 		}
-		log.Printf("Missing Organization:%q in %v", p.Org, allOrgs)
 	}
-	return false, nil
+	return false, orgErr
 }
 
-func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (p *GitHubProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 
 	var emails []struct {
 		Email    string `json:"email"`
@@ -215,27 +416,15 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 		Verified bool   `json:"verified"`
 	}
 
-	// if we require an Org or Team, check that first
-	if p.Org != "" {
-		if len(p.Teams) > 0 {
-			if ok, err := p.hasOrgAndTeam(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		} else {
-			if ok, err := p.hasOrg(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		}
+	// if we require an Org, Team or Repo, check that first
+	if ok, err := p.isAuthorized(ctx, s); err != nil || !ok {
+		return "", err
 	}
 
-	endpoint := &url.URL{
-		Scheme: p.ValidateURL.Scheme,
-		Host:   p.ValidateURL.Host,
-		Path:   path.Join(p.ValidateURL.Path, "/user/emails"),
-	}
-	req, _ := http.NewRequest("GET", endpoint.String(), nil)
+	endpoint := p.apiURL("/user/emails", nil)
+	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 	req.Header = getGitHubHeader(s.AccessToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.httpClient().Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -246,8 +435,7 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("got %d from %q %s",
-			resp.StatusCode, endpoint.String(), body)
+		return "", newStatusError(resp.StatusCode, endpoint, body)
 	}
 
 	log.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
@@ -269,25 +457,21 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 	return returnEmail, nil
 }
 
-func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
+func (p *GitHubProvider) GetUserName(ctx context.Context, s *SessionState) (string, error) {
 	var user struct {
 		Login string `json:"login"`
 		Email string `json:"email"`
 	}
 
-	endpoint := &url.URL{
-		Scheme: p.ValidateURL.Scheme,
-		Host:   p.ValidateURL.Host,
-		Path:   path.Join(p.ValidateURL.Path, "/user"),
-	}
+	endpoint := p.apiURL("/user", nil)
 
-	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 	if err != nil {
 		return "", fmt.Errorf("could not create new GET request: %v", err)
 	}
 
 	req.Header = getGitHubHeader(s.AccessToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.httpClient().Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -299,8 +483,7 @@ func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("got %d from %q %s",
-			resp.StatusCode, endpoint.String(), body)
+		return "", newStatusError(resp.StatusCode, endpoint, body)
 	}
 
 	log.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
@@ -312,6 +495,18 @@ func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
 	return user.Login, nil
 }
 
-func (p *GitHubProvider) ValidateSessionState(s *SessionState) bool {
-	return validateToken(p, s.AccessToken, getGitHubHeader(s.AccessToken))
+// ValidateSessionState checks that the token is still valid, and re-evaluates
+// the org, team and repository restrictions
+func (p *GitHubProvider) ValidateSessionState(ctx context.Context, s *SessionState) error {
+	if err := validateToken(ctx, p, s.AccessToken, getGitHubHeader(s.AccessToken)); err != nil {
+		return err
+	}
+	ok, err := p.isAuthorized(ctx, s)
+	if err != nil {
+		return fmt.Errorf("error re-checking GitHub authorization: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%s is no longer authorized", s)
+	}
+	return nil
 }
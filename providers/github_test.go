@@ -1,10 +1,12 @@
 package providers
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -31,7 +33,6 @@ func testGitHubBackend(payload []string) *httptest.Server {
 	pathToQueryMap := map[string][]string{
 		"/user":        []string{""},
 		"/user/emails": []string{""},
-		"/user/orgs":   []string{"page=1&per_page=100", "page=2&per_page=100", "page=3&per_page=100"},
 	}
 
 	return httptest.NewServer(http.HandlerFunc(
@@ -97,48 +98,83 @@ func TestGitHubProviderOverrides(t *testing.T) {
 	assert.Equal(t, "profile", p.Data().Scope)
 }
 
-func TestGitHubProviderGetEmailAddress(t *testing.T) {
-	b := testGitHubBackend([]string{`[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`})
+func TestGitHubProviderEnterpriseBaseURL(t *testing.T) {
+	p := testGitHubProvider("")
+	p.SetBaseURL(&url.URL{Scheme: "https", Host: "github.example.com"})
+	assert.Equal(t, "https://github.example.com/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://github.example.com/login/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3/",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3/user/teams?per_page=100",
+		p.apiURL("/user/teams", url.Values{"per_page": {"100"}}).String())
+}
+
+func TestGitHubProviderEnterpriseBaseURLOverrides(t *testing.T) {
+	p := NewGitHubProvider(
+		&ProviderData{
+			LoginURL: &url.URL{},
+			RedeemURL: &url.URL{
+				Scheme: "https",
+				Host:   "sso.example.com",
+				Path:   "/token"},
+			ValidateURL: &url.URL{}})
+	p.SetBaseURL(&url.URL{Scheme: "https", Host: "example.com", Path: "/github/"})
+	assert.Equal(t, "https://example.com/github/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://sso.example.com/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://example.com/github/api/v3/",
+		p.Data().ValidateURL.String())
+}
+
+func TestGitHubProviderGetEmailAddressEnterprise(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v3/user/emails" {
+				w.WriteHeader(404)
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`))
+		}))
 	defer b.Close()
 
 	bURL, _ := url.Parse(b.URL)
-	p := testGitHubProvider(bURL.Host)
+	p := testGitHubProvider("")
+	p.SetBaseURL(bURL)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Nil(t, err)
 	assert.Equal(t, "michael.bland@gsa.gov", email)
 }
 
-func TestGitHubProviderGetEmailAddressNotVerified(t *testing.T) {
-	b := testGitHubBackend([]string{`[ {"email": "michael.bland@gsa.gov", "verified": false, "primary": true} ]`})
+func TestGitHubProviderGetEmailAddress(t *testing.T) {
+	b := testGitHubBackend([]string{`[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`})
 	defer b.Close()
 
 	bURL, _ := url.Parse(b.URL)
 	p := testGitHubProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
-	assert.Equal(t, nil, err)
-	assert.Empty(t, "", email)
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
 }
 
-func TestGitHubProviderGetEmailAddressWithOrg(t *testing.T) {
-	b := testGitHubBackend([]string{
-		`[ {"email": "michael.bland@gsa.gov", "primary": true, "verified": true, "login":"testorg"} ]`,
-		`[ {"email": "michael.bland1@gsa.gov", "primary": true, "verified": true, "login":"testorg1"} ]`,
-		`[ ]`,
-	})
+func TestGitHubProviderGetEmailAddressNotVerified(t *testing.T) {
+	b := testGitHubBackend([]string{`[ {"email": "michael.bland@gsa.gov", "verified": false, "primary": true} ]`})
 	defer b.Close()
 
 	bURL, _ := url.Parse(b.URL)
 	p := testGitHubProvider(bURL.Host)
-	p.Org = "testorg1"
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
-	assert.Nil(t, err)
-	assert.Equal(t, "michael.bland@gsa.gov", email)
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Empty(t, "", email)
 }
 
 // Note that trying to trigger the "failed building request" case is not
@@ -154,7 +190,7 @@ func TestGitHubProviderGetEmailAddressFailedRequest(t *testing.T) {
 	// token. Alternatively, we could allow the parsing of the payload as
 	// JSON to fail.
 	session := &SessionState{AccessToken: "unexpected_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.NotNil(t, err)
 	assert.Equal(t, "", email)
 }
@@ -167,7 +203,7 @@ func TestGitHubProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
 	p := testGitHubProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.NotNil(t, err)
 	assert.Equal(t, "", email)
 }
@@ -180,7 +216,242 @@ func TestGitHubProviderGetUserName(t *testing.T) {
 	p := testGitHubProvider(bURL.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetUserName(session)
+	email, err := p.GetUserName(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "mbland", email)
 }
+
+func testGitHubPathBackend(payloads map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			payload, ok := payloads[r.URL.Path]
+			if !ok || r.Header.Get("Authorization") != "token imaginary_access_token" {
+				w.WriteHeader(404)
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(payload))
+		}))
+}
+
+func TestGitHubProviderGetEmailAddressWithOrg(t *testing.T) {
+	b := testGitHubPathBackend(map[string]string{
+		"/user":                           `{"login": "mbland"}`,
+		"/user/memberships/orgs/testorg1": `{"state": "active", "role": "member"}`,
+		"/user/memberships/orgs/pending":  `{"state": "pending", "role": "member"}`,
+		"/user/emails":                    `[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.SetOrgTeam([]string{"testorg1"}, nil)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, "mbland", session.User)
+
+	// an invitation which was not accepted yet does not count
+	p.SetOrgTeam([]string{"pending"}, nil)
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGitHubProviderGetEmailAddressWithTeam(t *testing.T) {
+	b := testGitHubPathBackend(map[string]string{
+		"/user": `{"login": "mbland"}`,
+		"/orgs/testorg/teams/testteam/memberships/mbland": `{"state": "active", "role": "member"}`,
+		"/user/emails": `[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.SetOrgTeam([]string{"testorg"}, []string{"otherteam", "testteam"})
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"testorg/testteam"}, session.Groups)
+
+	p.SetOrgTeam([]string{"testorg"}, []string{"otherteam"})
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGitHubProviderEnterpriseLegacyTeamMembership(t *testing.T) {
+	b := testGitHubPathBackend(map[string]string{
+		"/api/v3/user":                        `{"login": "mbland"}`,
+		"/api/v3/orgs/testorg/teams/testteam": `{"id": 42, "slug": "testteam"}`,
+		"/api/v3/teams/42/memberships/mbland": `{"state": "active", "role": "member"}`,
+		"/api/v3/user/emails":                 `[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider("")
+	p.SetBaseURL(bURL)
+	assert.True(t, p.Enterprise)
+	p.SetOrgTeam([]string{"testorg"}, []string{"testteam"})
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+}
+
+func TestGitHubProviderMembershipCache(t *testing.T) {
+	var requests int
+	b := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.URL.Path != "/user/memberships/orgs/testorg" {
+				w.WriteHeader(404)
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{"state": "active"}`))
+		}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.SetOrgTeam([]string{"testorg"}, nil)
+	p.SetMembershipCacheTTL(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		orgs, err := p.memberOrgs(context.Background(), "imaginary_access_token", "mbland")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"testorg"}, orgs)
+	}
+	assert.Equal(t, 1, requests)
+
+	orgs, err := p.memberOrgs(context.Background(), "imaginary_access_token", "someoneelse")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"testorg"}, orgs)
+	assert.Equal(t, 2, requests)
+}
+
+func TestGitHubProviderGetEmailAddressWithMultipleOrgs(t *testing.T) {
+	b := testGitHubPathBackend(map[string]string{
+		"/user":                           `{"login": "mbland"}`,
+		"/user/memberships/orgs/testorg2": `{"state": "active", "role": "member"}`,
+		"/user/emails":                    `[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.SetOrgTeam([]string{"testorg1", "testorg2"}, nil)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"testorg2"}, session.Groups)
+}
+
+func TestGitHubProviderGetEmailAddressWithRepo(t *testing.T) {
+	b := testGitHubPathBackend(map[string]string{
+		"/user":        `{"login": "mbland"}`,
+		"/user/emails": `[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`,
+		"/repos/testorg/testrepo/collaborators/mbland/permission": `{"permission": "write"}`,
+		"/repos/testorg/readonly/collaborators/mbland/permission": `{"permission": "read"}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.SetOrgTeam([]string{"testorg"}, nil)
+	p.SetRepo("testorg/testrepo")
+	assert.Equal(t, "user:email read:org repo", p.Scope)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, "mbland", session.User)
+
+	p.SetRepo("testorg/readonly")
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "", email)
+
+	p.SetRepo("testorg/missing")
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGitHubProviderGetEmailAddressOrgLookupError(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user/memberships/orgs/broken":
+			w.WriteHeader(500)
+		case "/user/memberships/orgs/testorg":
+			w.Write([]byte(`{"state": "active", "role": "member"}`))
+		case "/repos/testorg/testrepo/collaborators/mbland/permission":
+			w.Write([]byte(`{"permission": "write"}`))
+		case "/repos/testorg/readonly/collaborators/mbland/permission":
+			w.Write([]byte(`{"permission": "read"}`))
+		case "/user/emails":
+			w.Write([]byte(`[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+
+	// another org allows the user
+	p.SetOrgTeam([]string{"broken", "testorg"}, nil)
+	session := &SessionState{AccessToken: "imaginary_access_token", User: "mbland"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	// the repo allows the user
+	p.SetOrgTeam([]string{"broken"}, nil)
+	p.SetRepo("testorg/testrepo")
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Nil(t, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	// nothing allows the user, so the lookup error is returned
+	p.SetRepo("testorg/readonly")
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, IsUnavailable(err))
+	assert.Equal(t, "", email)
+}
+
+func TestGitHubProviderValidateSessionStateRechecksRepo(t *testing.T) {
+	b := testGitHubPathBackend(map[string]string{
+		"/": `{}`,
+		"/repos/testorg/testrepo/collaborators/mbland/permission": `{"permission": "admin"}`,
+		"/repos/testorg/readonly/collaborators/mbland/permission": `{"permission": "read"}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.ValidateURL.Path = "/"
+	session := &SessionState{AccessToken: "imaginary_access_token", User: "mbland"}
+
+	p.SetRepo("testorg/testrepo")
+	assert.Equal(t, nil, p.ValidateSessionState(context.Background(), session))
+
+	p.SetRepo("testorg/readonly")
+	assert.NotEqual(t, nil, p.ValidateSessionState(context.Background(), session))
+}
@@ -1,18 +1,35 @@
 package providers
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/ploxiln/oauth2_proxy/api"
 )
 
+// GitLab access levels https://docs.gitlab.com/ee/api/members.html
+var gitlabAccessLevels = map[string]int{
+	"guest":      10,
+	"reporter":   20,
+	"developer":  30,
+	"maintainer": 40,
+	"owner":      50,
+}
+
 type GitLabProvider struct {
 	*ProviderData
-	Groups []string
+	Groups   []string
+	Projects []string
+	// ProjectAccessLevel is the minimum access level required in Projects
+	ProjectAccessLevel int
 }
 
 func NewGitLabProvider(p *ProviderData) *GitLabProvider {
@@ -53,7 +70,44 @@ func (p *GitLabProvider) SetGroups(groups []string) {
 	}
 }
 
-func (p *GitLabProvider) hasGroup(accessToken string) (bool, error) {
+// SetProjects restricts logins to members of any of the projects (full path)
+// with at least the given access level, which may be a role name like
+// "developer" or a numeric level
+func (p *GitLabProvider) SetProjects(projects []string, accessLevel string) error {
+	level, err := ParseGitLabAccessLevel(accessLevel)
+	if err != nil {
+		return err
+	}
+	p.Projects = projects
+	p.ProjectAccessLevel = level
+
+	// reading a project's membership needs read_api, not the read/write api
+	if len(projects) > 0 && (p.Scope == "" || p.Scope == "read_user") {
+		p.Scope = "read_api"
+	}
+	return nil
+}
+
+// ParseGitLabAccessLevel accepts a role name (guest, reporter, developer,
+// maintainer, owner) or a numeric access level
+func ParseGitLabAccessLevel(level string) (int, error) {
+	if level == "" {
+		return gitlabAccessLevels["guest"], nil
+	}
+	if l, ok := gitlabAccessLevels[strings.ToLower(level)]; ok {
+		return l, nil
+	}
+	l, err := strconv.Atoi(level)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gitlab access level %q", level)
+	}
+	return l, nil
+}
+
+// userGroups returns the configured groups the user is a member of, directly
+// or by inheritance from a parent group
+func (p *GitLabProvider) userGroups(ctx context.Context, accessToken string) ([]string, error) {
+	var memberOf []string
 
 	type groupsPage []struct {
 		FullPath string `json:"full_path"`
@@ -61,9 +115,10 @@ func (p *GitLabProvider) hasGroup(accessToken string) (bool, error) {
 
 	for pn := 1; pn <= 10; pn++ {
 		params := url.Values{
-			"access_token": {accessToken},
-			"per_page":     {"100"},
-			"page":         {strconv.Itoa(pn)},
+			"access_token":     {accessToken},
+			"min_access_level": {strconv.Itoa(gitlabAccessLevels["guest"])},
+			"per_page":         {"100"},
+			"page":             {strconv.Itoa(pn)},
 		}
 
 		endpoint := &url.URL{
@@ -72,48 +127,144 @@ func (p *GitLabProvider) hasGroup(accessToken string) (bool, error) {
 			Path:     path.Join(p.ValidateURL.Path, "../groups"),
 			RawQuery: params.Encode(),
 		}
-		req, err := http.NewRequest("GET", endpoint.String(), nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 
 		var groups groupsPage
-		err = api.RequestJson(req, &groups)
+		err = api.RequestJson(p.httpClient(), req, &groups)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 		if len(groups) == 0 {
 			break
 		}
-
 		for _, group := range groups {
-			for _, g := range p.Groups {
-				if g == group.FullPath {
-					log.Printf("Found GitLab Group:%q", g)
-					return true, nil
-				}
+			memberOf = append(memberOf, group.FullPath)
+		}
+	}
+
+	var found []string
+	for _, g := range p.Groups {
+		for _, m := range memberOf {
+			if g == m || strings.HasPrefix(g, m+"/") {
+				log.Printf("Found GitLab Group:%q (via %q)", g, m)
+				found = append(found, g)
+				break
 			}
 		}
 	}
+	return found, nil
+}
+
+// projectAccessLevel returns the effective access level of the user in the
+// project, which may be inherited from its group, or 0 if it is not visible
+func (p *GitLabProvider) projectAccessLevel(ctx context.Context, accessToken string, project string) (int, error) {
+	// https://docs.gitlab.com/ee/api/projects.html#get-single-project
+	var result struct {
+		Permissions struct {
+			ProjectAccess *struct {
+				AccessLevel int `json:"access_level"`
+			} `json:"project_access"`
+			GroupAccess *struct {
+				AccessLevel int `json:"access_level"`
+			} `json:"group_access"`
+		} `json:"permissions"`
+	}
 
-	return false, nil
+	endpoint := &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     path.Join(p.ValidateURL.Path, "../projects", project),
+		RawPath:  path.Join(p.ValidateURL.Path, "../projects", url.PathEscape(project)),
+		RawQuery: url.Values{"access_token": {accessToken}}.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == 403 || resp.StatusCode == 404 {
+		return 0, nil
+	}
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("got %d from %q %s", resp.StatusCode, project, body)
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+
+	level := 0
+	if a := result.Permissions.ProjectAccess; a != nil && a.AccessLevel > level {
+		level = a.AccessLevel
+	}
+	if a := result.Permissions.GroupAccess; a != nil && a.AccessLevel > level {
+		level = a.AccessLevel
+	}
+	return level, nil
 }
 
-func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
-	// if we require a Group, check that first
-	if len(p.Groups) > 0 {
-		if ok, err := p.hasGroup(s.AccessToken); err != nil || !ok {
-			return "", err
+// userProjects returns the configured projects in which the user has at
+// least ProjectAccessLevel
+func (p *GitLabProvider) userProjects(ctx context.Context, accessToken string) ([]string, error) {
+	var found []string
+	for _, project := range p.Projects {
+		level, err := p.projectAccessLevel(ctx, accessToken, project)
+		if err != nil {
+			return nil, err
+		}
+		if level >= p.ProjectAccessLevel {
+			log.Printf("Found GitLab Project:%q (access level %d)", project, level)
+			found = append(found, project)
+		} else if level > 0 {
+			log.Printf("Insufficient access to GitLab Project:%q (access level %d < %d)",
+				project, level, p.ProjectAccessLevel)
+		}
+	}
+	return found, nil
+}
+
+func (p *GitLabProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
+	// if we require a Group or Project, check that first
+	if len(p.Groups) > 0 || len(p.Projects) > 0 {
+		var groups []string
+		if len(p.Groups) > 0 {
+			found, err := p.userGroups(ctx, s.AccessToken)
+			if err != nil {
+				return "", err
+			}
+			groups = append(groups, found...)
+		}
+		if len(p.Projects) > 0 {
+			found, err := p.userProjects(ctx, s.AccessToken)
+			if err != nil {
+				return "", err
+			}
+			groups = append(groups, found...)
+		}
+		if len(groups) == 0 {
+			log.Printf("Missing GitLab Group:%v or Project:%v", p.Groups, p.Projects)
+			return "", nil
 		}
+		s.Groups = groups
 	}
 
-	req, err := http.NewRequest("GET",
+	req, err := http.NewRequestWithContext(ctx, "GET",
 		p.ValidateURL.String()+"?access_token="+s.AccessToken, nil)
 	if err != nil {
 		log.Printf("failed building request %s", err)
 		return "", err
 	}
-	json, err := api.Request(req)
+	json, err := api.Request(p.httpClient(), req)
 	if err != nil {
 		log.Printf("failed making request %s", err)
 		return "", err
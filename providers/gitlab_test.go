@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -92,7 +93,7 @@ func TestGitLabProviderGetEmailAddress(t *testing.T) {
 	p := testGitLabProvider(b_url.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "michael.bland@gsa.gov", email)
 }
@@ -110,7 +111,7 @@ func TestGitLabProviderGetEmailAddressFailedRequest(t *testing.T) {
 	// token. Alternatively, we could allow the parsing of the payload as
 	// JSON to fail.
 	session := &SessionState{AccessToken: "unexpected_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
@@ -123,7 +124,105 @@ func TestGitLabProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
 	p := testGitLabProvider(b_url.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
+
+// testGitLabPathBackend serves each payload at its (escaped) path, ignoring
+// paging and other query parameters other than the access_token
+func testGitLabPathBackend(payloads map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			payload, ok := payloads[r.URL.EscapedPath()]
+			if !ok || r.URL.Query().Get("access_token") != "imaginary_access_token" {
+				w.WriteHeader(404)
+			} else if r.URL.Query().Get("page") > "1" {
+				w.WriteHeader(200)
+				w.Write([]byte("[]"))
+			} else {
+				w.WriteHeader(200)
+				w.Write([]byte(payload))
+			}
+		}))
+}
+
+func TestGitLabProviderGroups(t *testing.T) {
+	b := testGitLabPathBackend(map[string]string{
+		"/api/v4/user":   `{"email": "michael.bland@gsa.gov"}`,
+		"/api/v4/groups": `[{"full_path": "other"}, {"full_path": "mygroup/sub"}]`,
+	})
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testGitLabProvider(b_url.Host)
+	p.SetGroups([]string{"mygroup", "mygroup/sub"})
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"mygroup/sub"}, session.Groups)
+
+	p.SetGroups([]string{"mygroup"})
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+
+	// membership of a parent group is inherited by its subgroups
+	p.SetGroups([]string{"other/sub/deeper", "otherwise"})
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"other/sub/deeper"}, session.Groups)
+}
+
+func TestGitLabProviderProjects(t *testing.T) {
+	b := testGitLabPathBackend(map[string]string{
+		"/api/v4/user": `{"email": "michael.bland@gsa.gov"}`,
+		"/api/v4/projects/mygroup%2Fdirect": `{"permissions": {
+			"project_access": {"access_level": 30}, "group_access": null}}`,
+		"/api/v4/projects/mygroup%2Finherited": `{"permissions": {
+			"project_access": null, "group_access": {"access_level": 40}}}`,
+	})
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testGitLabProvider(b_url.Host)
+	assert.Equal(t, nil, p.SetProjects([]string{"mygroup/direct", "mygroup/inherited", "mygroup/hidden"}, "developer"))
+	assert.Equal(t, "read_api", p.Data().Scope)
+	assert.Equal(t, 30, p.ProjectAccessLevel)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"mygroup/direct", "mygroup/inherited"}, session.Groups)
+
+	assert.Equal(t, nil, p.SetProjects([]string{"mygroup/direct", "mygroup/inherited"}, "maintainer"))
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"mygroup/inherited"}, session.Groups)
+
+	assert.Equal(t, nil, p.SetProjects([]string{"mygroup/direct", "mygroup/inherited"}, "50"))
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGitLabAccessLevel(t *testing.T) {
+	for level, expected := range map[string]int{
+		"": 10, "guest": 10, "Developer": 30, "maintainer": 40, "owner": 50, "20": 20,
+	} {
+		l, err := ParseGitLabAccessLevel(level)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, expected, l, level)
+	}
+	_, err := ParseGitLabAccessLevel("bogus")
+	assert.NotEqual(t, nil, err)
+}
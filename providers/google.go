@@ -1,7 +1,7 @@
 package providers
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -9,7 +9,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"strings"
 	"time"
@@ -25,6 +24,11 @@ type GoogleProvider struct {
 	// GroupValidator is a function that determines if the passed email is in
 	// the configured Google group.
 	GroupValidator func(string) bool
+
+	// groupLookup returns the configured groups the passed email is in, or
+	// the error if the Directory API could not be checked
+	groupLookup func(context.Context, string) ([]string, error)
+	cache       *membershipCache
 }
 
 func NewGoogleProvider(p *ProviderData) *GoogleProvider {
@@ -89,7 +93,7 @@ func emailFromIdToken(idToken string) (string, error) {
 	return email.Email, nil
 }
 
-func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err error) {
+func (p *GoogleProvider) Redeem(ctx context.Context, redirectURL, code string) (s *SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -97,30 +101,16 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 
 	params := url.Values{}
 	params.Add("redirect_uri", redirectURL)
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
-	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
-	if err != nil {
-		return
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return
-	}
+	var status int
 	var body []byte
-	body, err = ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	status, body, err = p.postToken(ctx, p.RedeemURL, params)
 	if err != nil {
 		return
 	}
-
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	if status != 200 {
+		err = fmt.Errorf("got %d from %q %s", status, p.RedeemURL.String(), body)
 		return
 	}
 
@@ -152,69 +142,221 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 // specified group(s). AdminEmail has to be an administrative email on the domain that is
 // checked. CredentialsFile is the path to a json file containing a Google service
 // account credentials.
-func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
-	adminService := getAdminService(adminEmail, credentialsReader)
+func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) error {
+	adminService, err := getAdminService(p.clientContext(context.Background()), adminEmail, credentialsReader)
+	if err != nil {
+		return err
+	}
+	p.setAdminService(groups, adminService)
+	return nil
+}
+
+// SetGroupRestrictionADC is like SetGroupRestriction, but uses the Application
+// Default Credentials, e.g. of the GCE/GKE workload identity. The service
+// account then needs an admin role which can read groups. If adminEmail is
+// given, the credentials must instead be a service account key with
+// domain-wide delegation.
+func (p *GoogleProvider) SetGroupRestrictionADC(groups []string, adminEmail string) error {
+	ctx := p.clientContext(context.Background())
+	creds, err := google.FindDefaultCredentials(ctx, googleAdminScopes...)
+	if err != nil {
+		return err
+	}
+	ts := creds.TokenSource
+	if adminEmail != "" {
+		conf, err := google.JWTConfigFromJSON(creds.JSON, googleAdminScopes...)
+		if err != nil {
+			return fmt.Errorf("google-admin-email requires service account default credentials: %s", err)
+		}
+		conf.Subject = adminEmail
+		ts = conf.TokenSource(ctx)
+	}
+	adminService, err := admin.New(oauth2.NewClient(ctx, ts))
+	if err != nil {
+		return err
+	}
+	p.setAdminService(groups, adminService)
+	return nil
+}
+
+// SetGroupRestrictionTokenFile is like SetGroupRestriction, but uses an access
+// token read from a file, which is re-read periodically so that it can be
+// replaced by an external process before it expires
+func (p *GoogleProvider) SetGroupRestrictionTokenFile(groups []string, path string) error {
+	src := &tokenFileSource{path: path, interval: googleAccessTokenFileInterval}
+	token, err := src.Token()
+	if err != nil {
+		return err
+	}
+	ts := oauth2.ReuseTokenSource(token, src)
+	adminService, err := admin.New(oauth2.NewClient(p.clientContext(context.Background()), ts))
+	if err != nil {
+		return err
+	}
+	p.setAdminService(groups, adminService)
+	return nil
+}
+
+func (p *GoogleProvider) setAdminService(groups []string, adminService *admin.Service) {
+	p.groupLookup = func(ctx context.Context, email string) ([]string, error) {
+		return p.userGroups(ctx, adminService, groups, email)
+	}
 	p.GroupValidator = func(email string) bool {
-		return userInGroup(adminService, groups, email)
+		found, err := p.groupLookup(context.Background(), email)
+		if err != nil {
+			log.Printf("error checking the groups of %s: %s", email, err)
+		}
+		return len(found) > 0
 	}
 }
 
-func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
+var googleAdminScopes = []string{admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope}
+
+func getAdminService(ctx context.Context, adminEmail string, credentialsReader io.Reader) (*admin.Service, error) {
 	data, err := ioutil.ReadAll(credentialsReader)
 	if err != nil {
-		log.Fatal("can't read Google credentials file:", err)
+		return nil, fmt.Errorf("can't read Google credentials file: %s", err)
 	}
-	conf, err := google.JWTConfigFromJSON(data, admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
+	conf, err := google.JWTConfigFromJSON(data, googleAdminScopes...)
 	if err != nil {
-		log.Fatal("can't load Google credentials file:", err)
+		return nil, fmt.Errorf("can't load Google credentials file: %s", err)
 	}
 	conf.Subject = adminEmail
 
-	client := conf.Client(oauth2.NoContext)
-	adminService, err := admin.New(client)
+	client := conf.Client(ctx)
+	return admin.New(client)
+}
+
+// googleAccessTokenFileInterval is how often an access token file is re-read
+const googleAccessTokenFileInterval = time.Minute
+
+// tokenFileSource is an oauth2.TokenSource which reads the access token from
+// a file. Each token is treated as expiring after interval, so that wrapped in
+// an oauth2.ReuseTokenSource the file is re-read about that often.
+type tokenFileSource struct {
+	path     string
+	interval time.Duration
+}
+
+func (s *tokenFileSource) Token() (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(s.path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("no access token in %s", s.path)
 	}
-	return adminService
+	return &oauth2.Token{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(s.interval),
+	}, nil
 }
 
-func userInGroup(service *admin.Service, groups []string, email string) bool {
-	for _, allowedgroup := range groups {
-		resp, err := service.Members.HasMember(allowedgroup, email).Do()
+// SetGroupCache caches group membership lookups, positive results for ttl and
+// negative results for negativeTTL (0 disables each). If staleTTL is set,
+// results up to staleTTL past expiry are used when the Directory API fails.
+func (p *GoogleProvider) SetGroupCache(ttl, negativeTTL, staleTTL time.Duration) {
+	p.cache = newMembershipCache(ttl, negativeTTL, staleTTL)
+}
+
+// userGroups returns those of the groups which email is a member of. An
+// error looking up one group is only returned if no other group allows the
+// user.
+func (p *GoogleProvider) userGroups(ctx context.Context, service *admin.Service, groups []string, email string) ([]string, error) {
+	defer p.logCacheStats()
 
+	var found []string
+	var lookupErr error
+	for _, allowedgroup := range groups {
+		isMember, err := p.hasMember(ctx, service, allowedgroup, email)
 		if err != nil {
 			log.Printf("Error calling service.Members.HasMember(%s, %s): %s", allowedgroup, email, err)
-			return false
+			lookupErr = fmt.Errorf("checking group %s: %w", allowedgroup, err)
+			continue
 		}
 
-		if resp.IsMember {
-			log.Printf("%s is a member of %s, authorized", email, allowedgroup)
-			return true
+		if isMember {
+			found = append(found, allowedgroup)
 		}
 	}
+	if len(found) > 0 {
+		log.Printf("%s is a member of %s, authorized", email, strings.Join(found, ", "))
+		return found, nil
+	}
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
 
 	log.Printf("%s not found in any allowed groups", email)
-	return false
+	return nil, nil
+}
+
+func (p *GoogleProvider) hasMember(ctx context.Context, service *admin.Service, group, email string) (bool, error) {
+	key := "group:" + group + ":" + email
+	if member, ok := p.cache.get(key); ok {
+		return member, nil
+	}
+
+	resp, err := service.Members.HasMember(group, email).Context(ctx).Do()
+	if err != nil {
+		if member, ok := p.cache.getStale(key); ok {
+			log.Printf("Error calling service.Members.HasMember(%s, %s): %s - using stale cached result", group, email, err)
+			return member, nil
+		}
+		return false, err
+	}
+	p.cache.set(key, resp.IsMember)
+	return resp.IsMember, nil
+}
+
+func (p *GoogleProvider) logCacheStats() {
+	if p.cache == nil {
+		return
+	}
+	hits, misses, staleHits := p.cache.stats()
+	log.Printf("google group cache: %d hits, %d misses, %d stale hits", hits, misses, staleHits)
 }
 
-// ValidateGroup validates that the provided email exists in the configured Google
-// group(s).
-func (p *GoogleProvider) ValidateGroup(email string) bool {
-	return p.GroupValidator(email)
+// ValidateGroup validates that the session email exists in the configured Google
+// group(s), and sets the session groups to those the user is in.
+func (p *GoogleProvider) ValidateGroup(ctx context.Context, s *SessionState) bool {
+	ok, err := p.validateGroup(ctx, s)
+	if err != nil {
+		log.Printf("error checking the groups of %s: %s", s.Email, err)
+	}
+	return ok
+}
+
+// validateGroup is ValidateGroup, but returns the error if the Directory API
+// could not be checked, so that an outage is not taken for a removed member
+func (p *GoogleProvider) validateGroup(ctx context.Context, s *SessionState) (bool, error) {
+	if p.groupLookup == nil {
+		return p.GroupValidator(s.Email), nil
+	}
+	found, err := p.groupLookup(ctx, s.Email)
+	if len(found) == 0 {
+		return false, err
+	}
+	s.Groups = found
+	return true, nil
 }
 
-func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+func (p *GoogleProvider) RefreshSessionIfNeeded(ctx context.Context, s *SessionState) (bool, error) {
 	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
 		return false, nil
 	}
 
-	newToken, duration, err := p.redeemRefreshToken(s.RefreshToken)
+	newToken, duration, err := p.redeemRefreshToken(ctx, s.RefreshToken)
 	if err != nil {
 		return false, err
 	}
 
 	// re-check that the user is in the proper google group(s)
-	if !p.ValidateGroup(s.Email) {
+	if ok, err := p.validateGroup(ctx, s); err != nil {
+		return false, fmt.Errorf("checking the group(s) of %s: %w", s.Email, err)
+	} else if !ok {
 		return false, fmt.Errorf("%s is no longer in the group(s)", s.Email)
 	}
 
@@ -225,33 +367,19 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 	return true, nil
 }
 
-func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string, expires time.Duration, err error) {
+func (p *GoogleProvider) redeemRefreshToken(ctx context.Context, refreshToken string) (token string, expires time.Duration, err error) {
 	// https://developers.google.com/identity/protocols/OAuth2WebServer#refresh
 	params := url.Values{}
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
 	params.Add("refresh_token", refreshToken)
 	params.Add("grant_type", "refresh_token")
-	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
-	if err != nil {
-		return
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return
-	}
+	var status int
 	var body []byte
-	body, err = ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	status, body, err = p.postToken(ctx, p.RedeemURL, params)
 	if err != nil {
 		return
 	}
-
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	if status != 200 {
+		err = newStatusError(status, p.RedeemURL, body)
 		return
 	}
 
@@ -1,14 +1,21 @@
 package providers
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	admin "google.golang.org/api/admin/directory/v1"
 )
 
 func newRedeemServer(body []byte) (*url.URL, *httptest.Server) {
@@ -97,7 +104,7 @@ func TestGoogleProviderGetEmailAddress(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem(context.Background(), "http://redirect/", "code1234")
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, session, nil)
 	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
@@ -110,16 +117,122 @@ func TestGoogleProviderValidateGroup(t *testing.T) {
 	p.GroupValidator = func(email string) bool {
 		return email == "michael.bland@gsa.gov"
 	}
-	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), &SessionState{Email: "michael.bland@gsa.gov"}))
 	p.GroupValidator = func(email string) bool {
 		return email != "michael.bland@gsa.gov"
 	}
-	assert.Equal(t, false, p.ValidateGroup("michael.bland@gsa.gov"))
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), &SessionState{Email: "michael.bland@gsa.gov"}))
 }
 
 func TestGoogleProviderWithoutValidateGroup(t *testing.T) {
 	p := newGoogleProvider()
-	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), &SessionState{Email: "michael.bland@gsa.gov"}))
+}
+
+func TestGoogleProviderGroupCache(t *testing.T) {
+	calls := 0
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if fail {
+			w.WriteHeader(500)
+			return
+		}
+		isMember := strings.HasPrefix(r.URL.Path, "/groups/group1@example.com/hasMember/")
+		fmt.Fprintf(w, `{"isMember": %t}`, isMember)
+	}))
+	defer server.Close()
+	service, _ := admin.New(http.DefaultClient)
+	service.BasePath = server.URL + "/"
+
+	p := newGoogleProvider()
+	p.SetGroupCache(time.Minute, time.Minute, time.Hour)
+	groups := []string{"group2@example.com", "group1@example.com"}
+	email := "michael.bland@gsa.gov"
+
+	member := func() bool {
+		found, err := p.userGroups(context.Background(), service, groups, email)
+		assert.Equal(t, nil, err)
+		return len(found) > 0
+	}
+	assert.Equal(t, true, member())
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, true, member())
+	assert.Equal(t, 2, calls)
+	hits, misses, staleHits := p.cache.stats()
+	assert.Equal(t, []uint64{2, 2, 0}, []uint64{hits, misses, staleHits})
+
+	// expire the entries, and fail lookups: stale results are used
+	for k, e := range p.cache.entries {
+		e.expires = time.Now().Add(-time.Second)
+		p.cache.entries[k] = e
+	}
+	fail = true
+	assert.Equal(t, true, member())
+	hits, misses, staleHits = p.cache.stats()
+	assert.Equal(t, []uint64{2, 4, 2}, []uint64{hits, misses, staleHits})
+
+	// without stale results, failed lookups deny, with an error which shows
+	// that the Directory API is failing rather than that the user was removed
+	p.SetGroupCache(time.Minute, time.Minute, 0)
+	found, err := p.userGroups(context.Background(), service, groups, email)
+	assert.Equal(t, 0, len(found))
+	assert.Equal(t, true, IsUnavailable(err))
+}
+
+func TestGoogleProviderValidateGroupSetsGroups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isMember := !strings.HasPrefix(r.URL.Path, "/groups/group2@example.com/")
+		fmt.Fprintf(w, `{"isMember": %t}`, isMember)
+	}))
+	defer server.Close()
+	service, _ := admin.New(http.DefaultClient)
+	service.BasePath = server.URL + "/"
+
+	p := newGoogleProvider()
+	p.setAdminService([]string{"group1@example.com", "group2@example.com", "group3@example.com"}, service)
+	s := &SessionState{Email: "michael.bland@gsa.gov"}
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), s))
+	assert.Equal(t, []string{"group1@example.com", "group3@example.com"}, s.Groups)
+}
+
+func TestGoogleTokenFileSource(t *testing.T) {
+	f, _ := ioutil.TempFile("", "google_access_token")
+	defer os.Remove(f.Name())
+	f.WriteString("token1\n")
+	f.Close()
+
+	src := &tokenFileSource{path: f.Name(), interval: time.Minute}
+	token, err := src.Token()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "token1", token.AccessToken)
+	assert.True(t, token.Expiry.After(time.Now()))
+
+	ioutil.WriteFile(f.Name(), []byte("token2"), 0600)
+	token, err = src.Token()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "token2", token.AccessToken)
+
+	ioutil.WriteFile(f.Name(), []byte(""), 0600)
+	_, err = src.Token()
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGoogleProviderSetGroupRestrictionADC(t *testing.T) {
+	f, _ := ioutil.TempFile("", "google_adc")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "refresh"}`)
+	f.Close()
+	orig := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", orig)
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", f.Name())
+
+	p := newGoogleProvider()
+	assert.Equal(t, nil, p.SetGroupRestrictionADC([]string{"group1@example.com"}, ""))
+
+	// impersonating an admin needs service account credentials
+	err := p.SetGroupRestrictionADC([]string{"group1@example.com"}, "admin@example.com")
+	assert.NotEqual(t, nil, err)
 }
 
 //
@@ -134,7 +247,7 @@ func TestGoogleProviderGetEmailAddressInvalidEncoding(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem(context.Background(), "http://redirect/", "code1234")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
@@ -153,7 +266,7 @@ func TestGoogleProviderGetEmailAddressInvalidJson(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem(context.Background(), "http://redirect/", "code1234")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
@@ -172,7 +285,7 @@ func TestGoogleProviderGetEmailAddressEmailMissing(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem(context.Background(), "http://redirect/", "code1234")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
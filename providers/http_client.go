@@ -0,0 +1,148 @@
+package providers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/ploxiln/oauth2_proxy/cookie"
+)
+
+// HTTPClientConfig configures the client for requests to the provider
+type HTTPClientConfig struct {
+	// ConnectTimeout limits establishing the connection (including the TLS
+	// handshake), ResponseTimeout limits the whole request
+	ConnectTimeout  time.Duration
+	ResponseTimeout time.Duration
+	// CAFiles are PEM bundles of certificate authorities to trust, instead
+	// of the system roots
+	CAFiles            []string
+	InsecureSkipVerify bool
+	// ProxyURL is the outbound proxy; if nil, the HTTP_PROXY / HTTPS_PROXY /
+	// NO_PROXY environment variables are used
+	ProxyURL *url.URL
+	// RequestIDHeader, if set, is the header in which the id of the request
+	// being handled (see WithRequestID), or else a new unique id, is sent with
+	// each request, so that the provider's logs can be correlated
+	RequestIDHeader string
+	// Certificates are presented if the server requests a client certificate
+	Certificates []tls.Certificate
+	// Retries is how many times idempotent requests are retried after a
+	// connection error, timeout or 5xx response, with a random delay of up
+	// to RetryBackoff, doubled after each attempt
+	Retries      int
+	RetryBackoff time.Duration
+	// Breaker, if not nil, fails requests to endpoints which keep failing
+	Breaker *CircuitBreaker
+}
+
+// NewHTTPClient returns a client configured like http.DefaultClient, except
+// as specified by c
+func NewHTTPClient(c HTTPClientConfig) (*http.Client, error) {
+	defaultTransport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("DefaultTransport is unexpected type")
+	}
+	transport := defaultTransport.Clone()
+	if c.ConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: c.ConnectTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = c.ConnectTimeout
+	}
+	if c.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(c.ProxyURL)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		Certificates:       c.Certificates,
+	}
+	if len(c.CAFiles) > 0 {
+		pool := x509.NewCertPool()
+		for _, file := range c.CAFiles {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no PEM encoded certificates found in %s", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	var rt http.RoundTripper = transport
+	if c.Retries > 0 || c.Breaker != nil {
+		rt = &retryTransport{
+			retries: c.Retries,
+			backoff: c.RetryBackoff,
+			breaker: c.Breaker,
+			next:    rt,
+		}
+	}
+	if c.RequestIDHeader != "" {
+		rt = &requestIDTransport{header: c.RequestIDHeader, next: rt}
+	}
+	return &http.Client{Transport: rt, Timeout: c.ResponseTimeout}, nil
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx with the request id, which is sent with
+// the requests to the provider made with that context
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request id set with WithRequestID, or ""
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDTransport sets the request id of the request's context, or a new
+// unique id, in header, for requests which do not already have one
+type requestIDTransport struct {
+	header string
+	next   http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(t.header) == "" {
+		id := RequestIDFromContext(req.Context())
+		if id == "" {
+			var err error
+			if id, err = cookie.Nonce(); err != nil {
+				return nil, err
+			}
+		}
+		// a RoundTripper must not modify the request
+		req = req.Clone(req.Context())
+		req.Header.Set(t.header, id)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// httpClient returns the client for requests to the provider
+func (p *ProviderData) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// clientContext returns ctx for the oauth2 and go-oidc libraries, which make
+// requests with the provider's client
+func (p *ProviderData) clientContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, p.httpClient())
+}
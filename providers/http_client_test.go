@@ -0,0 +1,108 @@
+package providers
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPClientCAFiles(t *testing.T) {
+	b := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer b.Close()
+
+	client, err := NewHTTPClient(HTTPClientConfig{})
+	assert.Equal(t, nil, err)
+	_, err = client.Get(b.URL)
+	assert.NotEqual(t, nil, err)
+
+	dir, err := ioutil.TempDir("", "http_client_test")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b.Certificate().Raw}), 0600)
+
+	client, err = NewHTTPClient(HTTPClientConfig{CAFiles: []string{caFile}})
+	assert.Equal(t, nil, err)
+	resp, err := client.Get(b.URL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	client, err = NewHTTPClient(HTTPClientConfig{InsecureSkipVerify: true})
+	assert.Equal(t, nil, err)
+	resp, err = client.Get(b.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+
+	ioutil.WriteFile(caFile, []byte("not a certificate"), 0600)
+	_, err = NewHTTPClient(HTTPClientConfig{CAFiles: []string{caFile}})
+	assert.NotEqual(t, nil, err)
+	_, err = NewHTTPClient(HTTPClientConfig{CAFiles: []string{filepath.Join(dir, "missing.crt")}})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestHTTPClientResponseTimeout(t *testing.T) {
+	done := make(chan struct{})
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer b.Close()
+	defer close(done)
+
+	client, err := NewHTTPClient(HTTPClientConfig{ResponseTimeout: 50 * time.Millisecond})
+	assert.Equal(t, nil, err)
+	_, err = client.Get(b.URL)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestHTTPClientProxyAndRequestID(t *testing.T) {
+	var ids []string
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("X-Request-Id"))
+		hosts = append(hosts, r.URL.Host)
+		w.Write([]byte("ok"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client, err := NewHTTPClient(HTTPClientConfig{ProxyURL: proxyURL, RequestIDHeader: "X-Request-Id"})
+	assert.Equal(t, nil, err)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://provider.example.com/userinfo")
+		assert.Equal(t, nil, err)
+		resp.Body.Close()
+	}
+	req, _ := http.NewRequest("GET", "http://provider.example.com/userinfo", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	resp, err := client.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	// the id of the request being handled is sent
+	ctx := WithRequestID(context.Background(), "inbound123")
+	req, _ = http.NewRequestWithContext(ctx, "GET", "http://provider.example.com/userinfo", nil)
+	resp, err = client.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"provider.example.com", "provider.example.com", "provider.example.com", "provider.example.com"}, hosts)
+	assert.Equal(t, 4, len(ids))
+	assert.NotEqual(t, "", ids[0])
+	assert.NotEqual(t, ids[0], ids[1])
+	assert.Equal(t, "abc123", ids[2])
+	assert.Equal(t, "inbound123", ids[3])
+}
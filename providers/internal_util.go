@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -45,21 +48,33 @@ func stripParam(param, endpoint string) string {
 	return endpoint
 }
 
-// validateToken returns true if token is valid
-func validateToken(p Provider, access_token string, header http.Header) bool {
-	if access_token == "" || p.Data().ValidateURL == nil {
-		return false
+// validateToken returns nil if token is valid
+func validateToken(ctx context.Context, p Provider, access_token string, header http.Header) error {
+	if access_token == "" {
+		return errors.New("no access token")
+	}
+	if p.Data().ValidateURL == nil {
+		return errors.New("no validate url")
 	}
 	endpoint := p.Data().ValidateURL.String()
 	if len(header) == 0 {
 		params := url.Values{"access_token": {access_token}}
 		endpoint = endpoint + "?" + params.Encode()
 	}
-	resp, err := api.RequestUnparsedResponse(endpoint, header)
+	return validateTokenURL(ctx, p.Data().httpClient(), endpoint, access_token, header)
+}
+
+// validateTokenURL returns nil if a request to endpoint succeeds
+func validateTokenURL(ctx context.Context, client *http.Client, endpoint string, access_token string, header http.Header) error {
+	resp, err := api.RequestUnparsedResponse(ctx, client, endpoint, header)
 	if err != nil {
+		// the error has the endpoint, which may have the token
+		if urlErr, ok := err.(*url.Error); ok {
+			err = &url.Error{Op: urlErr.Op, URL: stripToken(urlErr.URL), Err: urlErr.Err}
+		}
 		log.Printf("GET %s", stripToken(endpoint))
 		log.Printf("token validation request failed: %s", err)
-		return false
+		return fmt.Errorf("token validation request failed: %w", err)
 	}
 
 	body, _ := ioutil.ReadAll(resp.Body)
@@ -67,10 +82,10 @@ func validateToken(p Provider, access_token string, header http.Header) bool {
 	log.Printf("%d GET %s %s", resp.StatusCode, stripToken(endpoint), body)
 
 	if resp.StatusCode == 200 {
-		return true
+		return nil
 	}
 	log.Printf("token validation request failed: status %d - %s", resp.StatusCode, body)
-	return false
+	return &StatusError{resp.StatusCode, stripToken(endpoint), body}
 }
 
 func updateURL(url *url.URL, hostname string) {
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -14,14 +15,14 @@ type ValidateSessionStateTestProvider struct {
 	*ProviderData
 }
 
-func (tp *ValidateSessionStateTestProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (tp *ValidateSessionStateTestProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	return "", errors.New("not implemented")
 }
 
 // Note that we're testing the internal validateToken() used to implement
 // several Provider's ValidateSessionState() implementations
-func (tp *ValidateSessionStateTestProvider) ValidateSessionState(s *SessionState) bool {
-	return false
+func (tp *ValidateSessionStateTestProvider) ValidateSessionState(ctx context.Context, s *SessionState) error {
+	return errors.New("not implemented")
 }
 
 type ValidateSessionStateTest struct {
@@ -81,7 +82,7 @@ func (vt_test *ValidateSessionStateTest) Close() {
 func TestValidateSessionStateValidToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
-	assert.Equal(t, true, validateToken(vt_test.provider, "foobar", nil))
+	assert.Equal(t, nil, validateToken(context.Background(), vt_test.provider, "foobar", nil))
 }
 
 func TestValidateSessionStateValidTokenWithHeaders(t *testing.T) {
@@ -89,35 +90,51 @@ func TestValidateSessionStateValidTokenWithHeaders(t *testing.T) {
 	defer vt_test.Close()
 	vt_test.header = make(http.Header)
 	vt_test.header.Set("Authorization", "Bearer foobar")
-	assert.Equal(t, true,
-		validateToken(vt_test.provider, "foobar", vt_test.header))
+	assert.Equal(t, nil,
+		validateToken(context.Background(), vt_test.provider, "foobar", vt_test.header))
 }
 
 func TestValidateSessionStateEmptyToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
-	assert.Equal(t, false, validateToken(vt_test.provider, "", nil))
+	assert.NotEqual(t, nil, validateToken(context.Background(), vt_test.provider, "", nil))
 }
 
 func TestValidateSessionStateEmptyValidateURL(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
 	vt_test.provider.Data().ValidateURL = nil
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	assert.NotEqual(t, nil, validateToken(context.Background(), vt_test.provider, "foobar", nil))
 }
 
 func TestValidateSessionStateRequestNetworkFailure(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	// Close immediately to simulate a network failure
 	vt_test.Close()
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	err := validateToken(context.Background(), vt_test.provider, "foobar", nil)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, IsUnavailable(err))
+	// the error is logged, so it must not have the token
+	assert.NotContains(t, err.Error(), "foobar")
+	assert.Contains(t, err.Error(), "access_token=foo...")
 }
 
 func TestValidateSessionStateExpiredToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
 	vt_test.response_code = 401
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	err := validateToken(context.Background(), vt_test.provider, "foobar", nil)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, IsUnavailable(err))
+}
+
+func TestValidateSessionStateServerError(t *testing.T) {
+	vt_test := NewValidateSessionStateTest()
+	defer vt_test.Close()
+	vt_test.response_code = 503
+	err := validateToken(context.Background(), vt_test.provider, "foobar", nil)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, IsUnavailable(err))
 }
 
 func TestStripTokenNotPresent(t *testing.T) {
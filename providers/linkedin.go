@@ -1,16 +1,28 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 
+	"github.com/bitly/go-simplejson"
+	oidc "github.com/coreos/go-oidc"
 	"github.com/ploxiln/oauth2_proxy/api"
 )
 
+// "Sign In with LinkedIn using OpenID Connect"
+// https://learn.microsoft.com/en-us/linkedin/consumer/integrations/self-serve/sign-in-with-linkedin-v2
+const (
+	linkedInIssuerURL = "https://www.linkedin.com/oauth"
+	linkedInJwksURL   = "https://www.linkedin.com/oauth/openid/jwks"
+)
+
 type LinkedInProvider struct {
 	*ProviderData
+
+	Verifier *oidc.IDTokenVerifier
 }
 
 func NewLinkedInProvider(p *ProviderData) *LinkedInProvider {
@@ -18,57 +30,120 @@ func NewLinkedInProvider(p *ProviderData) *LinkedInProvider {
 	if p.LoginURL.String() == "" {
 		p.LoginURL = &url.URL{Scheme: "https",
 			Host: "www.linkedin.com",
-			Path: "/uas/oauth2/authorization"}
+			Path: "/oauth/v2/authorization"}
 	}
 	if p.RedeemURL.String() == "" {
 		p.RedeemURL = &url.URL{Scheme: "https",
 			Host: "www.linkedin.com",
-			Path: "/uas/oauth2/accessToken"}
+			Path: "/oauth/v2/accessToken"}
 	}
 	if p.ProfileURL.String() == "" {
 		p.ProfileURL = &url.URL{Scheme: "https",
-			Host: "www.linkedin.com",
-			Path: "/v1/people/~/email-address"}
+			Host: "api.linkedin.com",
+			Path: "/v2/userinfo"}
 	}
 	if p.ValidateURL.String() == "" {
 		p.ValidateURL = p.ProfileURL
 	}
 	if p.Scope == "" {
-		p.Scope = "r_emailaddress r_basicprofile"
+		p.Scope = "openid profile email"
 	}
-	return &LinkedInProvider{ProviderData: p}
+	linkedInProvider := &LinkedInProvider{ProviderData: p}
+	linkedInProvider.SetVerifier(linkedInIssuerURL, linkedInJwksURL)
+	return linkedInProvider
+}
+
+// SetVerifier configures verification of id_tokens from the issuer, signed
+// by the keys published at jwksURL
+func (p *LinkedInProvider) SetVerifier(issuerURL string, jwksURL string) {
+	keySet := oidc.NewRemoteKeySet(p.clientContext(context.Background()), jwksURL)
+	p.Verifier = oidc.NewVerifier(issuerURL, keySet, &oidc.Config{
+		ClientID: p.ClientID,
+	})
 }
 
 func getLinkedInHeader(access_token string) http.Header {
 	header := make(http.Header)
 	header.Set("Accept", "application/json")
-	header.Set("x-li-format", "json")
 	header.Set("Authorization", fmt.Sprintf("Bearer %s", access_token))
 	return header
 }
 
-func (p *LinkedInProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (p *LinkedInProvider) Redeem(ctx context.Context, redirectURL, code string) (*SessionState, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	token, err := p.redeemToken(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange: %v", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("token response did not contain an id_token")
+	}
+	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("could not verify id_token: %v", err)
+	}
+
+	var claims struct {
+		Subject  string `json:"sub"`
+		Email    string `json:"email"`
+		Verified *bool  `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
+	}
+	if claims.Verified != nil && !*claims.Verified {
+		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
+	}
+
+	return &SessionState{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresOn:    token.Expiry,
+		Email:        claims.Email,
+		User:         claims.Subject,
+	}, nil
+}
+
+// userInfo requests the OpenID Connect userinfo endpoint, for sessions where
+// the id_token did not have the email claim
+func (p *LinkedInProvider) userInfo(ctx context.Context, s *SessionState) (*simplejson.Json, error) {
 	if s.AccessToken == "" {
-		return "", errors.New("missing access token")
+		return nil, errors.New("missing access token")
 	}
-	req, err := http.NewRequest("GET", p.ProfileURL.String()+"?format=json", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", p.ProfileURL.String(), nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	req.Header = getLinkedInHeader(s.AccessToken)
+	return api.Request(p.httpClient(), req)
+}
 
-	json, err := api.Request(req)
+func (p *LinkedInProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
+	json, err := p.userInfo(ctx, s)
 	if err != nil {
 		return "", err
 	}
+	return json.Get("email").String()
+}
 
-	email, err := json.String()
+// GetUserName returns the member's unique id (the "sub" claim), which unlike
+// their name can not be changed by them or shared with another member
+func (p *LinkedInProvider) GetUserName(ctx context.Context, s *SessionState) (string, error) {
+	json, err := p.userInfo(ctx, s)
 	if err != nil {
 		return "", err
 	}
-	return email, nil
+	return json.Get("sub").String()
 }
 
-func (p *LinkedInProvider) ValidateSessionState(s *SessionState) bool {
-	return validateToken(p, s.AccessToken, getLinkedInHeader(s.AccessToken))
+func (p *LinkedInProvider) ValidateSessionState(ctx context.Context, s *SessionState) error {
+	return validateToken(ctx, p, s.AccessToken, getLinkedInHeader(s.AccessToken))
 }
@@ -1,12 +1,18 @@
 package providers
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
 )
 
 func testLinkedInProvider(hostname string) *LinkedInProvider {
@@ -27,7 +33,7 @@ func testLinkedInProvider(hostname string) *LinkedInProvider {
 }
 
 func testLinkedInBackend(payload string) *httptest.Server {
-	path := "/v1/people/~/email-address"
+	path := "/v2/userinfo"
 
 	return httptest.NewServer(http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -43,19 +49,56 @@ func testLinkedInBackend(payload string) *httptest.Server {
 		}))
 }
 
+// testLinkedInOIDCBackend serves the token endpoint, returning an id_token
+// with the claims signed by key, and the key set to verify it
+func testLinkedInOIDCBackend(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) *httptest.Server {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	assert.Equal(t, nil, err)
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	assert.Equal(t, nil, err)
+	idToken, err := jws.CompactSerialize()
+	assert.Equal(t, nil, err)
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/oauth/v2/accessToken":
+				r.ParseForm()
+				if r.Form.Get("code") != "imaginary_code" {
+					w.WriteHeader(400)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"access_token": "imaginary_access_token",
+					"expires_in":   5184000,
+					"id_token":     idToken,
+				})
+			case "/oauth/openid/jwks":
+				json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+					{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+				}})
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
 func TestLinkedInProviderDefaults(t *testing.T) {
 	p := testLinkedInProvider("")
 	assert.NotEqual(t, nil, p)
 	assert.Equal(t, "LinkedIn", p.Data().ProviderName)
-	assert.Equal(t, "https://www.linkedin.com/uas/oauth2/authorization",
+	assert.Equal(t, "https://www.linkedin.com/oauth/v2/authorization",
 		p.Data().LoginURL.String())
-	assert.Equal(t, "https://www.linkedin.com/uas/oauth2/accessToken",
+	assert.Equal(t, "https://www.linkedin.com/oauth/v2/accessToken",
 		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://www.linkedin.com/v1/people/~/email-address",
+	assert.Equal(t, "https://api.linkedin.com/v2/userinfo",
 		p.Data().ProfileURL.String())
-	assert.Equal(t, "https://www.linkedin.com/v1/people/~/email-address",
+	assert.Equal(t, "https://api.linkedin.com/v2/userinfo",
 		p.Data().ValidateURL.String())
-	assert.Equal(t, "r_emailaddress r_basicprofile", p.Data().Scope)
+	assert.Equal(t, "openid profile email", p.Data().Scope)
 }
 
 func TestLinkedInProviderOverrides(t *testing.T) {
@@ -92,16 +135,20 @@ func TestLinkedInProviderOverrides(t *testing.T) {
 }
 
 func TestLinkedInProviderGetEmailAddress(t *testing.T) {
-	b := testLinkedInBackend(`"user@linkedin.com"`)
+	b := testLinkedInBackend(`{"sub": "782bbtaQ", "name": "John Doe", "email": "user@linkedin.com"}`)
 	defer b.Close()
 
 	b_url, _ := url.Parse(b.URL)
 	p := testLinkedInProvider(b_url.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "user@linkedin.com", email)
+
+	user, err := p.GetUserName(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "782bbtaQ", user)
 }
 
 func TestLinkedInProviderGetEmailAddressFailedRequest(t *testing.T) {
@@ -115,7 +162,7 @@ func TestLinkedInProviderGetEmailAddressFailedRequest(t *testing.T) {
 	// token. Alternatively, we could allow the parsing of the payload as
 	// JSON to fail.
 	session := &SessionState{AccessToken: "unexpected_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
@@ -128,7 +175,64 @@ func TestLinkedInProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
 	p := testLinkedInProvider(b_url.Host)
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	email, err := p.GetEmailAddress(context.Background(), session)
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
+
+func TestLinkedInProviderRedeem(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	claims := map[string]interface{}{
+		"iss":            "https://www.linkedin.com/oauth",
+		"aud":            "client-id",
+		"sub":            "782bbtaQ",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"name":           "John Doe",
+		"email":          "user@linkedin.com",
+		"email_verified": true,
+	}
+	b := testLinkedInOIDCBackend(t, key, claims)
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testLinkedInProvider(b_url.Host)
+	p.ClientID = "client-id"
+	p.SetVerifier("https://www.linkedin.com/oauth", b.URL+"/oauth/openid/jwks")
+
+	session, err := p.Redeem(context.Background(), "https://example.com/oauth2/callback", "imaginary_code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "imaginary_access_token", session.AccessToken)
+	assert.Equal(t, "user@linkedin.com", session.Email)
+	assert.Equal(t, "782bbtaQ", session.User)
+	assert.Equal(t, false, session.ExpiresOn.IsZero())
+
+	// the id_token must be for this client
+	p.ClientID = "other-client-id"
+	p.SetVerifier("https://www.linkedin.com/oauth", b.URL+"/oauth/openid/jwks")
+	_, err = p.Redeem(context.Background(), "https://example.com/oauth2/callback", "imaginary_code")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestLinkedInProviderRedeemUnverifiedEmail(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	claims := map[string]interface{}{
+		"iss":            "https://www.linkedin.com/oauth",
+		"aud":            "client-id",
+		"sub":            "782bbtaQ",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"email":          "user@linkedin.com",
+		"email_verified": false,
+	}
+	b := testLinkedInOIDCBackend(t, key, claims)
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testLinkedInProvider(b_url.Host)
+	p.ClientID = "client-id"
+	p.SetVerifier("https://www.linkedin.com/oauth", b.URL+"/oauth/openid/jwks")
+
+	_, err = p.Redeem(context.Background(), "https://example.com/oauth2/callback", "imaginary_code")
+	assert.Equal(t, "email in id_token (user@linkedin.com) isn't verified", err.Error())
+}
@@ -0,0 +1,111 @@
+package providers
+
+import (
+	"sync"
+	"time"
+)
+
+// membershipCache remembers the results of group/org/team membership lookups
+// for a while, to avoid repeating provider API calls on every login and
+// refresh. Positive and negative results can be kept for different durations,
+// and expired results can be kept for staleTTL longer, for use when the
+// provider API fails. A nil *membershipCache is valid and caches nothing.
+type membershipCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	staleTTL    time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]membershipCacheEntry
+	lastPurge time.Time
+
+	hits      uint64
+	misses    uint64
+	staleHits uint64
+}
+
+type membershipCacheEntry struct {
+	member  bool
+	expires time.Time
+}
+
+// newMembershipCache returns nil (no caching) when both ttls are zero
+func newMembershipCache(ttl, negativeTTL, staleTTL time.Duration) *membershipCache {
+	if ttl <= 0 && negativeTTL <= 0 {
+		return nil
+	}
+	return &membershipCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		staleTTL:    staleTTL,
+		entries:     make(map[string]membershipCacheEntry),
+	}
+}
+
+// get returns the cached result for key, and whether it was present and fresh
+func (c *membershipCache) get(key string) (member bool, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.entries[key]
+	if !found || time.Now().After(e.expires) {
+		c.misses++
+		return false, false
+	}
+	c.hits++
+	return e.member, true
+}
+
+// getStale returns the cached result for key even if it has expired, as long
+// as it is within staleTTL of expiring, for use when a fresh lookup failed
+func (c *membershipCache) getStale(key string) (member bool, ok bool) {
+	if c == nil || c.staleTTL <= 0 {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.entries[key]
+	if !found || time.Now().After(e.expires.Add(c.staleTTL)) {
+		return false, false
+	}
+	c.staleHits++
+	return e.member, true
+}
+
+// stats returns the number of fresh hits, misses, and stale hits so far
+func (c *membershipCache) stats() (hits, misses, staleHits uint64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.staleHits
+}
+
+func (c *membershipCache) set(key string, member bool) {
+	if c == nil {
+		return
+	}
+	ttl := c.ttl
+	if !member {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = membershipCacheEntry{member: member, expires: now.Add(ttl)}
+	if now.Sub(c.lastPurge) > ttl {
+		for k, e := range c.entries {
+			if now.After(e.expires.Add(c.staleTTL)) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastPurge = now
+	}
+}
@@ -0,0 +1,58 @@
+package providers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembershipCacheDisabled(t *testing.T) {
+	c := newMembershipCache(0, 0, time.Hour)
+	assert.Nil(t, c)
+	c.set("key", true)
+	_, ok := c.get("key")
+	assert.Equal(t, false, ok)
+	_, ok = c.getStale("key")
+	assert.Equal(t, false, ok)
+}
+
+func TestMembershipCacheNegativeTTL(t *testing.T) {
+	c := newMembershipCache(time.Minute, 0, 0)
+	c.set("yes", true)
+	c.set("no", false)
+
+	member, ok := c.get("yes")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, member)
+	_, ok = c.get("no")
+	assert.Equal(t, false, ok)
+
+	hits, misses, _ := c.stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(1), misses)
+}
+
+func TestMembershipCacheStale(t *testing.T) {
+	c := newMembershipCache(time.Minute, time.Minute, time.Hour)
+	c.set("recent", true)
+	c.set("old", true)
+	c.entries["recent"] = membershipCacheEntry{member: true, expires: time.Now().Add(-time.Minute)}
+	c.entries["old"] = membershipCacheEntry{member: true, expires: time.Now().Add(-2 * time.Hour)}
+
+	_, ok := c.get("recent")
+	assert.Equal(t, false, ok)
+	member, ok := c.getStale("recent")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, member)
+	_, ok = c.getStale("old")
+	assert.Equal(t, false, ok)
+
+	// purging keeps entries which may still be used stale
+	c.lastPurge = time.Time{}
+	c.set("new", false)
+	_, ok = c.entries["recent"]
+	assert.Equal(t, true, ok)
+	_, ok = c.entries["old"]
+	assert.Equal(t, false, ok)
+}
@@ -23,7 +23,7 @@ func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 }
 
 func (p *OIDCProvider) SetIssuerURL(issuerURL string) error {
-	provider, err := oidc.NewProvider(context.Background(), issuerURL)
+	provider, err := oidc.NewProvider(p.clientContext(context.Background()), issuerURL)
 	if err != nil {
 		return fmt.Errorf("error looking up issuer-url=%q %s", issuerURL, err)
 	}
@@ -45,23 +45,18 @@ func (p *OIDCProvider) SetIssuerURL(issuerURL string) error {
 }
 
 func (p *OIDCProvider) SetVerifier(issuerURL string, jwksURL string) {
-	keySet := oidc.NewRemoteKeySet(context.Background(), jwksURL)
+	keySet := oidc.NewRemoteKeySet(p.clientContext(context.Background()), jwksURL)
 	p.Verifier = oidc.NewVerifier(issuerURL, keySet, &oidc.Config{
 		ClientID: p.ClientID,
 	})
 }
 
-func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err error) {
-	ctx := context.Background()
-	c := oauth2.Config{
-		ClientID:     p.ClientID,
-		ClientSecret: p.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			TokenURL: p.RedeemURL.String(),
-		},
-		RedirectURL: redirectURL,
-	}
-	token, err := c.Exchange(ctx, code)
+func (p *OIDCProvider) Redeem(ctx context.Context, redirectURL, code string) (s *SessionState, err error) {
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	token, err := p.redeemToken(ctx, params)
 	if err != nil {
 		return nil, fmt.Errorf("token exchange: %v", err)
 	}
@@ -72,38 +67,33 @@ func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err er
 	return
 }
 
-func (p *OIDCProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+func (p *OIDCProvider) RefreshSessionIfNeeded(ctx context.Context, s *SessionState) (bool, error) {
 	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
 		return false, nil
 	}
 
 	origExpiration := s.ExpiresOn
 
-	err := p.redeemRefreshToken(s)
+	err := p.redeemRefreshToken(ctx, s)
 	if err != nil {
-		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
+		return false, fmt.Errorf("unable to redeem refresh token: %w", err)
 	}
 
 	fmt.Printf("refreshed id token %s (expired on %s)\n", s, origExpiration)
 	return true, nil
 }
 
-func (p *OIDCProvider) redeemRefreshToken(s *SessionState) (err error) {
-	c := oauth2.Config{
-		ClientID:     p.ClientID,
-		ClientSecret: p.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			TokenURL: p.RedeemURL.String(),
-		},
-	}
-	ctx := context.Background()
-	t := &oauth2.Token{
-		RefreshToken: s.RefreshToken,
-		Expiry:       time.Now().Add(-time.Hour),
-	}
-	token, err := c.TokenSource(ctx, t).Token()
+func (p *OIDCProvider) redeemRefreshToken(ctx context.Context, s *SessionState) (err error) {
+	params := url.Values{}
+	params.Add("refresh_token", s.RefreshToken)
+	params.Add("grant_type", "refresh_token")
+	token, err := p.redeemToken(ctx, params)
 	if err != nil {
-		return fmt.Errorf("failed to get token: %v", err)
+		return fmt.Errorf("failed to get token: %w", err)
+	}
+	// the provider may not issue a new refresh token
+	if token.RefreshToken == "" {
+		token.RefreshToken = s.RefreshToken
 	}
 	newSession, err := p.createSessionState(token, ctx)
 	if err != nil {
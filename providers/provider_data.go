@@ -1,18 +1,26 @@
 package providers
 
 import (
+	"net/http"
 	"net/url"
 )
 
 type ProviderData struct {
-	ProviderName      string
-	ClientID          string
-	ClientSecret      string
+	ProviderName string
+	ClientID     string
+	ClientSecret string
+	// ClientAuth authenticates requests to the token endpoint, by default
+	// with the ClientID and ClientSecret as form params
+	ClientAuth ClientAuthenticator
+	// HTTPClient makes the requests to the provider, by default
+	// http.DefaultClient
+	HTTPClient        *http.Client
 	LoginURL          *url.URL
 	RedeemURL         *url.URL
 	ProfileURL        *url.URL
 	ProtectedResource *url.URL
 	ValidateURL       *url.URL
+	DeviceAuthURL     *url.URL
 	Scope             string
 	Prompt            string
 	ApprovalPrompt    string
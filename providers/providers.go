@@ -1,18 +1,22 @@
 package providers
 
 import (
+	"context"
+
 	"github.com/ploxiln/oauth2_proxy/cookie"
 )
 
 type Provider interface {
 	Data() *ProviderData
-	GetEmailAddress(*SessionState) (string, error)
-	GetUserName(*SessionState) (string, error)
-	Redeem(string, string) (*SessionState, error)
-	ValidateGroup(string) bool
-	ValidateSessionState(*SessionState) bool
+	GetEmailAddress(context.Context, *SessionState) (string, error)
+	GetUserName(context.Context, *SessionState) (string, error)
+	Redeem(context.Context, string, string) (*SessionState, error)
+	StartDeviceAuth(context.Context) (*DeviceAuth, error)
+	RedeemDeviceCode(context.Context, string) (*SessionState, error)
+	ValidateGroup(context.Context, *SessionState) bool
+	ValidateSessionState(context.Context, *SessionState) error
 	GetLoginURL(redirectURI, finalRedirect string) string
-	RefreshSessionIfNeeded(*SessionState) (bool, error)
+	RefreshSessionIfNeeded(context.Context, *SessionState) (bool, error)
 	SessionFromCookie(string, *cookie.Cipher) (*SessionState, error)
 	CookieForSession(*SessionState, *cookie.Cipher) (string, error)
 }
@@ -35,6 +39,12 @@ func New(provider string, p *ProviderData) Provider {
 		return NewDiscordProvider(p)
 	case "bitbucket":
 		return NewBitbucketProvider(p)
+	case "gitea":
+		return NewGiteaProvider(p)
+	case "forgejo":
+		gp := NewGiteaProvider(p)
+		gp.ProviderName = "Forgejo"
+		return gp
 	default:
 		return NewGoogleProvider(p)
 	}
@@ -0,0 +1,209 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/ploxiln/oauth2_proxy/api"
+)
+
+// maxRetryBackoff caps the (exponentially growing) delay between retries
+const maxRetryBackoff = 5 * time.Second
+
+// StatusError is a response from the provider with an unexpected status
+type StatusError struct {
+	StatusCode int
+	Endpoint   string
+	Body       []byte
+}
+
+func newStatusError(status int, endpoint *url.URL, body []byte) *StatusError {
+	return &StatusError{status, endpoint.String(), body}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got %d from %q %s", e.StatusCode, e.Endpoint, e.Body)
+}
+
+// IsUnavailable returns whether err is from the provider failing to respond
+// (a connection error, timeout, open circuit or 5xx response), rather than
+// e.g. rejecting a token with a 4xx response
+func IsUnavailable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var apiErr *api.StatusError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code >= 500
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return retrieveErr.Response != nil && retrieveErr.Response.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// CircuitBreaker tracks failures (connection errors, timeouts and 5xx
+// responses) per provider endpoint (scheme, host and path). After threshold
+// consecutive failures requests to the endpoint fail immediately, until
+// cooldown has passed. Failures are forgotten after cooldown without another
+// one.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointState
+}
+
+type endpointState struct {
+	failures    int
+	lastFailure time.Time
+	openUntil   time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		endpoints: make(map[string]*endpointState),
+	}
+}
+
+// allow returns false if the circuit for endpoint is open
+func (b *CircuitBreaker) allow(endpoint string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.endpoints[endpoint]
+	return !ok || !e.openUntil.After(b.now())
+}
+
+// record the result of a request to endpoint
+func (b *CircuitBreaker) record(endpoint string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.prune(now)
+	if !failed {
+		delete(b.endpoints, endpoint)
+		return
+	}
+	e, ok := b.endpoints[endpoint]
+	if !ok {
+		e = &endpointState{}
+		b.endpoints[endpoint] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	if b.threshold > 0 && e.failures >= b.threshold {
+		if !e.openUntil.After(now) {
+			log.Printf("provider endpoint %s failed %d times, opening circuit for %s", endpoint, e.failures, b.cooldown)
+		}
+		e.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// prune forgets endpoints whose circuit is closed and which have not failed
+// for cooldown, so that endpoints with e.g. a username in the path do not
+// accumulate
+func (b *CircuitBreaker) prune(now time.Time) {
+	for endpoint, e := range b.endpoints {
+		if !e.openUntil.After(now) && now.Sub(e.lastFailure) >= b.cooldown {
+			delete(b.endpoints, endpoint)
+		}
+	}
+}
+
+// retryTransport retries idempotent requests which fail with a connection
+// error, timeout or 5xx response, with exponential backoff and jitter. Other
+// responses, including 4xx, are returned as is.
+type retryTransport struct {
+	retries int
+	backoff time.Duration
+	breaker *CircuitBreaker
+	next    http.RoundTripper
+}
+
+func retryable(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	if t.breaker != nil && !t.breaker.allow(endpoint) {
+		return nil, fmt.Errorf("%s: provider unavailable (circuit open)", endpoint)
+	}
+
+	retries := t.retries
+	if !idempotent(req.Method) {
+		retries = 0
+	}
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = t.next.RoundTrip(req)
+		if !retryable(resp, err) || attempt >= retries {
+			break
+		}
+		if err != nil {
+			log.Printf("%s %s failed, retrying: %s", req.Method, endpoint, err)
+		} else {
+			log.Printf("%s %s got %d, retrying", req.Method, endpoint, resp.StatusCode)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if werr := t.wait(req, attempt); werr != nil {
+			return nil, werr
+		}
+	}
+	if t.breaker != nil {
+		t.breaker.record(endpoint, retryable(resp, err))
+	}
+	return resp, err
+}
+
+// wait sleeps for a random duration up to backoff * 2^attempt ("full jitter")
+func (t *retryTransport) wait(req *http.Request, attempt int) error {
+	if t.backoff <= 0 {
+		return nil
+	}
+	max := t.backoff << uint(attempt)
+	if max <= 0 || max > maxRetryBackoff {
+		max = maxRetryBackoff
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(max) + 1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
@@ -0,0 +1,153 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+
+	"github.com/ploxiln/oauth2_proxy/api"
+)
+
+func testRetryBackend(statuses ...int) (*httptest.Server, *int) {
+	requests := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if requests < len(statuses) {
+			status = statuses[requests]
+		}
+		requests++
+		w.WriteHeader(status)
+	})), &requests
+}
+
+func TestRetryServerErrors(t *testing.T) {
+	b, requests := testRetryBackend(502, 503, 200)
+	defer b.Close()
+
+	client, err := NewHTTPClient(HTTPClientConfig{Retries: 2, RetryBackoff: time.Millisecond})
+	assert.Equal(t, nil, err)
+	resp, err := client.Get(b.URL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 3, *requests)
+
+	// not more than Retries
+	b2, requests := testRetryBackend(500)
+	defer b2.Close()
+	resp, err = client.Get(b2.URL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, 3, *requests)
+}
+
+func TestRetryNotClientErrorsOrPost(t *testing.T) {
+	b, requests := testRetryBackend(404, 200)
+	defer b.Close()
+
+	client, err := NewHTTPClient(HTTPClientConfig{Retries: 2, RetryBackoff: time.Millisecond})
+	assert.Equal(t, nil, err)
+	resp, err := client.Get(b.URL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.Equal(t, 1, *requests)
+
+	b2, requests := testRetryBackend(503, 200)
+	defer b2.Close()
+	resp, err = client.Post(b2.URL, "application/x-www-form-urlencoded", strings.NewReader("code=abc"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, 1, *requests)
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	b, _ := testRetryBackend(200)
+	b.Close()
+
+	breaker := NewCircuitBreaker(0, time.Minute)
+	client, err := NewHTTPClient(HTTPClientConfig{Retries: 1, RetryBackoff: time.Millisecond, Breaker: breaker})
+	assert.Equal(t, nil, err)
+	_, err = client.Get(b.URL)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, IsUnavailable(err))
+	assert.Equal(t, 1, len(breaker.endpoints))
+}
+
+func TestIsUnavailable(t *testing.T) {
+	endpoint, _ := url.Parse("https://provider.example.com/token")
+	assert.Equal(t, true, IsUnavailable(newStatusError(503, endpoint, nil)))
+	assert.Equal(t, false, IsUnavailable(newStatusError(401, endpoint, nil)))
+	assert.Equal(t, true, IsUnavailable(fmt.Errorf("refreshing: %w", newStatusError(500, endpoint, nil))))
+	assert.Equal(t, false, IsUnavailable(fmt.Errorf("refreshing: %s", newStatusError(500, endpoint, nil))))
+	assert.Equal(t, true, IsUnavailable(&api.StatusError{StatusCode: 502}))
+	assert.Equal(t, false, IsUnavailable(&api.StatusError{StatusCode: 404}))
+	assert.Equal(t, true, IsUnavailable(&googleapi.Error{Code: 503}))
+	assert.Equal(t, false, IsUnavailable(&googleapi.Error{Code: 403}))
+	assert.Equal(t, false, IsUnavailable(errors.New("not in the group(s)")))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b, requests := testRetryBackend(503, 503, 503, 200)
+	defer b.Close()
+	other, otherRequests := testRetryBackend(200)
+	defer other.Close()
+
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+	client, err := NewHTTPClient(HTTPClientConfig{Breaker: breaker})
+	assert.Equal(t, nil, err)
+
+	// failures are counted per endpoint
+	resp, err := client.Get(b.URL + "/userinfo")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	resp, err = client.Get(b.URL + "/userinfo?alt=json")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 503, resp.StatusCode)
+
+	// open: requests fail without reaching the provider
+	_, err = client.Get(b.URL + "/userinfo")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, IsUnavailable(err))
+	assert.Equal(t, 2, *requests)
+
+	// other endpoints are not affected
+	resp, err = client.Get(b.URL + "/orgs/x/members/alice")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, 3, *requests)
+	resp, err = client.Get(other.URL + "/userinfo")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 1, *otherRequests)
+
+	// after the cooldown a request is allowed, and a success closes it
+	now = now.Add(2 * time.Minute)
+	resp, err = client.Get(b.URL + "/userinfo")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 0, len(breaker.endpoints))
+}
+
+func TestCircuitBreakerForgetsFailures(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	breaker.record("https://a.example.com/userinfo", true)
+	breaker.record("https://a.example.com/orgs/x/members/alice", true)
+	now = now.Add(2 * time.Minute)
+	breaker.record("https://a.example.com/userinfo", true)
+	// the other endpoint's failure is forgotten, and the earlier failure does not count
+	assert.Equal(t, 1, len(breaker.endpoints))
+	assert.Equal(t, 1, breaker.endpoints["https://a.example.com/userinfo"].failures)
+	assert.Equal(t, true, breaker.allow("https://a.example.com/userinfo"))
+}
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +16,9 @@ type SessionState struct {
 	RefreshToken string
 	Email        string
 	User         string
+	// Groups holds provider groups (or similar) the user was found in, which
+	// are passed on to the upstream
+	Groups []string
 }
 
 func (s *SessionState) IsExpired() bool {
@@ -46,7 +50,15 @@ func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
 }
 
 func (s *SessionState) accountInfo() string {
-	return fmt.Sprintf("email:%s user:%s", s.Email, s.User)
+	info := fmt.Sprintf("email:%s user:%s", s.Email, s.User)
+	if len(s.Groups) > 0 {
+		groups := make([]string, len(s.Groups))
+		for i, g := range s.Groups {
+			groups[i] = url.PathEscape(g)
+		}
+		info += " groups:" + strings.Join(groups, ",")
+	}
+	return info
 }
 
 func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
@@ -71,8 +83,8 @@ func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 
 func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 	chunks := strings.Split(v, " ")
-	if len(chunks) != 2 {
-		return nil, fmt.Errorf("could not decode session state: expected 2 chunks got %d", len(chunks))
+	if len(chunks) != 2 && len(chunks) != 3 {
+		return nil, fmt.Errorf("could not decode session state: expected 2 or 3 chunks got %d", len(chunks))
 	}
 
 	email := strings.TrimPrefix(chunks[0], "email:")
@@ -81,7 +93,17 @@ func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 		user = strings.Split(email, "@")[0]
 	}
 
-	return &SessionState{User: user, Email: email}, nil
+	var groups []string
+	if len(chunks) == 3 {
+		for _, g := range strings.Split(strings.TrimPrefix(chunks[2], "groups:"), ",") {
+			if g, err = url.PathUnescape(g); err != nil {
+				return nil, fmt.Errorf("could not decode session state groups: %s", err)
+			}
+			groups = append(groups, g)
+		}
+	}
+
+	return &SessionState{User: user, Email: email, Groups: groups}, nil
 }
 
 func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error) {
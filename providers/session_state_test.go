@@ -127,6 +127,34 @@ func TestSessionStateSerializationNoCipherWithUser(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationWithGroups(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		User:        "just-user",
+		Email:       "user@domain.com",
+		Groups:      []string{"group/sub group", "a,b"},
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+	}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user:just-user groups:group%2Fsub%20group,a%2Cb", encoded)
+
+	ss, err := DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.User, ss.User)
+	assert.Equal(t, s.Groups, ss.Groups)
+
+	encoded, err = s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err = DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, s.Groups, ss.Groups)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+}
+
 func TestSessionStateAccountInfo(t *testing.T) {
 	s := &SessionState{
 		Email: "user@domain.com",
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the requests it matches (by path regex) with a token bucket
+// for each user, or for each client address for requests which do not need
+// authentication. The spec is space separated, e.g.
+//
+//	path=^/api/ rate=10/s burst=20
+//	rate=600/m
+//
+// The burst defaults to one second of requests, at least 1.
+type RateLimit struct {
+	spec  string
+	path  *regexp.Regexp
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	nextPrune time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rateUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+func parseRateLimit(spec string) (*RateLimit, error) {
+	r := &RateLimit{spec: spec, buckets: make(map[string]*tokenBucket), now: time.Now}
+	for _, field := range strings.Fields(spec) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "path":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path: %s", err)
+			}
+			r.path = re
+		case "rate":
+			rate := strings.SplitN(value, "/", 2)
+			n, err := strconv.ParseFloat(rate[0], 64)
+			if err != nil || n <= 0 || len(rate) != 2 || rateUnits[rate[1]] == 0 {
+				return nil, fmt.Errorf("invalid rate %q, must be like 10/s, 100/m or 1000/h", value)
+			}
+			r.rate = n / rateUnits[rate[1]].Seconds()
+		case "burst":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid burst %q", value)
+			}
+			r.burst = float64(n)
+		default:
+			return nil, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	if r.rate == 0 {
+		return nil, fmt.Errorf("a rate is required")
+	}
+	if r.burst == 0 {
+		r.burst = math.Max(1, math.Ceil(r.rate))
+	}
+	return r, nil
+}
+
+func (r *RateLimit) String() string {
+	return r.spec
+}
+
+// Matches returns true if the limit applies to req
+func (r *RateLimit) Matches(req *http.Request) bool {
+	return r.path == nil || r.path.MatchString(cleanPath(req.URL.Path))
+}
+
+// Allow takes a token from the key's bucket, or returns false and how long
+// until there is one
+func (r *RateLimit) Allow(key string) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.prune(now)
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = math.Min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / r.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets buckets which have refilled, at most every minute
+func (r *RateLimit) prune(now time.Time) {
+	if now.Before(r.nextPrune) {
+		return
+	}
+	r.nextPrune = now.Add(time.Minute)
+	full := time.Duration(r.burst / r.rate * float64(time.Second))
+	for k, b := range r.buckets {
+		if now.Sub(b.last) > full {
+			delete(r.buckets, k)
+		}
+	}
+}
+
+// matchRateLimit returns the first limit which matches req, or nil
+func matchRateLimit(limits []*RateLimit, req *http.Request) *RateLimit {
+	for _, r := range limits {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return nil
+}
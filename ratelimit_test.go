@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+func mustParseRateLimits(t *testing.T, specs ...string) []*RateLimit {
+	var limits []*RateLimit
+	for _, spec := range specs {
+		limit, err := parseRateLimit(spec)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", spec, err)
+		}
+		limits = append(limits, limit)
+	}
+	return limits
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limits := mustParseRateLimits(t, "path=^/api/ rate=10/s burst=20", "rate=90/m", "rate=1/h")
+	assert.Equal(t, 10.0, limits[0].rate)
+	assert.Equal(t, 20.0, limits[0].burst)
+	assert.Equal(t, 1.5, limits[1].rate)
+	assert.Equal(t, 2.0, limits[1].burst)
+	assert.Equal(t, 1.0, limits[2].burst)
+
+	for _, spec := range []string{
+		"path=^/api/",
+		"rate=10",
+		"rate=10/d",
+		"rate=0/s",
+		"rate=x/s",
+		"rate=10/s burst=0",
+		"rate=10/s path=[",
+		"rate=10/s user=bob",
+	} {
+		_, err := parseRateLimit(spec)
+		assert.NotEqual(t, nil, err, spec)
+	}
+}
+
+func TestRateLimitAllow(t *testing.T) {
+	now := time.Now()
+	limit := mustParseRateLimits(t, "rate=2/s burst=3")[0]
+	limit.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limit.Allow("user:bob")
+		assert.Equal(t, true, ok)
+	}
+	ok, wait := limit.Allow("user:bob")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	// others have their own bucket
+	ok, _ = limit.Allow("user:alice")
+	assert.Equal(t, true, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = limit.Allow("user:bob")
+	assert.Equal(t, true, ok)
+	ok, _ = limit.Allow("user:bob")
+	assert.Equal(t, false, ok)
+
+	// refilled buckets are forgotten
+	now = now.Add(2 * time.Minute)
+	limit.Allow("user:carol")
+	assert.Equal(t, 1, len(limit.buckets))
+}
+
+func TestProxyRateLimits(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{ProviderName: "Test Provider"},
+		ValidToken:   true,
+	}
+	test.proxy.compiledRegex = []*regexp.Regexp{regexp.MustCompile("^/public/")}
+	test.proxy.rateLimits = mustParseRateLimits(t,
+		"path=^/api/ rate=1/m burst=2",
+		"path=^/public/ rate=1/m",
+	)
+	upstream := http.NewServeMux()
+	upstream.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	})
+	test.proxy.serveMux = upstream
+
+	var log bytes.Buffer
+	handler := LoggingHandler(&log, test.proxy, "", nil, "{{.StatusCode}} {{.RateLimit}}")
+	serve := func(path, remoteAddr string, session *providers.SessionState) *httptest.ResponseRecorder {
+		test.req = httptest.NewRequest("GET", path, nil)
+		test.req.RemoteAddr = remoteAddr
+		if session != nil {
+			test.SaveSession(session, time.Now())
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, test.req)
+		return rw
+	}
+
+	bob := &providers.SessionState{Email: "bob@example.com", User: "bob", AccessToken: "token"}
+	alice := &providers.SessionState{Email: "alice@example.com", User: "alice", AccessToken: "token"}
+	assert.Equal(t, 200, serve("/api/x", "192.0.2.1:1234", bob).Code)
+	assert.Equal(t, 200, serve("/api/x", "192.0.2.1:1234", bob).Code)
+	rw := serve("/api/x", "192.0.2.2:1234", bob)
+	assert.Equal(t, 429, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+	assert.Equal(t, "", rw.Header().Get("GAP-Rate-Limit"))
+	assert.Equal(t, 200, serve("/api/x", "192.0.2.1:1234", alice).Code)
+	// the path is cleaned as for authz-rules
+	assert.Equal(t, 429, serve("//api/x", "192.0.2.1:1234", bob).Code)
+	// not limited
+	assert.Equal(t, 200, serve("/app", "192.0.2.1:1234", bob).Code)
+
+	// by client address without authentication
+	assert.Equal(t, 200, serve("/public/x", "192.0.2.1:1234", nil).Code)
+	assert.Equal(t, 429, serve("/public/x", "192.0.2.1:1234", nil).Code)
+	assert.Equal(t, 200, serve("/public/x", "192.0.2.2:1234", nil).Code)
+
+	assert.Equal(t, "200 -\n200 -\n429 \"path=^/api/ rate=1/m burst=2\"\n200 -\n429 \"path=^/api/ rate=1/m burst=2\"\n200 -\n"+
+		"200 -\n429 \"path=^/public/ rate=1/m\"\n200 -\n", log.String())
+}
@@ -1,67 +1,351 @@
 package main
 
 import (
+	"bufio"
 	"encoding/csv"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+// UserEntry holds the optional restrictions of an authenticated-emails-file
+// entry, given as extra columns, e.g.
+//
+//	contractor@example.com,expires=2026-12-31,groups=dev,paths=^/app/ ^/docs/
+type UserEntry struct {
+	// From and Expires bound when the entry is valid, if set
+	From    time.Time
+	Expires time.Time
+	// Groups, if set, must include one of the session's groups
+	Groups []string
+	// Paths, if set, must match the request path
+	Paths []*regexp.Regexp
+	// Deny is set for a ! entry, denying the email
+	Deny bool
+}
+
+// Active returns whether the entry is valid at the time
+func (e *UserEntry) Active(now time.Time) bool {
+	if !e.From.IsZero() && now.Before(e.From) {
+		return false
+	}
+	if !e.Expires.IsZero() && !now.Before(e.Expires) {
+		return false
+	}
+	return true
+}
+
+// Allows returns whether the entry's groups and paths allow the request
+func (e *UserEntry) Allows(groups []string, path string) bool {
+	if len(e.Groups) > 0 && !hasAnyGroup(groups, e.Groups) {
+		return false
+	}
+	if len(e.Paths) == 0 {
+		return true
+	}
+	for _, re := range e.Paths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyGroup(groups []string, allowed []string) bool {
+	for _, g := range groups {
+		for _, a := range allowed {
+			if g == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseEntryTime parses a date (meaning the start of that day, UTC) or a
+// RFC3339 time
+func parseEntryTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseUserEntry parses the columns after the email address
+func parseUserEntry(columns []string) (*UserEntry, error) {
+	entry := &UserEntry{}
+	for _, column := range columns {
+		column = strings.TrimSpace(column)
+		if column == "" {
+			continue
+		}
+		kv := strings.SplitN(column, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", column)
+		}
+		value := strings.TrimSpace(kv[1])
+		var err error
+		switch strings.TrimSpace(kv[0]) {
+		case "from":
+			entry.From, err = parseEntryTime(value)
+		case "expires":
+			entry.Expires, err = parseEntryTime(value)
+			// a date is valid through the end of that day
+			if err == nil && len(value) == len("2006-01-02") {
+				entry.Expires = entry.Expires.AddDate(0, 0, 1)
+			}
+		case "groups":
+			entry.Groups = strings.Fields(value)
+		case "paths":
+			for _, p := range strings.Fields(value) {
+				var re *regexp.Regexp
+				re, err = regexp.Compile(p)
+				if err != nil {
+					break
+				}
+				entry.Paths = append(entry.Paths, re)
+			}
+		default:
+			return nil, fmt.Errorf("unknown column %q", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", kv[0], err)
+		}
+	}
+	return entry, nil
+}
+
+// userPattern is a glob or regex entry
+type userPattern struct {
+	re    *regexp.Regexp
+	entry *UserEntry
+}
+
+// userList is a loaded authenticated-emails-file
+type userList struct {
+	exact    map[string]*UserEntry
+	patterns []*userPattern
+	// denied entries take precedence
+	denied         map[string]bool
+	deniedPatterns []*regexp.Regexp
+}
+
+// deniedEntry is returned by Lookup for denied emails
+var deniedEntry = &UserEntry{Deny: true}
+
+// parseUserPattern parses a glob (with * and ?) or /regex/ entry, or returns
+// nil for an exact email address. Regexes must match the whole address. Both
+// are matched without regard to case; a regex is not lowercased, since that
+// would change escapes like \S into their opposites.
+func parseUserPattern(address string) (*regexp.Regexp, error) {
+	if len(address) > 1 && strings.HasPrefix(address, "/") && strings.HasSuffix(address, "/") {
+		return regexp.Compile("(?i)^(?:" + address[1:len(address)-1] + ")$")
+	}
+	if !strings.ContainsAny(address, "*?") {
+		return nil, nil
+	}
+	glob := regexp.QuoteMeta(strings.ToLower(address))
+	glob = strings.Replace(glob, `\*`, ".*", -1)
+	glob = strings.Replace(glob, `\?`, ".", -1)
+	return regexp.Compile("^" + glob + "$")
+}
+
+// add adds a line of the file
+func (l *userList) add(record []string) error {
+	address := strings.TrimSpace(record[0])
+	deny := strings.HasPrefix(address, "!")
+	if deny {
+		address = strings.TrimSpace(address[1:])
+	}
+	if address == "" {
+		return fmt.Errorf("missing email address")
+	}
+	re, err := parseUserPattern(address)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %s", address, err)
+	}
+	entry, err := parseUserEntry(record[1:])
+	if err != nil {
+		return err
+	}
+	if deny {
+		for _, column := range record[1:] {
+			if strings.TrimSpace(column) != "" {
+				return fmt.Errorf("deny entries can not have restrictions")
+			}
+		}
+		if re != nil {
+			l.deniedPatterns = append(l.deniedPatterns, re)
+		} else {
+			l.denied[strings.ToLower(address)] = true
+		}
+	} else if re != nil {
+		l.patterns = append(l.patterns, &userPattern{re, entry})
+	} else {
+		l.exact[strings.ToLower(address)] = entry
+	}
+	return nil
+}
+
+func (l *userList) isDenied(email string) bool {
+	if l.denied[email] {
+		return true
+	}
+	for _, re := range l.deniedPatterns {
+		if re.MatchString(email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *userList) lookup(email string) *UserEntry {
+	if entry, ok := l.exact[email]; ok {
+		return entry
+	}
+	for _, p := range l.patterns {
+		if p.re.MatchString(email) {
+			return p.entry
+		}
+	}
+	return nil
+}
+
+// normalizePlus removes a +tag from the local part of the email
+func normalizePlus(email string) string {
+	at := strings.LastIndex(email, "@")
+	if plus := strings.Index(email, "+"); plus >= 0 && plus < at {
+		return email[:plus] + email[at:]
+	}
+	return email
+}
+
 type UserMap struct {
 	usersFile string
 	m         unsafe.Pointer
+	// NormalizePlus also looks up user+tag@domain addresses as user@domain
+	NormalizePlus bool
 }
 
 func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
 	um := &UserMap{usersFile: usersFile}
-	m := make(map[string]bool)
-	atomic.StorePointer(&um.m, unsafe.Pointer(&m))
+	l := &userList{exact: make(map[string]*UserEntry), denied: make(map[string]bool)}
 	if usersFile != "" {
 		log.Printf("using authenticated emails file %s", usersFile)
+		var err error
+		// an invalid file is fatal at startup, as its deny entries would be lost
+		if l, err = um.readFile(); err != nil {
+			log.Fatalf("error reading authenticated-emails-file=%q, %s", usersFile, err)
+		}
 		WatchForUpdates(usersFile, done, func() {
 			um.LoadAuthenticatedEmailsFile()
 			onUpdate()
 		})
-		um.LoadAuthenticatedEmailsFile()
 	}
+	atomic.StorePointer(&um.m, unsafe.Pointer(l))
 	return um
 }
 
-func (um *UserMap) IsValid(email string) (result bool) {
-	m := *(*map[string]bool)(atomic.LoadPointer(&um.m))
-	_, result = m[email]
-	return
+// Lookup returns the entry for the (lower-cased) email, if listed. Denied
+// emails, by an exact or pattern entry, return an entry with Deny set.
+// Otherwise an exact entry is used before the first matching pattern.
+func (um *UserMap) Lookup(email string) (*UserEntry, bool) {
+	l := (*userList)(atomic.LoadPointer(&um.m))
+	emails := []string{email}
+	if normalized := normalizePlus(email); um.NormalizePlus && normalized != email {
+		emails = append(emails, normalized)
+	}
+	for _, e := range emails {
+		if l.isDenied(e) {
+			return deniedEntry, true
+		}
+	}
+	for _, e := range emails {
+		if entry := l.lookup(e); entry != nil {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+func (um *UserMap) IsValid(email string) bool {
+	entry, ok := um.Lookup(email)
+	return ok && !entry.Deny && entry.Active(time.Now())
+}
+
+// Allows returns whether the entry for the email, if any, is active and
+// allows the groups and request path
+func (um *UserMap) Allows(email string, groups []string, path string) bool {
+	if um == nil {
+		return true
+	}
+	entry, ok := um.Lookup(strings.ToLower(email))
+	return !ok || (!entry.Deny && entry.Active(time.Now()) && entry.Allows(groups, path))
 }
 
+// LoadAuthenticatedEmailsFile reloads the file. If it is invalid, the
+// previous list is kept.
 func (um *UserMap) LoadAuthenticatedEmailsFile() {
+	updated, err := um.readFile()
+	if err != nil {
+		log.Printf("error reading authenticated-emails-file=%q, %s; keeping the previous list", um.usersFile, err)
+		return
+	}
+	atomic.StorePointer(&um.m, unsafe.Pointer(updated))
+}
+
+// readFile reads one email address, glob (e.g. *@example.com) or /regex/ per
+// line, optionally followed by columns of restrictions (see UserEntry).
+// Entries starting with ! deny the emails they match. Invalid lines are logged
+// with their line numbers.
+func (um *UserMap) readFile() (*userList, error) {
 	r, err := os.Open(um.usersFile)
 	if err != nil {
 		log.Fatalf("failed opening authenticated-emails-file=%q, %s", um.usersFile, err)
 	}
 	defer r.Close()
-	csv_reader := csv.NewReader(r)
-	csv_reader.Comma = ','
-	csv_reader.Comment = '#'
-	csv_reader.TrimLeadingSpace = true
-	records, err := csv_reader.ReadAll()
-	if err != nil {
-		log.Printf("error reading authenticated-emails-file=%q, %s", um.usersFile, err)
-		return
+	l := &userList{exact: make(map[string]*UserEntry), denied: make(map[string]bool)}
+	invalid := 0
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		csv_reader := csv.NewReader(strings.NewReader(line))
+		csv_reader.Comma = ','
+		csv_reader.TrimLeadingSpace = true
+		record, err := csv_reader.Read()
+		if err == nil {
+			err = l.add(record)
+		}
+		if err != nil {
+			log.Printf("error reading authenticated-emails-file=%q line %d, %s", um.usersFile, lineno, err)
+			invalid++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	updated := make(map[string]bool)
-	for _, r := range records {
-		address := strings.ToLower(strings.TrimSpace(r[0]))
-		updated[address] = true
+	if invalid > 0 {
+		return nil, fmt.Errorf("%d invalid lines", invalid)
 	}
-	atomic.StorePointer(&um.m, unsafe.Pointer(&updated))
+	return l, nil
 }
 
 func newValidatorImpl(domains []string, usersFile string, done <-chan bool, onUpdate func()) func(string) bool {
-	validUsers := NewUserMap(usersFile, done, onUpdate)
+	return newValidatorWithUsers(domains, NewUserMap(usersFile, done, onUpdate))
+}
 
+// newValidatorWithUsers returns a validator of email addresses in the domains
+// or the users list. An entry in the list which denies the email or is not
+// active (e.g. expired) is not valid, even in the domains.
+func newValidatorWithUsers(domains []string, validUsers *UserMap) func(string) bool {
 	var allowAll bool
 	for i, domain := range domains {
 		if domain == "*" {
@@ -76,12 +360,12 @@ func newValidatorImpl(domains []string, usersFile string, done <-chan bool, onUp
 			return
 		}
 		email = strings.ToLower(email)
+		if entry, ok := validUsers.Lookup(email); ok {
+			return !entry.Deny && entry.Active(time.Now())
+		}
 		for _, domain := range domains {
 			valid = valid || strings.HasSuffix(email, domain)
 		}
-		if !valid {
-			valid = validUsers.IsValid(email)
-		}
 		if allowAll {
 			valid = true
 		}
@@ -89,7 +373,3 @@ func newValidatorImpl(domains []string, usersFile string, done <-chan bool, onUp
 	}
 	return validator
 }
-
-func NewValidator(domains []string, usersFile string) func(string) bool {
-	return newValidatorImpl(domains, usersFile, nil, func() {})
-}
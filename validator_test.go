@@ -1,10 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
 )
 
 type ValidatorTest struct {
@@ -207,3 +215,286 @@ func TestValidatorOverwriteEmailListDirectly(t *testing.T) {
 		t.Error("email added to list should validate")
 	}
 }
+
+func TestValidatorEntryExpiry(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"expired@example.com,expires=2001-01-01",
+		"current@example.com, expires=2999-12-31",
+		"later@example.com,from=2999-01-01T00:00:00Z",
+		"window@example.com,from=2001-01-01,expires=2999-01-01T00:00:00Z",
+	})
+	domains := []string{"example.com"}
+	validator := vt.NewValidator(domains, nil)
+
+	if validator("expired@example.com") {
+		t.Error("expired email should not validate, even in the domain")
+	}
+	if !validator("current@example.com") {
+		t.Error("email before its expiry should validate")
+	}
+	if validator("later@example.com") {
+		t.Error("email before its start should not validate")
+	}
+	if !validator("window@example.com") {
+		t.Error("email within its time window should validate")
+	}
+	if !validator("other@example.com") {
+		t.Error("unlisted email in the domain should validate")
+	}
+}
+
+func TestParseUserEntry(t *testing.T) {
+	entry, err := parseUserEntry([]string{"expires=2020-02-29", "groups=ops dev", "paths=^/app/ ^/docs/", ""})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), entry.Expires)
+	assert.Equal(t, true, entry.Active(time.Date(2020, 2, 29, 23, 59, 0, 0, time.UTC)))
+	assert.Equal(t, false, entry.Active(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, true, entry.Allows([]string{"dev"}, "/docs/x"))
+	assert.Equal(t, false, entry.Allows([]string{"dev"}, "/admin/"))
+	assert.Equal(t, false, entry.Allows([]string{"qa"}, "/app/"))
+	assert.Equal(t, false, entry.Allows(nil, "/app/"))
+
+	for _, columns := range [][]string{
+		{"expires=2020-13-01"},
+		{"from=yesterday"},
+		{"paths=^/app/ ["},
+		{"group=ops"},
+		{"ops"},
+	} {
+		_, err := parseUserEntry(columns)
+		assert.NotEqual(t, nil, err, columns)
+	}
+}
+
+func TestValidatorInvalidLineKeepsList(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{"xyzzy@example.com"})
+	updated := make(chan bool)
+	validator := vt.NewValidator(nil, updated)
+
+	if !validator("xyzzy@example.com") {
+		t.Error("email in list should validate")
+	}
+
+	vt.WriteEmails(t, []string{
+		"plugh@example.com",
+		"contractor@example.com,expires=soon",
+	})
+	<-updated
+
+	if !validator("xyzzy@example.com") {
+		t.Error("email list should be kept when a line is invalid")
+	}
+	if validator("plugh@example.com") {
+		t.Error("emails from the invalid file should not validate")
+	}
+}
+
+func TestProxyAuthenticatedEmailsEntries(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"expired@example.com,expires=2001-01-01",
+		"contractor@example.com,groups=contractors,paths=^/app/",
+	})
+	users := NewUserMap(vt.authEmailFileName, vt.done, func() {})
+
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{ProviderName: "Test Provider"},
+		ValidToken:   true,
+	}
+	test.proxy.Validator = newValidatorWithUsers([]string{"example.com"}, users)
+	test.proxy.AuthenticatedEmails = users
+	upstream := http.NewServeMux()
+	upstream.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	})
+	test.proxy.serveMux = upstream
+
+	serve := func(path string, session *providers.SessionState) *httptest.ResponseRecorder {
+		test.req = httptest.NewRequest("GET", path, nil)
+		test.SaveSession(session, time.Now())
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw
+	}
+
+	// the session of an expired entry is removed
+	rw := serve("/app/", &providers.SessionState{Email: "expired@example.com", AccessToken: "token"})
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Header().Get("Set-Cookie"), "_oauth2_proxy=;")
+
+	contractor := &providers.SessionState{Email: "contractor@example.com", Groups: []string{"contractors"}, AccessToken: "token"}
+	assert.Equal(t, 200, serve("/app/x", contractor).Code)
+	rw = serve("/admin/", contractor)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Permission Denied")
+	assert.Equal(t, 403, serve("/app/x", &providers.SessionState{Email: "contractor@example.com", AccessToken: "token"}).Code)
+
+	// unlisted users in the domain are not restricted
+	assert.Equal(t, 200, serve("/admin/", &providers.SessionState{Email: "staff@example.com", AccessToken: "token"}).Code)
+}
+
+func TestAuthOnlyEndpointAuthenticatedEmailsPaths(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{"contractor@example.com,paths=^/app/"})
+	users := NewUserMap(vt.authEmailFileName, vt.done, func() {})
+
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.Validator = newValidatorWithUsers([]string{"example.com"}, users)
+	test.proxy.AuthenticatedEmails = users
+	contractor := &providers.SessionState{Email: "contractor@example.com", AccessToken: "token"}
+
+	auth := func(header, uri string) int {
+		test.req = httptest.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+		if header != "" {
+			test.req.Header.Set(header, uri)
+		}
+		test.SaveSession(contractor, time.Now())
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw.Code
+	}
+
+	// the path of the original request is checked
+	assert.Equal(t, 202, auth("X-Original-URI", "/app/x?y=z"))
+	assert.Equal(t, 202, auth("X-Forwarded-Uri", "/app/"))
+	assert.Equal(t, 403, auth("X-Original-URI", "/admin/"))
+	assert.Equal(t, 403, auth("X-Original-URI", "/app/../admin/"))
+	// without it, paths= entries are denied
+	assert.Equal(t, 403, auth("", ""))
+}
+
+func TestValidatorPatternsAndDenies(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"*@contractors.example.com,expires=2999-01-01",
+		"lead@contractors.example.com",
+		"!former@contractors.example.com",
+		"/[a-z]+\\.ops@example\\.org/",
+		"/.*@example\\.com/",
+		"!/test-.*/",
+		"!carol@contractors.example.com,",
+		"!*@old.example.com",
+		"alice@example.net",
+		"/\\S+@nospace\\.example\\.com/",
+		"!/\\D+[0-9]@Digits\\.Example\\.com/",
+		"*@Digits.Example.com",
+		"Mixed@Case.Example.com",
+	})
+	domains := []string{"old.example.com"}
+	validator := vt.NewValidator(domains, nil)
+
+	for email, valid := range map[string]bool{
+		"bob@contractors.example.com":      true,
+		"Bob@Contractors.Example.com":      true,
+		"bob@sub.contractors.example.com":  false,
+		"former@contractors.example.com":   false,
+		"lead@contractors.example.com":     true,
+		"jane.ops@example.org":             true,
+		"JANE.OPS@example.org":             true,
+		"jane.ops@example.org.evil.com":    false,
+		"x@example.com":                    true,
+		"x@example.com.evil.com":           false,
+		"carol@contractors.example.com":    false,
+		"test-jane.ops@example.org":        false,
+		"test-1@contractors.example.com":   false,
+		"someone@old.example.com":          false,
+		"alice@example.net":                true,
+		"alice+tag@example.net":            false,
+		"bob@contractors.example.com.evil": false,
+		// regexes keep their escapes, e.g. \S is not lowercased to \s
+		"x@nospace.example.com":   true,
+		"x y@nospace.example.com": false,
+		"abc1@digits.example.com": false,
+		"123@digits.example.com":  true,
+		"mixed@case.example.com":  true,
+	} {
+		assert.Equal(t, valid, validator(email), email)
+	}
+}
+
+func TestUserMapNormalizePlus(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"alice@example.com",
+		"*@contractors.example.com",
+		"!bob@contractors.example.com",
+	})
+	users := NewUserMap(vt.authEmailFileName, vt.done, func() {})
+
+	assert.Equal(t, false, users.IsValid("alice+tag@example.com"))
+	users.NormalizePlus = true
+	assert.Equal(t, true, users.IsValid("alice+tag@example.com"))
+	assert.Equal(t, true, users.IsValid("alice@example.com"))
+	assert.Equal(t, false, users.IsValid("alice+tag@example.org"))
+	// denies apply to the normalized address too
+	assert.Equal(t, true, users.IsValid("carol+x@contractors.example.com"))
+	assert.Equal(t, false, users.IsValid("bob+x@contractors.example.com"))
+}
+
+func TestValidatorPatternsReload(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{"*@example.com"})
+	updated := make(chan bool)
+	validator := vt.NewValidator(nil, updated)
+
+	if !validator("xyzzy@example.com") {
+		t.Error("email matching the pattern should validate")
+	}
+
+	vt.WriteEmails(t, []string{
+		"*@example.com",
+		"!xyzzy@example.com",
+	})
+	<-updated
+
+	if validator("xyzzy@example.com") {
+		t.Error("denied email should not validate after reload")
+	}
+	if !validator("plugh@example.com") {
+		t.Error("email matching the pattern should validate after reload")
+	}
+}
+
+func TestUserListAddErrors(t *testing.T) {
+	for _, record := range [][]string{
+		{""},
+		{"!"},
+		{"/[/"},
+		{"!bob@example.com", "expires=2999-01-01"},
+		{"*@example.com", "expires=never"},
+	} {
+		l := &userList{exact: make(map[string]*UserEntry), denied: make(map[string]bool)}
+		assert.NotEqual(t, nil, l.add(record), record)
+	}
+}
+
+func TestUserMapReadFileErrors(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer os.Remove(vt.authEmailFileName)
+
+	vt.WriteEmails(t, []string{
+		"alice@example.com",
+		"!bob@example.com,expires=2999-01-01",
+		"/[/",
+	})
+	um := &UserMap{usersFile: vt.authEmailFileName}
+	_, err := um.readFile()
+	assert.Equal(t, "2 invalid lines", fmt.Sprint(err))
+}